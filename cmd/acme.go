@@ -0,0 +1,68 @@
+/*
+Copyright © 2021 Mark Ignacio <mark@ignacio.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+// acmeCmd groups the ACME DNS-01 helpers
+var acmeCmd = &cobra.Command{
+	Use:   "acme",
+	Short: "Creates and cleans ACME DNS-01 challenge records, compatible with lego's exec provider.",
+	Long: `Creates and cleans _acme-challenge TXT records in the Cloudflare zone so that tailnet devices can
+get certificates for their public names. The subcommands take the same arguments as lego's exec
+provider, so a wrapper script running "tailscale2cloudflare acme "$@"" works as its EXEC_PATH:
+
+  EXEC_PATH=/path/to/tailscale2cloudflare-acme lego --dns exec ...`,
+}
+
+var acmePresentCmd = &cobra.Command{
+	Use:   "present <fqdn> <value>",
+	Short: "Create a challenge TXT record",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			cfToken = mustLoadViperString("cloudflare-token", "Cloudflare API token")
+			cfZone  = mustLoadCloudflareZone(cfToken)
+		)
+		if err := sync.PresentACMEChallenge(cmd.Context(), cfToken, cfZone, args[0], args[1]); err != nil {
+			log.Fatal().Err(err).Msg("error presenting ACME challenge")
+		}
+	},
+}
+
+var acmeCleanupCmd = &cobra.Command{
+	Use:   "cleanup <fqdn> <value>",
+	Short: "Delete a challenge TXT record",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			cfToken = mustLoadViperString("cloudflare-token", "Cloudflare API token")
+			cfZone  = mustLoadCloudflareZone(cfToken)
+		)
+		if err := sync.CleanupACMEChallenge(cmd.Context(), cfToken, cfZone, args[0], args[1]); err != nil {
+			log.Fatal().Err(err).Msg("error cleaning up ACME challenge")
+		}
+	},
+}
+
+func init() {
+	acmeCmd.AddCommand(acmePresentCmd, acmeCleanupCmd)
+	rootCmd.AddCommand(acmeCmd)
+}
@@ -0,0 +1,170 @@
+/*
+Copyright © 2021 Mark Ignacio <mark@ignacio.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	stdsync "sync"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/zalando/go-keyring"
+	"golang.org/x/term"
+)
+
+const keyringService = "tailscale2cloudflare"
+
+// keyringCredentials are the flags that auth login can store in the OS credential store.
+var keyringCredentials = []struct{ name, humanName string }{
+	{"tailscale-key", "Tailscale API key"},
+	{"tailscale-oauth-secret", "Tailscale OAuth client secret"},
+	{"cloudflare-token", "Cloudflare API token"},
+}
+
+var authCmd = &cobra.Command{
+	Use:   "auth",
+	Short: "Manages credentials stored in the OS credential store.",
+}
+
+var authLoginCmd = &cobra.Command{
+	Use:   "login",
+	Short: "Stores the Tailscale API key and Cloudflare API token in the OS credential store.",
+	Long: `Prompts for the Tailscale API key (or OAuth client secret) and Cloudflare API token and stores
+them in the macOS Keychain, Windows Credential Manager, or the Secret Service (e.g. GNOME Keyring) on
+Linux. Later runs use them whenever --tailscale-key, --tailscale-oauth-secret, or --cloudflare-token
+aren't given some other way, so tokens stay out of shell history and env files. Leave a prompt blank
+to keep what's stored.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		reader := bufio.NewReader(os.Stdin)
+		for _, credential := range keyringCredentials {
+			secret, err := promptSecret(reader, credential.humanName)
+			if err != nil {
+				log.Fatal().Err(err).Msg("error reading credential")
+			}
+			if secret == "" {
+				continue
+			}
+			if err := keyring.Set(keyringService, credential.name, secret); err != nil {
+				log.Fatal().Err(err).Str("credential", credential.name).Msg("error storing credential")
+			}
+			log.Info().Str("credential", credential.name).Msg("stored credential")
+		}
+	},
+}
+
+var authLogoutCmd = &cobra.Command{
+	Use:   "logout",
+	Short: "Removes stored credentials from the OS credential store.",
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, credential := range keyringCredentials {
+			err := keyring.Delete(keyringService, credential.name)
+			if err != nil && !errors.Is(err, keyring.ErrNotFound) {
+				log.Fatal().Err(err).Str("credential", credential.name).Msg("error removing credential")
+			}
+		}
+		log.Info().Msg("removed stored credentials")
+	},
+}
+
+// promptSecret reads a line from stdin, without echoing it if stdin is a terminal.
+func promptSecret(reader *bufio.Reader, humanName string) (string, error) {
+	fmt.Fprintf(os.Stderr, "%s: ", humanName)
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		secret, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return strings.TrimSpace(string(secret)), err
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// keyringLookups remembers which credentials the OS credential store was already asked for.
+var keyringLookups = struct {
+	stdsync.Mutex
+	done map[string]bool
+}{done: map[string]bool{}}
+
+// viperCredential returns the named setting, falling back to the stored credential if it's one auth
+// login stores and it wasn't set by flag, env var, config file, or credential file. The credential
+// store is only queried once a missing credential is actually needed, and at most once per name.
+func viperCredential(name string) string {
+	if value := viper.GetString(name); value != "" {
+		return value
+	}
+	stored := false
+	for _, credential := range keyringCredentials {
+		stored = stored || credential.name == name
+	}
+	keyringLookups.Lock()
+	defer keyringLookups.Unlock()
+	if !stored || keyringLookups.done[name] {
+		return viper.GetString(name)
+	}
+	keyringLookups.done[name] = true
+	secret, err := keyring.Get(keyringService, name)
+	if err != nil {
+		if !errors.Is(err, keyring.ErrNotFound) {
+			log.Debug().Err(err).Str("credential", name).Msg("error reading credential store")
+		}
+		return ""
+	}
+	viper.SetDefault(name, secret)
+	return secret
+}
+
+// readCredentialFile reads a credential from a file, e.g. a mounted Kubernetes secret, trimming the
+// surrounding whitespace.
+func readCredentialFile(path string) (string, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading credential file: %s", err)
+	}
+	credential := strings.TrimSpace(string(body))
+	if credential == "" {
+		return "", fmt.Errorf("credential file %s is empty", path)
+	}
+	return credential, nil
+}
+
+// loadCredentialFiles reads credentials from the files given for them with --<name>-file, which take
+// precedence over values set any other way.
+func loadCredentialFiles() {
+	for _, name := range []string{"tailscale-key", "cloudflare-token"} {
+		path := viper.GetString(name + "-file")
+		if path == "" {
+			continue
+		}
+		credential, err := readCredentialFile(path)
+		if err != nil {
+			log.Fatal().Err(err).Str("credential", name).Msg("error reading credential")
+		}
+		viper.Set(name, credential)
+	}
+}
+
+func init() {
+	authCmd.AddCommand(authLoginCmd, authLogoutCmd)
+	rootCmd.AddCommand(authCmd)
+}
@@ -0,0 +1,120 @@
+/*
+Copyright © 2021 Mark Ignacio <mark@ignacio.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// cleanupCmd deletes records pointing at Tailscale addresses that no device has anymore
+var cleanupCmd = &cobra.Command{
+	Use:   "cleanup",
+	Short: "Deletes orphaned records pointing at Tailscale addresses no device has.",
+	Long: `Records created under older naming schemes, e.g. with --sync-hostnames, aren't recognized by
+syncs once the naming changes, so they outlive the devices they pointed at. cleanup lists the A
+records under each job's subdomain that point into 100.64.0.0/10 at an address no device in the
+job's tailnet has, whatever they're named, and asks before deleting them. Records without the job's
+--record-prefix are left to other tailnets, and with --ownership-txt, so are records without the
+job's ownership record.
+
+Records pointing at a current device's address are left alone, as are --protect'ed ones. To move
+hostname records that still point at devices over to machine names, use migrate.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		acquireLockFile()
+		jobs := loadJobs()
+		dryRun := viper.GetBool("dry-run")
+		var (
+			ctx     context.Context
+			cancel  context.CancelFunc
+			confirm func(ctx context.Context, result *sync.Result) (bool, error)
+		)
+		if viper.GetBool("yes") {
+			ctx, cancel = syncContext(context.Background())
+		} else {
+			ctx, cancel, confirm = confirmingContext(context.Background())
+		}
+		defer cancel()
+		st := loadState()
+		start := time.Now()
+		var (
+			results []*sync.Result
+			applied []sync.Mutation
+			errs    []error
+		)
+		for _, job := range jobs {
+			logger := log.With().Str("job", job.Name).Logger()
+			tsKey, err := tailscaleAPIKey(ctx, job.TailscaleKey, job.TailscaleOAuthClientID, job.TailscaleOAuthSecret)
+			if err != nil {
+				logger.Error().Err(err).Msg("error getting Tailscale access token")
+				errs = append(errs, fmt.Errorf("%s: %s", job.Name, err))
+				continue
+			}
+			syncer := &sync.Syncer{
+				Tailscale: &sync.TailscaleAPI{Key: tsKey},
+				DNS:       job.dnsProvider(),
+			}
+			result, err := syncer.Prune(ctx, job.TailscaleTailnet, job.zone, job.CloudflareSubdomain, &sync.PruneOptions{
+				DryRun:       dryRun,
+				Protect:      viperStringSlice("protect"),
+				RecordPrefix: job.RecordPrefix,
+				Ownership:    viper.GetBool("ownership-txt"),
+				OwnerID:      viper.GetString("owner-id"),
+				Confirm:      confirm,
+				Logger:       &logger,
+			})
+			if err != nil {
+				logger.Error().Err(err).Msg("error cleaning up orphaned records")
+				errs = append(errs, fmt.Errorf("%s: %s", job.Name, err))
+			}
+			if result != nil {
+				results = append(results, result)
+				if !result.DryRun {
+					applied = append(applied, result.Applied()...)
+				}
+			}
+		}
+		if len(applied) > 0 {
+			st.RecordHistory(start, applied, viper.GetInt("history-limit"))
+			saveState(st)
+		}
+		if err := errors.Join(errs...); err != nil {
+			log.Fatal().Err(err).Msg("error cleaning up orphaned records")
+		}
+		result := sync.MergeResults(results...)
+		if dryRun {
+			if err := writePlanTable(os.Stdout, result.Plan); err != nil {
+				log.Fatal().Err(err).Msg("error writing orphaned records")
+			}
+		}
+		log.Info().Str("summary", result.Summary()).Msg("cleanup finished")
+	},
+}
+
+func init() {
+	flags := cleanupCmd.Flags()
+	flags.BoolP("yes", "y", false, "delete orphaned records without asking first")
+	viper.BindPFlags(flags)
+	rootCmd.AddCommand(cleanupCmd)
+}
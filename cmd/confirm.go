@@ -0,0 +1,92 @@
+/*
+Copyright © 2021 Mark Ignacio <mark@ignacio.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	stdsync "sync"
+	"time"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+	"github.com/spf13/viper"
+)
+
+var (
+	// confirmMu keeps concurrent jobs from prompting over one another
+	confirmMu    stdsync.Mutex
+	confirmInput = bufio.NewReader(os.Stdin)
+)
+
+// confirmingContext is syncContext for syncs that ask before applying changes: --timeout stops
+// counting while confirm waits for an answer, and starts over once there is one, so a slow answer
+// doesn't leave the confirmed changes no time to be applied.
+func confirmingContext(parent context.Context) (context.Context, context.CancelFunc, func(context.Context, *sync.Result) (bool, error)) {
+	timeout := viper.GetDuration("timeout")
+	if timeout <= 0 {
+		ctx, cancel := context.WithCancel(parent)
+		return ctx, cancel, confirmChanges
+	}
+	var (
+		ctx, cancel = context.WithCancel(parent)
+		deadline    = time.AfterFunc(timeout, cancel)
+		mu          stdsync.Mutex
+		waiting     int // jobs waiting on an answer, which all pause the deadline
+	)
+	confirm := func(ctx context.Context, result *sync.Result) (bool, error) {
+		mu.Lock()
+		if waiting++; waiting == 1 {
+			deadline.Stop()
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			if waiting--; waiting == 0 {
+				deadline.Reset(timeout)
+			}
+			mu.Unlock()
+		}()
+		return confirmChanges(ctx, result)
+	}
+	return ctx, func() {
+		deadline.Stop()
+		cancel()
+	}, confirm
+}
+
+// confirmChanges shows result's planned changes on stderr and asks whether to apply them, taking
+// anything but yes as a no.
+func confirmChanges(ctx context.Context, result *sync.Result) (bool, error) {
+	confirmMu.Lock()
+	defer confirmMu.Unlock()
+	if err := writePlanTable(os.Stderr, result.Plan); err != nil {
+		return false, err
+	}
+	fmt.Fprintf(os.Stderr, "Apply these %d changes? [y/N] ", len(result.Plan))
+	answer, err := confirmInput.ReadString('\n')
+	if err != nil && answer == "" {
+		fmt.Fprintln(os.Stderr)
+		return false, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
+}
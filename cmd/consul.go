@@ -0,0 +1,65 @@
+/*
+Copyright © 2021 Mark Ignacio <mark@ignacio.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/consul"
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// consulCmd syncs devices into a Consul catalog instead of Cloudflare
+var consulCmd = &cobra.Command{
+	Use:   "consul",
+	Short: "Registers Tailscale devices as external nodes in a Consul catalog.",
+	Long: `Registers each authorized device as an external Consul node (address = Tailscale IP) with a
+service whose tags are the device's Tailscale tags, and deregisters nodes it created for devices that
+are gone. Useful when Consul DNS serves internal names instead of Cloudflare.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			tsKey     = mustLoadTailscaleKey()
+			tsTailnet = mustLoadViperString("tailscale-tailnet", "Tailscale tailnet")
+		)
+		devices, err := sync.ListDevices(cmd.Context(), tsKey, tsTailnet)
+		if err != nil {
+			log.Fatal().Err(err).Msg("error listing Tailscale devices")
+		}
+		err = consul.Sync(sync.PublishedDevices(devices, tsTailnet, viper.GetBool("sync-hostnames")), consul.Options{
+			Address:    viper.GetString("consul-address"),
+			Token:      viper.GetString("consul-token"),
+			Datacenter: viper.GetString("consul-datacenter"),
+			Service:    viper.GetString("consul-service"),
+			Port:       viper.GetInt("consul-service-port"),
+			DryRun:     viper.GetBool("dry-run"),
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("error synchronizing Tailscale -> Consul catalog")
+		}
+	},
+}
+
+func init() {
+	flags := consulCmd.Flags()
+	flags.String("consul-address", "http://127.0.0.1:8500", "Consul HTTP API address")
+	flags.String("consul-token", "", "Consul ACL token")
+	flags.String("consul-datacenter", "", "Consul datacenter, defaults to the agent's")
+	flags.String("consul-service", "tailscale", "service name to register devices under")
+	flags.Int("consul-service-port", 0, "service port to register devices with")
+	viper.BindPFlags(flags)
+	rootCmd.AddCommand(consulCmd)
+}
@@ -0,0 +1,154 @@
+/*
+Copyright © 2021 Mark Ignacio <mark@ignacio.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"os/signal"
+	stdsync "sync"
+	"syscall"
+	"time"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/leader"
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/state"
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/trigger"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// runDaemon syncs every interval (if set), whenever --watch sees devices change or a source triggers
+// a sync, and on SIGHUP, until SIGINT or SIGTERM. Failed syncs are retried with jittered exponential
+// backoff before waiting for the next interval. With --leader-election, only the instance holding the
+// lease syncs.
+func runDaemon(jobs []syncJob, interval time.Duration, sources ...func(ctx context.Context, trigger func())) {
+	if viper.GetBool("confirm") {
+		log.Fatal().Msg("--confirm needs someone to answer it, so it can't be used while running continuously")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if listen := viper.GetString("metrics-listen"); listen != "" {
+		serveMetrics(listen)
+	}
+	// state lives for as long as the daemon, so that failures add up across intervals
+	st := loadState()
+	var (
+		elector *leader.Elector
+		term    context.Context
+	)
+	reconcile := func() {
+		syncCtx := ctx
+		if elector != nil {
+			// stepping down cuts the sync short, before another instance takes over
+			syncCtx = elector.Term()
+			if syncCtx.Err() != nil {
+				log.Debug().Msg("not the leader, skipping sync")
+				return
+			}
+			// another leader may have saved to a shared --state-file since this instance last led
+			if syncCtx != term {
+				term = syncCtx
+				st = loadState()
+			}
+		}
+		syncWithRetries(syncCtx, jobs, st)
+	}
+	coalescer := trigger.New(viper.GetDuration("debounce"), viper.GetDuration("min-interval"), reconcile)
+	coalescer.Logger = &log.Logger
+	// a new leader syncs right away, in case the old one left changes behind
+	elector = newLeaderElector(jobs, coalescer.Trigger)
+	if listen := viper.GetString("health-listen"); listen != "" {
+		serveHealth(listen, time.Duration(viper.GetInt("ready-intervals"))*interval, elector)
+	}
+	var campaign stdsync.WaitGroup
+	if elector != nil {
+		campaign.Add(1)
+		go func() {
+			defer campaign.Done()
+			elector.Run(ctx)
+		}()
+	}
+	go func() {
+		hangups := make(chan os.Signal, 1)
+		signal.Notify(hangups, syscall.SIGHUP)
+		var ticks <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			ticks = ticker.C
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hangups:
+				log.Info().Msg("SIGHUP received, syncing")
+				coalescer.Trigger()
+			case <-ticks:
+				coalescer.Trigger()
+			}
+		}
+	}()
+	if viper.GetBool("watch") {
+		go watchDevices(ctx, jobs, viper.GetDuration("watch-interval"), coalescer.Trigger)
+	}
+	for _, source := range sources {
+		go source(ctx, coalescer.Trigger)
+	}
+	log.Info().Dur("interval", interval).Bool("watch", viper.GetBool("watch")).Msg("running as a daemon")
+	sdNotify("READY=1")
+	go sdWatchdog(ctx)
+	reconcile()
+	coalescer.Serve(ctx)
+	log.Info().Msg("shutting down")
+	sdNotify("STOPPING=1")
+	// let the lease go, so a standby takes over without waiting for it to expire
+	campaign.Wait()
+}
+
+// syncWithRetries syncs, retrying failures up to --retries times, and counts the outcome once in st.
+func syncWithRetries(ctx context.Context, jobs []syncJob, st *state.State) {
+	delay := viper.GetDuration("retry-delay")
+	retries := viper.GetInt("retries")
+	for attempt := 0; ; attempt++ {
+		_, err := syncJobs(ctx, jobs, st)
+		if ctx.Err() != nil {
+			// cut short, which says nothing about whether syncs work
+			saveState(st)
+			return
+		}
+		if err == nil || attempt >= retries {
+			if err != nil {
+				log.Error().Err(err).Msg("error synchronizing Tailscale -> Cloudflare records, waiting for the next interval")
+			}
+			trackFailures(st, err)
+			saveState(st)
+			return
+		}
+		// keep failed mutations queued in case the retries don't get to finish
+		saveState(st)
+		// +/- 20% so that many instances don't retry in lockstep
+		wait := delay + time.Duration((rand.Float64()-0.5)*0.4*float64(delay))
+		log.Warn().Err(err).Dur("retryIn", wait).Int("attempt", attempt+1).Msg("error synchronizing Tailscale -> Cloudflare records, retrying")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
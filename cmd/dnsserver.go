@@ -0,0 +1,140 @@
+/*
+Copyright © 2021 Mark Ignacio <mark@ignacio.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/dnsserver"
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsServerCmd serves device records over DNS instead of (or alongside) Cloudflare
+var dnsServerCmd = &cobra.Command{
+	Use:   "dns-server",
+	Short: "Serves tailnet device records directly over DNS.",
+	Long: `Runs an authoritative DNS server for --dns-domain that answers A queries for
+${machineName}.${dns-domain} with each device's Tailscale IP, refreshing the device list every
+--dns-refresh. Listen on a tailnet address to skip Cloudflare entirely, or to serve a split-horizon
+internal view of the same names, which --split-dns points MagicDNS at.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			tsTailnet = mustLoadViperString("tailscale-tailnet", "Tailscale tailnet")
+			domain    = mustLoadViperString("dns-domain", "domain to serve")
+			listen    = viper.GetString("dns-listen")
+			refresh   = viper.GetDuration("dns-refresh")
+		)
+		if _, err := dnsmessage.NewName("hostmaster." + domain + "."); err != nil {
+			log.Fatal().Err(err).Str("dns-domain", domain).Msg("invalid domain")
+		}
+		server := &dnsserver.Server{Domain: domain, TTL: uint32(viper.GetInt("dns-ttl"))}
+		refreshPublishedDevices(tsTailnet, refresh, server.SetDevices)
+		packetConn, err := net.ListenPacket("udp", listen)
+		if err != nil {
+			log.Fatal().Err(err).Msg("error listening on UDP")
+		}
+		listener, err := net.Listen("tcp", listen)
+		if err != nil {
+			log.Fatal().Err(err).Msg("error listening on TCP")
+		}
+		go func() {
+			log.Fatal().Err(server.ServeTCP(listener)).Msg("error serving DNS over TCP")
+		}()
+		if viper.GetBool("split-dns") {
+			pointSplitDNS(tsTailnet, domain, listen)
+		}
+		log.Info().Str("listen", listen).Str("domain", domain).Msg("serving DNS")
+		log.Fatal().Err(server.ServeUDP(packetConn)).Msg("error serving DNS over UDP")
+	},
+}
+
+// refreshPublishedDevices calls update with the devices a sync would publish, then again every
+// interval in the background. Failing to list devices the first time is fatal, but later failures
+// leave the last known devices in place. The Tailscale key is reloaded each time, so that OAuth access
+// tokens are refreshed.
+func refreshPublishedDevices(tsTailnet string, interval time.Duration, update func(map[string]sync.Device)) {
+	mustLoadTailscaleKey()
+	refresh := func() error {
+		ctx, cancel := syncContext(context.Background())
+		defer cancel()
+		tsKey, err := loadTailscaleKey(ctx)
+		if err != nil {
+			return err
+		}
+		devices, err := sync.ListDevices(ctx, tsKey, tsTailnet)
+		if err != nil {
+			return err
+		}
+		published := sync.PublishedDevices(devices, tsTailnet, viper.GetBool("sync-hostnames"))
+		update(published)
+		log.Debug().Int("devices", len(published)).Msg("refreshed published devices")
+		return nil
+	}
+	if err := refresh(); err != nil {
+		log.Fatal().Err(err).Msg("error listing Tailscale devices")
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := refresh(); err != nil {
+				log.Error().Err(err).Msg("error refreshing Tailscale devices, keeping the last known devices")
+			}
+		}
+	}()
+}
+
+// pointSplitDNS points the tailnet's split DNS for domain at this server, so tailnet members resolve
+// it with MagicDNS while everyone else gets the Cloudflare records.
+func pointSplitDNS(tsTailnet, domain, listen string) {
+	nameserver := viper.GetString("split-dns-nameserver")
+	if nameserver == "" {
+		host, port, err := net.SplitHostPort(listen)
+		if ip := net.ParseIP(host); err != nil || ip == nil || ip.IsUnspecified() {
+			log.Fatal().Str("dns-listen", listen).Msg("--split-dns needs --split-dns-nameserver, or --dns-listen on a tailnet address")
+		}
+		if port != "53" {
+			log.Warn().Str("dns-listen", listen).Msg("split DNS nameservers are queried on port 53, but the server isn't listening there")
+		}
+		nameserver = host
+	}
+	ctx, cancel := syncContext(context.Background())
+	defer cancel()
+	tsKey, err := loadTailscaleKey(ctx)
+	if err != nil {
+		log.Fatal().Err(err).Msg("error getting Tailscale access token")
+	}
+	if err := sync.SetSplitDNS(ctx, tsKey, tsTailnet, domain, []string{nameserver}); err != nil {
+		log.Fatal().Err(err).Msg("error setting Tailscale split DNS")
+	}
+	log.Info().Str("domain", domain).Str("nameserver", nameserver).Msg("pointed tailnet split DNS at this server")
+}
+
+func init() {
+	flags := dnsServerCmd.Flags()
+	flags.String("dns-listen", ":53", "address to serve DNS on, ideally a tailnet address like 100.100.100.100:53")
+	flags.String("dns-domain", "", "domain to be authoritative for, e.g. ts.example.com")
+	flags.Int("dns-ttl", 60, "TTL of served records")
+	flags.Duration("dns-refresh", time.Minute, "how often to refresh the device list")
+	flags.Bool("split-dns", false, "point the tailnet's split DNS for --dns-domain at this server, so MagicDNS resolves it inside the tailnet. Needs an API key or OAuth client allowed to write DNS settings")
+	flags.String("split-dns-nameserver", "", "tailnet address split DNS should send queries to. Defaults to the --dns-listen address")
+	viper.BindPFlags(flags)
+	rootCmd.AddCommand(dnsServerCmd)
+}
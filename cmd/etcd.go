@@ -0,0 +1,68 @@
+/*
+Copyright © 2021 Mark Ignacio <mark@ignacio.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/etcd"
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// etcdCmd syncs devices into etcd for CoreDNS instead of Cloudflare
+var etcdCmd = &cobra.Command{
+	Use:   "etcd",
+	Short: "Writes Tailscale devices into etcd as SkyDNS records for CoreDNS's etcd plugin.",
+	Long: `Writes a SkyDNS-format key for each authorized device, e.g. /skydns/com/example/ts/machine for
+machine.ts.example.com, so CoreDNS's etcd plugin serves the tailnet names. Keys it wrote for devices
+that are gone are deleted; other keys under the domain are left alone.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			tsKey     = mustLoadTailscaleKey()
+			tsTailnet = mustLoadViperString("tailscale-tailnet", "Tailscale tailnet")
+			domain    = mustLoadViperString("etcd-domain", "domain to publish devices under")
+		)
+		devices, err := sync.ListDevices(cmd.Context(), tsKey, tsTailnet)
+		if err != nil {
+			log.Fatal().Err(err).Msg("error listing Tailscale devices")
+		}
+		err = etcd.Sync(sync.PublishedDevices(devices, tsTailnet, viper.GetBool("sync-hostnames")), etcd.Options{
+			Endpoint: viper.GetString("etcd-endpoint"),
+			Username: viper.GetString("etcd-username"),
+			Password: viper.GetString("etcd-password"),
+			Prefix:   viper.GetString("etcd-prefix"),
+			Domain:   domain,
+			TTL:      viper.GetInt("etcd-ttl"),
+			DryRun:   viper.GetBool("dry-run"),
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("error synchronizing Tailscale -> etcd records")
+		}
+	},
+}
+
+func init() {
+	flags := etcdCmd.Flags()
+	flags.String("etcd-endpoint", "http://127.0.0.1:2379", "etcd endpoint")
+	flags.String("etcd-username", "", "etcd username, if auth is enabled")
+	flags.String("etcd-password", "", "etcd password, if auth is enabled")
+	flags.String("etcd-prefix", "/skydns", "CoreDNS etcd plugin path")
+	flags.String("etcd-domain", "", "domain to publish devices under, e.g. ts.example.com")
+	flags.Int("etcd-ttl", 60, "record TTL")
+	viper.BindPFlags(flags)
+	rootCmd.AddCommand(etcdCmd)
+}
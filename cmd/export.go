@@ -0,0 +1,190 @@
+/*
+Copyright © 2021 Mark Ignacio <mark@ignacio.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/export"
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// exportCmd writes the synced device inventory out for other tools
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Exports the tailnet devices that would be synced for use by other tools.",
+	Long: `Renders the same devices that are synced to Cloudflare in another format.
+
+Formats:
+  ssh           Host blocks for ssh_config. Without --output, these are written to a managed
+                section of ~/.ssh/config, leaving the rest of the file alone.
+  ansible       INI inventory grouped by Tailscale tags, with Tailscale IPs as ansible_host.
+  ansible-yaml  The same inventory in YAML.
+  prometheus    Target groups for Prometheus file_sd_configs, or http_sd_configs with --listen.
+  zone          A and AAAA records under --zone-domain as a zone file fragment.
+  reverse-zone  PTR records for the same addresses, e.g. for a 64.100.in-addr.arpa zone.
+  dnsmasq       host-record lines, which dnsmasq answers forward and reverse lookups from.
+  unbound       local-data and local-data-ptr lines for an unbound server: clause.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			tsTailnet = mustLoadViperString("tailscale-tailnet", "Tailscale tailnet")
+			format    = viper.GetString("format")
+			output    = viper.GetString("output")
+		)
+		if listen := viper.GetString("listen"); listen != "" {
+			serveExport(listen, tsTailnet, format)
+			return
+		}
+		rendered, hosts, err := renderExport(cmd.Context(), mustLoadTailscaleKey(), tsTailnet, format)
+		if err != nil {
+			log.Fatal().Err(err).Str("format", format).Msg("error exporting devices")
+		}
+		if format == "ssh" && output == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				log.Fatal().Err(err).Msg("error finding home directory for ~/.ssh/config")
+			}
+			if err := export.WriteManagedSection(filepath.Join(home, ".ssh", "config"), rendered); err != nil {
+				log.Fatal().Err(err).Msg("error updating ~/.ssh/config")
+			}
+			log.Info().Int("hosts", hosts).Msg("updated ~/.ssh/config")
+			return
+		}
+		if output == "" {
+			output = "-"
+		}
+		if err := writeOutput(output, rendered); err != nil {
+			log.Fatal().Err(err).Msg("error writing export")
+		}
+	},
+}
+
+// renderExport fetches the tailnet's devices and renders them in format, also returning how many
+// devices were considered.
+func renderExport(ctx context.Context, tsKey, tsTailnet, format string) ([]byte, int, error) {
+	devices, err := sync.ListDevices(ctx, tsKey, tsTailnet)
+	if err != nil {
+		return nil, 0, err
+	}
+	published := sync.PublishedDevices(devices, tsTailnet, viper.GetBool("sync-hostnames"))
+	var rendered bytes.Buffer
+	switch format {
+	case "ssh":
+		err = export.SSHConfig(&rendered, published, export.SSHOptions{
+			UseDNSNames: viper.GetBool("ssh-dns-names"),
+			TagUsers:    viper.GetStringMapString("ssh-tag-user"),
+			TagPorts:    viper.GetStringMapString("ssh-tag-port"),
+		})
+	case "ansible":
+		err = export.AnsibleINI(&rendered, published)
+	case "ansible-yaml":
+		err = export.AnsibleYAML(&rendered, published)
+	case "prometheus":
+		err = export.PrometheusSD(&rendered, published, viper.GetInt("prometheus-port"))
+	case "zone", "reverse-zone", "dnsmasq", "unbound":
+		domain, ttl := viper.GetString("zone-domain"), viper.GetInt("zone-ttl")
+		if domain == "" {
+			return nil, 0, fmt.Errorf("the %s format needs --zone-domain, e.g. ts.example.com", format)
+		}
+		switch format {
+		case "zone":
+			err = export.ZoneFile(&rendered, published, domain, ttl)
+		case "reverse-zone":
+			err = export.ReverseZoneFile(&rendered, published, domain, ttl)
+		case "dnsmasq":
+			err = export.Dnsmasq(&rendered, published, domain)
+		case "unbound":
+			err = export.Unbound(&rendered, published, domain, ttl)
+		}
+	default:
+		err = fmt.Errorf("unknown export format %q", format)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return rendered.Bytes(), len(published), nil
+}
+
+// serveExport re-renders the export on every GET, e.g. for Prometheus http_sd.
+func serveExport(listen, tsTailnet, format string) {
+	mustLoadTailscaleKey()
+	contentType := "text/plain; charset=utf-8"
+	switch format {
+	case "prometheus":
+		contentType = "application/json"
+	case "ansible-yaml":
+		contentType = "application/yaml"
+	}
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		tsKey, err := loadTailscaleKey(r.Context())
+		if err != nil {
+			log.Error().Err(err).Msg("error getting Tailscale access token")
+			http.Error(w, "error exporting devices", http.StatusBadGateway)
+			return
+		}
+		rendered, _, err := renderExport(r.Context(), tsKey, tsTailnet, format)
+		if err != nil {
+			log.Error().Err(err).Str("format", format).Msg("error exporting devices")
+			http.Error(w, "error exporting devices", http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Write(rendered)
+	})
+	log.Info().Str("listen", listen).Str("format", format).Msg("serving export over HTTP")
+	if err := http.ListenAndServe(listen, nil); err != nil {
+		log.Fatal().Err(err).Msg("error serving export")
+	}
+}
+
+// writeOutput writes to path, or stdout when path is "-".
+func writeOutput(path string, content []byte) error {
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("error creating %s: %s", path, err)
+		}
+		defer f.Close()
+		w = f
+	}
+	_, err := w.Write(content)
+	return err
+}
+
+func init() {
+	flags := exportCmd.Flags()
+	flags.String("format", "ssh", "export format")
+	flags.StringP("output", "o", "", "file to write to, or - for stdout")
+	flags.String("listen", "", "serve the export over HTTP on this address instead of writing it, e.g. :8080")
+	flags.Int("prometheus-port", 9100, "port to scrape on each device")
+	flags.String("zone-domain", "", "domain to name devices under for the zone, reverse-zone, dnsmasq, and unbound formats, e.g. ts.example.com")
+	flags.Int("zone-ttl", 300, "TTL of records in the zone, reverse-zone, and unbound formats")
+	flags.Bool("ssh-dns-names", false, "use MagicDNS names for HostName instead of Tailscale IPs")
+	flags.StringToString("ssh-tag-user", nil, "User for devices with a tag, e.g. tag:server=root")
+	flags.StringToString("ssh-tag-port", nil, "Port for devices with a tag, e.g. tag:server=2222")
+	viper.BindPFlags(flags)
+	rootCmd.AddCommand(exportCmd)
+}
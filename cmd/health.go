@@ -0,0 +1,59 @@
+/*
+Copyright © 2021 Mark Ignacio <mark@ignacio.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/leader"
+	"github.com/rs/zerolog/log"
+)
+
+// serveHealth serves Kubernetes-style probes: /healthz while the process is up, and /readyz while a
+// sync has succeeded within readyAge, with the details as JSON either way. With leader election,
+// elector's standbys are always ready, since only the leader syncs.
+func serveHealth(listen string, readyAge time.Duration, elector *leader.Elector) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"ok"}` + "\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		health := runMetrics.Health(readyAge, time.Now())
+		if elector != nil {
+			if leading := elector.Leading(); leading {
+				health.Leading = &leading
+			} else {
+				health = health.Standby()
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !health.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetEscapeHTML(false)
+		encoder.Encode(health)
+	})
+	log.Info().Str("listen", listen).Msg("serving health checks")
+	go func() {
+		if err := http.ListenAndServe(listen, mux); err != nil {
+			log.Fatal().Err(err).Msg("error serving health checks")
+		}
+	}()
+}
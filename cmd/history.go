@@ -0,0 +1,63 @@
+/*
+Copyright © 2021 Mark Ignacio <mark@ignacio.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/state"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+// historyCmd shows what's been applied from the state file
+var historyCmd = &cobra.Command{
+	Use:   "history [record-name]",
+	Short: "Shows the record changes remembered in --state-file.",
+	Long: `Lists every applied record change remembered in --state-file, oldest first: when records were
+created, what IPs they pointed to, and when they were removed. Pass a record name to only show its
+history.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		statePath := mustLoadViperString("state-file", "state file")
+		st, err := state.Load(statePath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("error loading state")
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TIME\tACTION\tNAME\tCONTENT\tTTL\tRECORD ID")
+		for _, entry := range st.History {
+			if len(args) == 1 && !strings.EqualFold(strings.TrimSuffix(args[0], "."), entry.Name) {
+				continue
+			}
+			ttl := "-"
+			if entry.TTL != 0 {
+				ttl = fmt.Sprint(entry.TTL)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				entry.Time.Local().Format(time.RFC3339), entry.Action, entry.Name, entry.Content, ttl, entry.RecordID)
+		}
+		w.Flush()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(historyCmd)
+}
@@ -0,0 +1,68 @@
+/*
+Copyright © 2021 Mark Ignacio <mark@ignacio.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/icinga"
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// icingaCmd keeps Icinga monitoring hosts in step with the tailnet
+var icingaCmd = &cobra.Command{
+	Use:   "icinga",
+	Short: "Creates Icinga hosts for Tailscale devices via Icinga Director and disables them once devices are gone.",
+	Long: `Creates a host importing --icinga-host-template for each authorized device, addressed by its
+Tailscale IP with its Tailscale tags in vars.tailscale_tags, disables hosts it created for devices that
+are gone, and deploys the config if anything changed. Hosts are named like the DNS records when
+--icinga-domain is set.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			tsKey     = mustLoadTailscaleKey()
+			tsTailnet = mustLoadViperString("tailscale-tailnet", "Tailscale tailnet")
+			url       = mustLoadViperString("icinga-director-url", "Icinga Director URL")
+			template  = mustLoadViperString("icinga-host-template", "Icinga host template")
+		)
+		devices, err := sync.ListDevices(cmd.Context(), tsKey, tsTailnet)
+		if err != nil {
+			log.Fatal().Err(err).Msg("error listing Tailscale devices")
+		}
+		err = icinga.Sync(sync.PublishedDevices(devices, tsTailnet, viper.GetBool("sync-hostnames")), icinga.Options{
+			URL:      url,
+			Username: viper.GetString("icinga-username"),
+			Password: viper.GetString("icinga-password"),
+			Template: template,
+			Domain:   viper.GetString("icinga-domain"),
+			DryRun:   viper.GetBool("dry-run"),
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("error synchronizing Tailscale -> Icinga hosts")
+		}
+	},
+}
+
+func init() {
+	flags := icingaCmd.Flags()
+	flags.String("icinga-director-url", "", "Icinga Director URL, e.g. https://icinga.example.com/icingaweb2/director")
+	flags.String("icinga-username", "", "Icinga Web username")
+	flags.String("icinga-password", "", "Icinga Web password")
+	flags.String("icinga-host-template", "", "host template for created hosts to import")
+	flags.String("icinga-domain", "", "domain to append to host names, e.g. ts.example.com to match the DNS records")
+	viper.BindPFlags(flags)
+	rootCmd.AddCommand(icingaCmd)
+}
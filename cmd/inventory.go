@@ -0,0 +1,70 @@
+/*
+Copyright © 2021 Mark Ignacio <mark@ignacio.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"time"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/notify"
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/state"
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// trackInventory remembers each listed tailnet's devices in st, logging and optionally notifying
+// about devices that appeared or vanished since the last run.
+func trackInventory(ctx context.Context, jobs []syncJob, results []*sync.Result, st *state.State) {
+	var (
+		now     = time.Now().UTC()
+		tracked = map[string]bool{}
+		events  []notify.InventoryEvent
+	)
+	for i, job := range jobs {
+		if results[i] == nil || tracked[job.TailscaleTailnet] {
+			continue
+		}
+		tracked[job.TailscaleTailnet] = true
+		appeared, vanished := st.TrackDevices(job.TailscaleTailnet, results[i].Devices, now)
+		for action, devices := range map[string][]state.KnownDevice{"appeared": appeared, "vanished": vanished} {
+			for _, device := range devices {
+				log.Info().
+					Str("tailnet", job.TailscaleTailnet).
+					Str("name", device.Name).
+					Str("hostname", device.Hostname).
+					Strs("addresses", device.Addresses).
+					Msgf("tailnet device %s", action)
+				events = append(events, notify.InventoryEvent{
+					Type:      "device",
+					Action:    action,
+					Tailnet:   job.TailscaleTailnet,
+					Name:      device.Name,
+					Hostname:  device.Hostname,
+					Addresses: device.Addresses,
+					Time:      now,
+				})
+			}
+		}
+	}
+	webhookURL := viper.GetString("inventory-webhook-url")
+	if webhookURL == "" || len(events) == 0 {
+		return
+	}
+	if err := notify.PostInventoryWebhook(ctx, webhookURL, events); err != nil {
+		log.Warn().Err(err).Msg("error posting device inventory changes")
+	}
+}
@@ -0,0 +1,420 @@
+/*
+Copyright © 2021 Mark Ignacio <mark@ignacio.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	stdsync "sync"
+	"time"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/state"
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// syncJob is one tailnet -> zone sync. Config files can define several under "jobs", and any field
+// left blank falls back to the flag/env var of the same name.
+type syncJob struct {
+	Name             string `mapstructure:"name"`
+	TailscaleKey     string `mapstructure:"tailscale-key"`
+	TailscaleKeyFile string `mapstructure:"tailscale-key-file"`
+	// OAuth client credentials take the place of TailscaleKey
+	TailscaleOAuthClientID string `mapstructure:"tailscale-oauth-client-id"`
+	TailscaleOAuthSecret   string `mapstructure:"tailscale-oauth-secret"`
+	TailscaleTailnet       string `mapstructure:"tailscale-tailnet"`
+	CloudflareToken        string `mapstructure:"cloudflare-token"`
+	CloudflareTokenFile    string `mapstructure:"cloudflare-token-file"`
+	CloudflareZone         string `mapstructure:"cloudflare-zone"`
+	CloudflareZoneName     string `mapstructure:"cloudflare-zone-name"`
+	CloudflareSubdomain    string `mapstructure:"cloudflare-subdomain"`
+	// RecordPrefix lets jobs for several tailnets share a subdomain
+	RecordPrefix string `mapstructure:"record-prefix"`
+	// Provider is the DNS provider, cloudflare or route53. The subdomain applies to either.
+	Provider            string `mapstructure:"provider"`
+	Route53HostedZoneID string `mapstructure:"route53-hosted-zone-id"`
+	// device filters, which only make sense per job
+	Tags        []string `mapstructure:"tags"`
+	ExcludeTags []string `mapstructure:"exclude-tags"`
+	Names       []string `mapstructure:"names"`
+	// OS filters fall back to --include-os and --exclude-os
+	IncludeOS []string `mapstructure:"include-os"`
+	ExcludeOS []string `mapstructure:"exclude-os"`
+
+	// zone is the job's zone ID at its DNS provider
+	zone string
+}
+
+// loadJobs returns the configured jobs, or a single job from flags and env vars if there are none.
+func loadJobs() []syncJob {
+	var jobs []syncJob
+	if err := viper.UnmarshalKey("jobs", &jobs); err != nil {
+		log.Fatal().Err(err).Msg("error reading jobs from config")
+	}
+	if len(jobs) == 0 {
+		jobs = []syncJob{{}}
+	}
+	if len(jobs) > 1 && viper.GetString("rehearse-zone") != "" {
+		// jobs rehearsing in one zone would delete each other's records
+		log.Fatal().Int("jobs", len(jobs)).Msg("--rehearse-zone only works with a single job")
+	}
+	for i := range jobs {
+		job := &jobs[i]
+		if job.TailscaleOAuthClientID == "" {
+			job.TailscaleOAuthClientID = viper.GetString("tailscale-oauth-client-id")
+		}
+		if job.TailscaleOAuthClientID != "" {
+			job.TailscaleOAuthSecret = jobString(job.TailscaleOAuthSecret, "tailscale-oauth-secret", "Tailscale OAuth client secret")
+		} else {
+			jobCredential(&job.TailscaleKey, &job.TailscaleKeyFile, "tailscale-key", "Tailscale API key")
+		}
+		job.TailscaleTailnet = jobString(job.TailscaleTailnet, "tailscale-tailnet", "Tailscale tailnet")
+		if job.Provider == "" {
+			job.Provider = viper.GetString("provider")
+		}
+		switch job.Provider {
+		case "cloudflare":
+			jobCredential(&job.CloudflareToken, &job.CloudflareTokenFile, "cloudflare-token", "Cloudflare API token")
+			if job.CloudflareZone == "" && job.CloudflareZoneName == "" {
+				job.CloudflareZone = viper.GetString("cloudflare-zone")
+				job.CloudflareZoneName = viper.GetString("cloudflare-zone-name")
+			}
+			job.zone = cloudflareZoneID(job.CloudflareToken, job.CloudflareZone, job.CloudflareZoneName)
+			if job.zone == "" {
+				log.Fatal().Msg("Must specify a Cloudflare zone ID or name via environment variable or flag")
+			}
+		case "route53":
+			job.zone = jobString(job.Route53HostedZoneID, "route53-hosted-zone-id", "Route 53 hosted zone ID")
+			mustLoadViperString("aws-access-key-id", "AWS access key ID")
+			mustLoadViperString("aws-secret-access-key", "AWS secret access key")
+		default:
+			log.Fatal().Str("provider", job.Provider).Msg("Unknown DNS provider, must be cloudflare or route53")
+		}
+		if job.CloudflareSubdomain == "" {
+			job.CloudflareSubdomain = viper.GetString("cloudflare-subdomain")
+		}
+		if job.RecordPrefix == "" {
+			job.RecordPrefix = viper.GetString("record-prefix")
+		}
+		if len(job.IncludeOS) == 0 {
+			job.IncludeOS = viperStringSlice("include-os")
+		}
+		if len(job.ExcludeOS) == 0 {
+			job.ExcludeOS = viperStringSlice("exclude-os")
+		}
+		if job.Name == "" {
+			zone := job.zone
+			if job.CloudflareZoneName != "" {
+				zone = job.CloudflareZoneName
+			}
+			job.Name = fmt.Sprintf("%s -> %s", job.TailscaleTailnet, zone)
+			if job.CloudflareSubdomain != "" {
+				job.Name += "/" + job.CloudflareSubdomain
+			}
+		}
+		if strings.HasSuffix(job.CloudflareSubdomain, ".") || strings.HasPrefix(job.CloudflareSubdomain, ".") {
+			log.Fatal().Str("job", job.Name).Str("cloudflare-subdomain", job.CloudflareSubdomain).Msg("Remove '.' at the start/end of this field")
+		}
+		if rehearseZone := viper.GetString("rehearse-zone"); rehearseZone != "" {
+			log.Info().Str("job", job.Name).Str("rehearseZone", rehearseZone).Msg("rehearsing against staging zone instead of the job's zone")
+			job.zone = rehearseZone
+		}
+	}
+	checkSharedSubdomains(jobs)
+	if !viper.GetBool("skip-preflight") {
+		preflightJobs(jobs)
+	}
+	return jobs
+}
+
+// preflightJobs exits if a Cloudflare job's token can't manage its zone, before any sync starts.
+func preflightJobs(jobs []syncJob) {
+	checked := map[string]bool{}
+	for _, job := range jobs {
+		key := job.CloudflareToken + " " + job.zone
+		if job.Provider != "cloudflare" || checked[key] {
+			continue
+		}
+		checked[key] = true
+		ctx, cancel := syncContext(context.Background())
+		err := (&sync.Cloudflare{Token: job.CloudflareToken}).VerifyAccess(ctx, job.zone)
+		cancel()
+		if err != nil {
+			log.Fatal().Err(err).Str("job", job.Name).Msg("Cloudflare token can't manage the job's zone")
+		}
+		log.Debug().Str("job", job.Name).Msg("verified Cloudflare token")
+	}
+}
+
+// checkSharedSubdomains exits if jobs sharing a zone and subdomain could delete each other's records,
+// which record prefixes that don't start with one another prevent.
+func checkSharedSubdomains(jobs []syncJob) {
+	for i, job := range jobs {
+		for _, other := range jobs[i+1:] {
+			if job.Provider != other.Provider || job.zone != other.zone || job.CloudflareSubdomain != other.CloudflareSubdomain {
+				continue
+			}
+			if strings.HasPrefix(job.RecordPrefix, other.RecordPrefix) || strings.HasPrefix(other.RecordPrefix, job.RecordPrefix) {
+				log.Fatal().Str("job", job.Name).Str("otherJob", other.Name).Msg("Jobs sharing a zone and subdomain need record-prefixes that don't start with one another")
+			}
+		}
+	}
+}
+
+func jobString(value, name, humanName string) string {
+	if value != "" {
+		return value
+	}
+	return mustLoadViperString(name, humanName)
+}
+
+// jobCredential fills in a job's credential, reading it from the job's file for it if there is one.
+// Jobs that set neither fall back to the top-level file, then the top-level value.
+func jobCredential(value, path *string, name, humanName string) {
+	if *value == "" && *path == "" {
+		*path = viper.GetString(name + "-file")
+	}
+	if *path == "" {
+		*value = jobString(*value, name, humanName)
+		return
+	}
+	credential, err := readCredentialFile(*path)
+	if err != nil {
+		log.Fatal().Err(err).Msgf("error reading %s", humanName)
+	}
+	*value = credential
+}
+
+// reloadCredentials rereads the job's credential files, so that rotated secrets are picked up.
+func (j *syncJob) reloadCredentials() error {
+	for _, credential := range []struct{ value, path *string }{
+		{&j.TailscaleKey, &j.TailscaleKeyFile},
+		{&j.CloudflareToken, &j.CloudflareTokenFile},
+	} {
+		if *credential.path == "" {
+			continue
+		}
+		value, err := readCredentialFile(*credential.path)
+		if err != nil {
+			return err
+		}
+		*credential.value = value
+	}
+	return nil
+}
+
+// dnsProvider returns the client for the job's DNS provider.
+func (j *syncJob) dnsProvider() sync.DNSProvider {
+	if j.Provider == "route53" {
+		return &sync.Route53{
+			AccessKeyID:     viper.GetString("aws-access-key-id"),
+			SecretAccessKey: viper.GetString("aws-secret-access-key"),
+			SessionToken:    viper.GetString("aws-session-token"),
+		}
+	}
+	return &sync.Cloudflare{Token: j.CloudflareToken}
+}
+
+// snapshotKey identifies the job's snapshot in the state file.
+func (j *syncJob) snapshotKey() string {
+	key := fmt.Sprintf("%s %s %s", j.TailscaleTailnet, j.zone, j.CloudflareSubdomain)
+	if j.RecordPrefix != "" {
+		key += " " + j.RecordPrefix
+	}
+	return key
+}
+
+// runJobs runs every job, up to --parallel-jobs at a time, and combines their results. The result is
+// nil if no job got as far as planning. Each job's failed mutations are queued in st for that job to
+// retry.
+func runJobs(ctx context.Context, jobs []syncJob, st *state.State) (*sync.Result, error) {
+	var recordTypes []string
+	for _, recordType := range viperStringSlice("record-types") {
+		recordTypes = append(recordTypes, strings.ToUpper(recordType))
+	}
+	var overrides map[string]sync.DeviceOverride
+	if err := viper.UnmarshalKey("devices", &overrides); err != nil {
+		return nil, fmt.Errorf("error reading device overrides from config: %s", err)
+	}
+	var (
+		results = make([]*sync.Result, len(jobs))
+		errs    = make([]error, len(jobs))
+		wg      stdsync.WaitGroup
+		slots   = make(chan struct{}, max(viper.GetInt("parallel-jobs"), 1))
+	)
+	var (
+		confirm func(context.Context, *sync.Result) (bool, error)
+		cancel  context.CancelFunc
+	)
+	if viper.GetBool("confirm") {
+		ctx, cancel, confirm = confirmingContext(ctx)
+	} else {
+		ctx, cancel = syncContext(ctx)
+	}
+	defer cancel()
+	for i, job := range jobs {
+		wg.Add(1)
+		go func(i int, job syncJob) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			logger := log.With().Str("job", job.Name).Logger()
+			logger.Debug().Msg("starting sync job")
+			start := time.Now()
+			if err := job.reloadCredentials(); err != nil {
+				errs[i] = err
+				logger.Error().Err(err).Msg("error rereading credentials")
+				return
+			}
+			tsKey, err := tailscaleAPIKey(ctx, job.TailscaleKey, job.TailscaleOAuthClientID, job.TailscaleOAuthSecret)
+			if err != nil {
+				errs[i] = err
+				logger.Error().Err(err).Msg("error getting Tailscale access token")
+				return
+			}
+			pending := append(
+				append([]sync.Mutation(nil), st.PendingMutations[job.snapshotKey()]...),
+				pendingForZone(st.UnkeyedPendingMutations, job.zone, len(jobs) == 1)...,
+			)
+			var snapshot *sync.Snapshot
+			if !viper.GetBool("refresh-state") {
+				snapshot = st.Snapshots[job.snapshotKey()]
+			}
+			syncer := &sync.Syncer{
+				Tailscale: &sync.TailscaleAPI{Key: tsKey},
+				DNS:       job.dnsProvider(),
+				Options: &sync.Tailscale2CloudflareOptions{
+					DryRun:             viper.GetBool("dry-run"),
+					UseHostnames:       viper.GetBool("sync-hostnames"),
+					RemoveUnauthorized: viper.GetBool("remove-unauthorized"),
+					RemoveExpired:      viper.GetBool("remove-expired"),
+					ExpiredGrace:       viper.GetDuration("expired-grace"),
+					SkipEphemeral:      viper.GetBool("skip-ephemeral"),
+					OfflineTTL:         viper.GetInt("offline-ttl"),
+					OfflineAfter:       viper.GetDuration("offline-after"),
+					MaxOffline:         viper.GetDuration("max-offline"),
+					Protect:            viperStringSlice("protect"),
+					RecordTTL:          viper.GetInt("record-ttl"),
+					Proxied:            viper.GetBool("record-proxied"),
+					Overrides:          overrides,
+					RecordMode:         sync.RecordMode(viper.GetString("record-mode")),
+					SubnetRouterSuffix: viper.GetString("subnet-router-suffix"),
+					StrictNames:        viper.GetBool("strict-names"),
+					GroupByUser:        viper.GetBool("group-by-user"),
+					RecordPrefix:       job.RecordPrefix,
+					RecordTemplate:     viper.GetString("record-template"),
+					PendingMutations:   pending,
+					Snapshot:           snapshot,
+					RecordTypes:        recordTypes,
+					Ownership:          viper.GetBool("ownership-txt"),
+					OwnerID:            viper.GetString("owner-id"),
+					DuplicateStrategy:  sync.DuplicateStrategy(viper.GetString("duplicate-strategy")),
+					Concurrency:        viper.GetInt("concurrency"),
+					BatchSize:          viper.GetInt("batch-size"),
+					MaxDeletes:         viper.GetInt("max-deletes"),
+					Confirm:            confirm,
+					Logger:             &logger,
+					Filter: sync.DeviceFilter{
+						Tags:        job.Tags,
+						ExcludeTags: job.ExcludeTags,
+						Names:       job.Names,
+						OS:          job.IncludeOS,
+						ExcludeOS:   job.ExcludeOS,
+					},
+				},
+			}
+			results[i], errs[i] = syncer.Sync(ctx, job.TailscaleTailnet, job.zone, job.CloudflareSubdomain)
+			event := logger.Info()
+			if errs[i] != nil {
+				event = logger.Error().Err(errs[i])
+			}
+			if results[i] != nil {
+				event = event.Str("summary", results[i].Summary())
+			}
+			event.Dur("elapsed", time.Since(start)).Msg("finished sync job")
+		}(i, job)
+	}
+	wg.Wait()
+	trackInventory(ctx, jobs, results, st)
+	for i, job := range jobs {
+		if results[i] == nil || results[i].DryRun {
+			continue
+		}
+		if st.Snapshots == nil {
+			st.Snapshots = map[string]*sync.Snapshot{}
+		}
+		if results[i].Snapshot != nil {
+			st.Snapshots[job.snapshotKey()] = results[i].Snapshot
+		} else {
+			delete(st.Snapshots, job.snapshotKey())
+		}
+		// requeue failures, keeping pending mutations for jobs that didn't get far enough to retry them
+		if st.PendingMutations == nil {
+			st.PendingMutations = map[string][]sync.Mutation{}
+		}
+		if len(results[i].Failed) > 0 {
+			st.PendingMutations[job.snapshotKey()] = results[i].Failed
+		} else {
+			delete(st.PendingMutations, job.snapshotKey())
+		}
+	}
+	var unkeyed []sync.Mutation
+	for _, mutation := range st.UnkeyedPendingMutations {
+		retried := false
+		for i, job := range jobs {
+			if results[i] != nil && !results[i].DryRun && (mutation.Zone == job.zone || mutation.Zone == "" && len(jobs) == 1) {
+				retried = true
+			}
+		}
+		if !retried {
+			unkeyed = append(unkeyed, mutation)
+		}
+	}
+	st.UnkeyedPendingMutations = unkeyed
+
+	for i, err := range errs {
+		if err != nil {
+			errs[i] = fmt.Errorf("%s: %s", jobs[i].Name, err)
+		}
+	}
+	planned := false
+	for _, result := range results {
+		planned = planned || result != nil
+	}
+	if !planned {
+		return nil, errors.Join(errs...)
+	}
+	merged := sync.MergeResults(results...)
+	if len(jobs) > 1 {
+		log.Info().Int("jobs", len(jobs)).Str("summary", merged.Summary()).Msg("finished all sync jobs")
+	}
+	return merged, errors.Join(errs...)
+}
+
+// pendingForZone picks out the unkeyed pending mutations for zone. Mutations queued before zones were
+// recorded only belong to a lone job.
+func pendingForZone(pending []sync.Mutation, zone string, onlyJob bool) []sync.Mutation {
+	var forZone []sync.Mutation
+	for _, mutation := range pending {
+		if mutation.Zone == zone || mutation.Zone == "" && onlyJob {
+			forZone = append(forZone, mutation)
+		}
+	}
+	return forZone
+}
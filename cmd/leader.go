@@ -0,0 +1,146 @@
+/*
+Copyright © 2021 Mark Ignacio <mark@ignacio.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	stdsync "sync"
+	"time"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/leader"
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// newLeaderElector returns an Elector for --leader-election's lease, if set, calling onLeading whenever
+// this instance becomes the leader. It returns nil when every instance should apply changes.
+func newLeaderElector(jobs []syncJob, onLeading func()) *leader.Elector {
+	backend := leaderBackend(jobs)
+	if backend == nil {
+		return nil
+	}
+	holder := viper.GetString("leader-id")
+	if holder == "" {
+		hostname, _ := os.Hostname()
+		holder = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	if strings.ContainsAny(holder, `,="`) {
+		log.Fatal().Str("leaderID", holder).Msg("--leader-id can't contain commas, equals signs, or quotes")
+	}
+	ttl := viper.GetDuration("leader-ttl")
+	if ttl < 3*time.Second {
+		log.Fatal().Dur("leaderTTL", ttl).Msg("--leader-ttl has to be at least 3s")
+	}
+	elector := leader.New(backend, holder, ttl, func(leading bool) {
+		if leading {
+			onLeading()
+		}
+	})
+	elector.Logger = &log.Logger
+	log.Info().Str("leaderID", holder).Dur("leaderTTL", ttl).Msg("campaigning for leader lease, standing by until acquired")
+	return elector
+}
+
+// leaderBackend returns the --leader-election backend, or nil if it's off.
+func leaderBackend(jobs []syncJob) leader.Backend {
+	switch election := viper.GetString("leader-election"); election {
+	case "":
+		return nil
+	case "dns":
+		// the first job's zone holds the lease
+		job := jobs[0]
+		dns := job.dnsProvider()
+		namer, ok := dns.(sync.ZoneNamer)
+		if !ok {
+			log.Fatal().Str("provider", job.Provider).Msg("DNS provider can't look up zone names for --leader-election dns")
+		}
+		zoneName, err := namer.ZoneName(context.Background(), job.zone)
+		if err != nil {
+			log.Fatal().Err(err).Str("job", job.Name).Msg("error looking up zone name for the leader lease record")
+		}
+		name := viper.GetString("leader-record")
+		if job.CloudflareSubdomain != "" {
+			name += "." + job.CloudflareSubdomain
+		}
+		name += "." + zoneName
+		log.Debug().Str("recordName", name).Msg("keeping leader lease in TXT record")
+		return &leader.DNSLease{
+			DNS: func() (sync.DNSProvider, error) {
+				if err := job.reloadCredentials(); err != nil {
+					return nil, err
+				}
+				return job.dnsProvider(), nil
+			},
+			Zone: job.zone,
+			Name: name,
+		}
+	case "file":
+		return &fileLease{path: mustLoadViperString("leader-lock-file", "leader election lock file")}
+	default:
+		log.Fatal().Str("leaderElection", election).Msg("Unknown leader election backend, must be dns or file")
+		return nil
+	}
+}
+
+// fileLease is a leader.Backend holding the lease as a lock on a file, for instances on one host or
+// sharing a filesystem with working locks. The lock is released if the holder dies, so the lease
+// never outlives it and the TTL doesn't matter.
+type fileLease struct {
+	path string
+
+	mu     stdsync.Mutex
+	locked *os.File
+}
+
+func (l *fileLease) Acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.locked != nil {
+		return true, nil
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return false, fmt.Errorf("error opening leader lock file: %s", err)
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		if errors.Is(err, errLocked) {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := f.Truncate(0); err == nil {
+		fmt.Fprintln(f, holder)
+	}
+	l.locked = f
+	return true, nil
+}
+
+func (l *fileLease) Release(ctx context.Context, holder string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.locked == nil {
+		return nil
+	}
+	err := l.locked.Close()
+	l.locked = nil
+	return err
+}
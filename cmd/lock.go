@@ -0,0 +1,55 @@
+/*
+Copyright © 2021 Mark Ignacio <mark@ignacio.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// errLocked means another process holds the lock file.
+var errLocked = errors.New("lock file is held by another process")
+
+// lockedFile is kept open, and so locked, until the process exits.
+var lockedFile *os.File
+
+// acquireLockFile locks --lock-file, if set, for the rest of the process. If another run holds it,
+// this one exits cleanly instead of interleaving its changes with that one's.
+func acquireLockFile() {
+	path := viper.GetString("lock-file")
+	if path == "" {
+		return
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		log.Fatal().Err(err).Str("lockFile", path).Msg("error opening lock file")
+	}
+	if err := lockFile(f); errors.Is(err, errLocked) {
+		log.Info().Str("lockFile", path).Msg("another run holds the lock file, exiting")
+		os.Exit(0)
+	} else if err != nil {
+		log.Fatal().Err(err).Str("lockFile", path).Msg("error locking lock file")
+	}
+	// note who holds it, for humans
+	if err := f.Truncate(0); err == nil {
+		fmt.Fprintf(f, "%d\n", os.Getpid())
+	}
+	lockedFile = f
+}
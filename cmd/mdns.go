@@ -0,0 +1,63 @@
+/*
+Copyright © 2021 Mark Ignacio <mark@ignacio.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"net"
+	"time"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/dnsserver"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// mdnsCmd announces device names on the local network segment
+var mdnsCmd = &cobra.Command{
+	Use:   "mdns",
+	Short: "Announces tailnet device names over mDNS on the local network.",
+	Long: `Answers multicast DNS queries for ${machineName}.local with each device's Tailscale IP from this
+machine, as a zero-configuration complement to the public records. New and changed names are
+announced as the device list is refreshed every --mdns-refresh, and removed names get goodbyes.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			tsTailnet = mustLoadViperString("tailscale-tailnet", "Tailscale tailnet")
+			ifaceName = viper.GetString("mdns-interface")
+			iface     *net.Interface
+		)
+		if ifaceName != "" {
+			var err error
+			if iface, err = net.InterfaceByName(ifaceName); err != nil {
+				log.Fatal().Err(err).Str("mdns-interface", ifaceName).Msg("error finding interface")
+			}
+		}
+		responder := &dnsserver.MDNSResponder{}
+		if err := responder.Listen(iface); err != nil {
+			log.Fatal().Err(err).Msg("error joining mDNS multicast group")
+		}
+		refreshPublishedDevices(tsTailnet, viper.GetDuration("mdns-refresh"), responder.SetDevices)
+		log.Info().Str("interface", ifaceName).Msg("answering mDNS queries")
+		log.Fatal().Err(responder.Serve()).Msg("error serving mDNS")
+	},
+}
+
+func init() {
+	flags := mdnsCmd.Flags()
+	flags.String("mdns-interface", "", "network interface to announce on, defaults to the system's multicast interface")
+	flags.Duration("mdns-refresh", time.Minute, "how often to refresh the device list")
+	viper.BindPFlags(flags)
+	rootCmd.AddCommand(mdnsCmd)
+}
@@ -0,0 +1,59 @@
+/*
+Copyright © 2021 Mark Ignacio <mark@ignacio.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"net/http"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/metrics"
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+	"github.com/rs/zerolog/log"
+)
+
+// runMetrics is updated by every sync, and served by --metrics-listen.
+var runMetrics = metrics.New()
+
+// serveMetrics exposes runMetrics on /metrics, counting API errors from then on.
+func serveMetrics(listen string) {
+	http.DefaultClient.Transport = &metrics.Transport{Metrics: runMetrics, Transport: defaultTransport()}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", runMetrics)
+	log.Info().Str("listen", listen).Msg("serving Prometheus metrics")
+	go func() {
+		if err := http.ListenAndServe(listen, mux); err != nil {
+			log.Fatal().Err(err).Msg("error serving metrics")
+		}
+	}()
+}
+
+// changedRecords counts a result's applied mutations by action.
+func changedRecords(result *sync.Result) map[string]int {
+	changed := map[string]int{}
+	if result == nil {
+		return changed
+	}
+	for _, mutation := range result.Applied() {
+		changed[string(mutation.Action)]++
+	}
+	return changed
+}
+
+func defaultTransport() http.RoundTripper {
+	if http.DefaultClient.Transport != nil {
+		return http.DefaultClient.Transport
+	}
+	return http.DefaultTransport
+}
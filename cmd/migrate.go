@@ -0,0 +1,110 @@
+/*
+Copyright © 2021 Mark Ignacio <mark@ignacio.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// migrateCmd moves zones synced with --sync-hostnames over to machine names
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Migrates records named after device hostnames to machine names.",
+	Long: `Zones synced before machine names were used (or with --sync-hostnames) have records named after
+each device's OS hostname. migrate matches those to devices by name and IP, creates the machine-name
+record for each, and reports the legacy records. With --remove-legacy, they're deleted once every
+machine-name record has been created.
+
+Records that a device's machine name still uses, or whose IP doesn't match the device, are left alone.
+With --ownership-txt, so are records without an ownership record, and the machine-name records get
+one.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		acquireLockFile()
+		jobs := loadJobs()
+		st := loadState()
+		start := time.Now()
+		ctx, cancel := syncContext(context.Background())
+		defer cancel()
+		var (
+			legacy  []sync.LegacyRecord
+			results []*sync.Result
+			applied []sync.Mutation
+			errs    []error
+		)
+		for _, job := range jobs {
+			logger := log.With().Str("job", job.Name).Logger()
+			tsKey, err := tailscaleAPIKey(ctx, job.TailscaleKey, job.TailscaleOAuthClientID, job.TailscaleOAuthSecret)
+			if err != nil {
+				logger.Error().Err(err).Msg("error getting Tailscale access token")
+				errs = append(errs, fmt.Errorf("%s: %s", job.Name, err))
+				continue
+			}
+			syncer := &sync.Syncer{
+				Tailscale: &sync.TailscaleAPI{Key: tsKey},
+				DNS:       job.dnsProvider(),
+			}
+			jobLegacy, result, err := syncer.Migrate(ctx, job.TailscaleTailnet, job.zone, job.CloudflareSubdomain, &sync.MigrateOptions{
+				DryRun:       viper.GetBool("dry-run"),
+				RemoveLegacy: viper.GetBool("remove-legacy"),
+				Ownership:    viper.GetBool("ownership-txt"),
+				OwnerID:      viper.GetString("owner-id"),
+				Logger:       &logger,
+			})
+			if err != nil {
+				logger.Error().Err(err).Msg("error migrating hostname records")
+				errs = append(errs, fmt.Errorf("%s: %s", job.Name, err))
+			}
+			legacy = append(legacy, jobLegacy...)
+			if result != nil {
+				results = append(results, result)
+				if !result.DryRun {
+					applied = append(applied, result.Applied()...)
+				}
+			}
+		}
+		if len(applied) > 0 {
+			st.RecordHistory(start, applied, viper.GetInt("history-limit"))
+			saveState(st)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "LEGACY RECORD\tCONTENT\tMACHINE NAME\tMACHINE NAME EXISTED")
+		for _, record := range legacy {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%t\n", record.Name, record.Content, record.MachineName, record.MachineNameIsUp)
+		}
+		w.Flush()
+		if err := errors.Join(errs...); err != nil {
+			log.Fatal().Err(err).Msg("error migrating hostname records")
+		}
+		log.Info().Str("summary", sync.MergeResults(results...).Summary()).Msg("migration finished")
+	},
+}
+
+func init() {
+	flags := migrateCmd.Flags()
+	flags.Bool("remove-legacy", false, "delete hostname records once their machine-name records exist, instead of only reporting them")
+	viper.BindPFlags(flags)
+	rootCmd.AddCommand(migrateCmd)
+}
@@ -0,0 +1,72 @@
+/*
+Copyright © 2021 Mark Ignacio <mark@ignacio.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	stdsync "sync"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// oauthClients caches a client per OAuth client ID, so access tokens are reused until they're close
+// to expiring, e.g. across daemon syncs.
+var oauthClients = struct {
+	stdsync.Mutex
+	clients map[string]*sync.TailscaleOAuthClient
+}{clients: map[string]*sync.TailscaleOAuthClient{}}
+
+// tailscaleAPIKey returns key, or an access token for the OAuth client if one is given.
+func tailscaleAPIKey(ctx context.Context, key, oauthClientID, oauthSecret string) (string, error) {
+	if oauthClientID == "" {
+		return key, nil
+	}
+	oauthClients.Lock()
+	client, ok := oauthClients.clients[oauthClientID]
+	if !ok {
+		client = &sync.TailscaleOAuthClient{ClientID: oauthClientID, ClientSecret: oauthSecret}
+		oauthClients.clients[oauthClientID] = client
+	}
+	oauthClients.Unlock()
+	return client.Token(ctx)
+}
+
+// loadTailscaleKey returns an API key or access token from flags and env vars. Long-running commands
+// should call it before each use, so that access tokens get refreshed.
+func loadTailscaleKey(ctx context.Context) (string, error) {
+	return tailscaleAPIKey(
+		ctx,
+		viperCredential("tailscale-key"),
+		viper.GetString("tailscale-oauth-client-id"),
+		viperCredential("tailscale-oauth-secret"),
+	)
+}
+
+func mustLoadTailscaleKey() string {
+	if viper.GetString("tailscale-oauth-client-id") == "" {
+		return mustLoadViperString("tailscale-key", "Tailscale API key")
+	}
+	mustLoadViperString("tailscale-oauth-secret", "Tailscale OAuth client secret")
+	ctx, cancel := syncContext(context.Background())
+	defer cancel()
+	key, err := loadTailscaleKey(ctx)
+	if err != nil {
+		log.Fatal().Err(err).Msg("error getting Tailscale access token")
+	}
+	return key
+}
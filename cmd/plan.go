@@ -0,0 +1,83 @@
+/*
+Copyright © 2021 Mark Ignacio <mark@ignacio.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+	"gopkg.in/yaml.v3"
+)
+
+// planDocument is the plan written by --output.
+type planDocument struct {
+	DryRun  bool                 `json:"dryRun" yaml:"dryRun"`
+	Summary string               `json:"summary" yaml:"summary"`
+	Changes []sync.PlannedChange `json:"changes" yaml:"changes"`
+}
+
+// writePlan writes result's planned changes to w as json, yaml, or a table.
+func writePlan(w io.Writer, format string, result *sync.Result) error {
+	doc := planDocument{
+		DryRun:  result.DryRun,
+		Summary: result.Summary(),
+		Changes: result.Plan,
+	}
+	if doc.Changes == nil {
+		doc.Changes = []sync.PlannedChange{}
+	}
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(doc); err != nil {
+			return fmt.Errorf("error encoding plan as JSON: %s", err)
+		}
+	case "yaml":
+		encoder := yaml.NewEncoder(w)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(doc); err != nil {
+			return fmt.Errorf("error encoding plan as YAML: %s", err)
+		}
+		return encoder.Close()
+	case "table":
+		if err := writePlanTable(w, doc.Changes); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintln(w, doc.Summary)
+		return err
+	default:
+		return fmt.Errorf("unknown output format %q, must be json, yaml, or table", format)
+	}
+	return nil
+}
+
+// writePlanTable writes changes to w as a table.
+func writePlanTable(w io.Writer, changes []sync.PlannedChange) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tTYPE\tNAME\tCONTENT\tREASON")
+	for _, change := range changes {
+		content := change.Content
+		if change.Action == sync.MutationRetune {
+			content = fmt.Sprintf("ttl %d", change.TTL)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", change.Action, change.Type, change.Name, content, change.Reason)
+	}
+	return tw.Flush()
+}
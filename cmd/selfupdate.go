@@ -0,0 +1,222 @@
+/*
+Copyright © 2021 Mark Ignacio <mark@ignacio.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// Version is set at build time with -ldflags "-X github.com/mark-ignacio/tailscale2cloudflare/cmd.Version=v1.2.3"
+var Version = "dev"
+
+const (
+	releasesURL       = "https://api.github.com/repos/mark-ignacio/tailscale2cloudflare/releases/latest"
+	checksumsAsset    = "checksums.txt"
+	checksumsSigAsset = "checksums.txt.sig"
+)
+
+type githubRelease struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name               string
+		BrowserDownloadURL string `json:"browser_download_url"`
+	}
+}
+
+// selfUpdateCmd replaces the running binary with the latest release
+var selfUpdateCmd = &cobra.Command{
+	Use:   "self-update",
+	Short: "Updates tailscale2cloudflare to the latest GitHub release.",
+	Long: `Checks GitHub for the latest release, downloads the binary for this platform, verifies it against
+the release's SHA-256 checksums (and their ed25519 signature with --public-key), and replaces the
+running binary in place.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		release, err := latestRelease()
+		if err != nil {
+			log.Fatal().Err(err).Msg("error checking for the latest release")
+		}
+		logger := log.With().Str("current", Version).Str("latest", release.TagName).Logger()
+		if release.TagName == Version {
+			logger.Info().Msg("already up to date")
+			return
+		}
+		if Version == "dev" && !viper.GetBool("force") {
+			logger.Fatal().Msg("this is a development build, pass --force to replace it with a release anyway")
+		}
+		assetName := fmt.Sprintf("tailscale2cloudflare_%s_%s", runtime.GOOS, runtime.GOARCH)
+		if runtime.GOOS == "windows" {
+			assetName += ".exe"
+		}
+		assets := map[string]string{}
+		for _, asset := range release.Assets {
+			assets[asset.Name] = asset.BrowserDownloadURL
+		}
+		if assets[assetName] == "" || assets[checksumsAsset] == "" {
+			logger.Fatal().Str("asset", assetName).Msg("release is missing the binary for this platform or its checksums")
+		}
+		checksums, err := download(assets[checksumsAsset])
+		if err != nil {
+			logger.Fatal().Err(err).Msg("error downloading checksums")
+		}
+		if publicKey := viper.GetString("public-key"); publicKey != "" {
+			if assets[checksumsSigAsset] == "" {
+				logger.Fatal().Msg("release has no checksum signature to verify")
+			}
+			signature, err := download(assets[checksumsSigAsset])
+			if err != nil {
+				logger.Fatal().Err(err).Msg("error downloading checksum signature")
+			}
+			if err := verifySignature(publicKey, checksums, signature); err != nil {
+				logger.Fatal().Err(err).Msg("error verifying checksum signature")
+			}
+		}
+		binary, err := download(assets[assetName])
+		if err != nil {
+			logger.Fatal().Err(err).Msg("error downloading release binary")
+		}
+		if err := verifyChecksum(checksums, assetName, binary); err != nil {
+			logger.Fatal().Err(err).Msg("error verifying release binary")
+		}
+		if err := replaceExecutable(binary); err != nil {
+			logger.Fatal().Err(err).Msg("error replacing binary")
+		}
+		logger.Info().Msg("updated")
+	},
+}
+
+func latestRelease() (*githubRelease, error) {
+	body, err := download(releasesURL)
+	if err != nil {
+		return nil, err
+	}
+	var release githubRelease
+	if err := json.Unmarshal(body, &release); err != nil {
+		return nil, fmt.Errorf("error unmarshalling GitHub release as JSON: %s", err)
+	}
+	return &release, nil
+}
+
+func download(url string) ([]byte, error) {
+	response, err := http.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("error performing GET %s: %s", url, err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading GET %s body: %s", url, err)
+	}
+	if response.StatusCode > http.StatusOK {
+		return nil, fmt.Errorf("non-200 response to GET %s: %d", url, response.StatusCode)
+	}
+	return body, nil
+}
+
+// verifySignature checks a base64 ed25519 signature of the checksums file.
+func verifySignature(publicKey string, checksums, signature []byte) error {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("--public-key must be a base64 ed25519 public key")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return fmt.Errorf("error decoding signature: %s", err)
+	}
+	if !ed25519.Verify(key, checksums, decoded) {
+		return fmt.Errorf("signature does not match checksums")
+	}
+	return nil
+}
+
+// verifyChecksum finds name in sha256sum-formatted checksums and compares it against content.
+func verifyChecksum(checksums []byte, name string, content []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(checksums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || strings.TrimPrefix(fields[1], "*") != name {
+			continue
+		}
+		sum := sha256.Sum256(content)
+		if !strings.EqualFold(fields[0], hex.EncodeToString(sum[:])) {
+			return fmt.Errorf("SHA-256 of %s does not match checksums", name)
+		}
+		return nil
+	}
+	return fmt.Errorf("no checksum for %s", name)
+}
+
+// replaceExecutable swaps the running binary for content via a rename in the same directory.
+func replaceExecutable(content []byte) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("error finding executable: %s", err)
+	}
+	if executable, err = filepath.EvalSymlinks(executable); err != nil {
+		return fmt.Errorf("error resolving executable: %s", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(executable), ".tailscale2cloudflare-update-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing temporary file: %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing temporary file: %s", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return fmt.Errorf("error making temporary file executable: %s", err)
+	}
+	if runtime.GOOS == "windows" {
+		// a running executable can't be replaced, but it can be moved out of the way
+		old := executable + ".old"
+		os.Remove(old)
+		if err := os.Rename(executable, old); err != nil {
+			return fmt.Errorf("error moving old executable: %s", err)
+		}
+	}
+	if err := os.Rename(tmp.Name(), executable); err != nil {
+		return fmt.Errorf("error replacing executable: %s", err)
+	}
+	return nil
+}
+
+func init() {
+	flags := selfUpdateCmd.Flags()
+	flags.Bool("force", false, "replace development builds too")
+	flags.String("public-key", "", "base64 ed25519 public key to verify the release checksums' signature with")
+	viper.BindPFlags(flags)
+	rootCmd.AddCommand(selfUpdateCmd)
+}
@@ -0,0 +1,87 @@
+/*
+Copyright © 2021 Mark Ignacio <mark@ignacio.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/webhook"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// serveCmd syncs on Tailscale webhook events
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Syncs whenever Tailscale sends a device webhook event.",
+	Long: `Listens for Tailscale webhooks on /webhook at --webhook-listen and syncs shortly after devices are
+added, approved, expire, or are deleted, instead of waiting for the next poll. Requests must be signed
+with --webhook-secret, the secret shown when the webhook endpoint was added in the Tailscale admin
+console. Subscribe the endpoint to the nodeCreated, nodeNeedsApproval, nodeApproved, nodeKeyExpired,
+and nodeDeleted events.
+
+Like a daemon, serve syncs once on startup, on SIGHUP, and every --interval if set, which is a good
+safety net for missed webhooks.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		acquireLockFile()
+		var (
+			jobs   = loadJobs()
+			secret = mustLoadViperString("webhook-secret", "Tailscale webhook secret")
+			listen = viper.GetString("webhook-listen")
+		)
+		runDaemon(jobs, viper.GetDuration("interval"), func(ctx context.Context, trigger func()) {
+			serveWebhooks(ctx, listen, secret, trigger)
+		})
+	},
+}
+
+// serveWebhooks listens for webhook requests until ctx is done, calling trigger for device events.
+func serveWebhooks(ctx context.Context, listen, secret string, trigger func()) {
+	mux := http.NewServeMux()
+	mux.Handle("/webhook", &webhook.Handler{
+		Secret: secret,
+		Logger: &log.Logger,
+		OnEvents: func(events []webhook.Event) {
+			relevant := false
+			for _, event := range events {
+				log.Info().Str("type", event.Type).Str("tailnet", event.Tailnet).Str("event", event.Message).Msg("received Tailscale webhook event")
+				relevant = relevant || event.DeviceEvent()
+			}
+			if relevant {
+				trigger()
+			}
+		},
+	})
+	server := &http.Server{Addr: listen, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	log.Info().Str("listen", listen).Msg("listening for Tailscale webhooks")
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal().Err(err).Msg("error serving webhooks")
+	}
+}
+
+func init() {
+	flags := serveCmd.Flags()
+	flags.String("webhook-listen", ":8080", "address to listen for Tailscale webhooks on")
+	flags.String("webhook-secret", "", "secret Tailscale signs webhooks with")
+	viper.BindPFlags(flags)
+	rootCmd.AddCommand(serveCmd)
+}
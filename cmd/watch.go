@@ -0,0 +1,104 @@
+/*
+Copyright © 2021 Mark Ignacio <mark@ignacio.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+	"github.com/rs/zerolog/log"
+)
+
+// watchDevices polls each job's tailnet every interval and calls changed when the devices that
+// decide the sync's plan change. Only the Tailscale API is polled, so an unchanged tailnet costs no
+// Cloudflare API calls.
+func watchDevices(ctx context.Context, jobs []syncJob, interval time.Duration, changed func()) {
+	hashes := map[string]string{} // tailnet -> device list hash
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	// the first poll is the baseline, taken around the daemon's first sync
+	for {
+		polled := map[string]bool{}
+		for _, job := range jobs {
+			if polled[job.TailscaleTailnet] {
+				continue
+			}
+			polled[job.TailscaleTailnet] = true
+			logger := log.With().Str("tailnet", job.TailscaleTailnet).Logger()
+			tsKey, err := tailscaleAPIKey(ctx, job.TailscaleKey, job.TailscaleOAuthClientID, job.TailscaleOAuthSecret)
+			if err != nil {
+				logger.Warn().Err(err).Msg("error getting Tailscale access token to watch devices")
+				continue
+			}
+			devices, err := sync.ListDevices(ctx, tsKey, job.TailscaleTailnet)
+			if err != nil {
+				logger.Warn().Err(err).Msg("error watching Tailscale devices")
+				continue
+			}
+			hash := devicesHash(devices)
+			if previous, ok := hashes[job.TailscaleTailnet]; ok && previous != hash {
+				logger.Info().Msg("Tailscale devices changed, syncing")
+				changed()
+			}
+			hashes[job.TailscaleTailnet] = hash
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// devicesHash fingerprints what a sync's plan depends on. LastSeen is left out since it changes
+// constantly, so --offline-ttl changes wait for the next --interval.
+func devicesHash(devices []sync.Device) string {
+	lines := make([]string, 0, len(devices))
+	for _, device := range devices {
+		addresses := append([]string(nil), device.Addresses...)
+		sort.Strings(addresses)
+		tags := append([]string(nil), device.Tags...)
+		sort.Strings(tags)
+		// subnet routers are published under --subnet-router-suffix once a route is enabled
+		routes := append([]string(nil), device.EnabledRoutes...)
+		sort.Strings(routes)
+		lines = append(lines, fmt.Sprintf("%s %s %s %t %s %t %s %s %s %t %s",
+			device.Name,
+			device.Hostname,
+			strings.Join(addresses, ","),
+			device.Authorized,
+			strings.Join(tags, ","),
+			device.KeyExpiryDisabled,
+			device.Expires.UTC().Format(time.RFC3339),
+			strings.Join(routes, ","),
+			// --group-by-user publishes devices under their owner, and --record-template can render it
+			device.User,
+			// --skip-ephemeral leaves ephemeral devices out
+			device.Ephemeral,
+			// --include-os and --exclude-os filter on it, and --record-template can render it
+			device.OS,
+		))
+	}
+	sort.Strings(lines)
+	hash := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,67 @@
+/*
+Copyright © 2021 Mark Ignacio <mark@ignacio.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/zabbix"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// zabbixCmd keeps Zabbix monitoring hosts in step with the tailnet
+var zabbixCmd = &cobra.Command{
+	Use:   "zabbix",
+	Short: "Creates Zabbix hosts for Tailscale devices and disables them once devices are gone.",
+	Long: `Creates a host with an agent interface on the Tailscale IP for each authorized device, tagged
+with its Tailscale tags, and disables hosts it created for devices that are gone. Hosts are named like
+the DNS records when --zabbix-domain is set. Requires Zabbix 6.4 or later and an API token.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			tsKey     = mustLoadTailscaleKey()
+			tsTailnet = mustLoadViperString("tailscale-tailnet", "Tailscale tailnet")
+			zabbixURL = mustLoadViperString("zabbix-url", "Zabbix URL")
+			apiToken  = mustLoadViperString("zabbix-api-token", "Zabbix API token")
+		)
+		devices, err := sync.ListDevices(cmd.Context(), tsKey, tsTailnet)
+		if err != nil {
+			log.Fatal().Err(err).Msg("error listing Tailscale devices")
+		}
+		err = zabbix.Sync(sync.PublishedDevices(devices, tsTailnet, viper.GetBool("sync-hostnames")), zabbix.Options{
+			URL:       zabbixURL,
+			APIToken:  apiToken,
+			Group:     viper.GetString("zabbix-group"),
+			Templates: viperStringSlice("zabbix-template"),
+			Domain:    viper.GetString("zabbix-domain"),
+			DryRun:    viper.GetBool("dry-run"),
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("error synchronizing Tailscale -> Zabbix hosts")
+		}
+	},
+}
+
+func init() {
+	flags := zabbixCmd.Flags()
+	flags.String("zabbix-url", "", "Zabbix frontend URL, e.g. https://zabbix.example.com")
+	flags.String("zabbix-api-token", "", "Zabbix API token")
+	flags.String("zabbix-group", "Tailscale", "host group to create hosts in")
+	flags.StringSlice("zabbix-template", nil, "template to link to created hosts. Can be repeated")
+	flags.String("zabbix-domain", "", "domain to append to host names, e.g. ts.example.com to match the DNS records")
+	viper.BindPFlags(flags)
+	rootCmd.AddCommand(zabbixCmd)
+}
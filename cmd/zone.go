@@ -0,0 +1,46 @@
+/*
+Copyright © 2021 Mark Ignacio <mark@ignacio.io>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// cloudflareZoneID returns zone if set, or else looks up the ID of the zone named zoneName.
+func cloudflareZoneID(cloudflareToken, zone, zoneName string) string {
+	if zone != "" || zoneName == "" {
+		return zone
+	}
+	zone, err := (&sync.Cloudflare{Token: cloudflareToken}).ZoneID(context.Background(), zoneName)
+	if err != nil {
+		log.Fatal().Err(err).Str("zoneName", zoneName).Msg("error looking up Cloudflare zone ID")
+	}
+	log.Debug().Str("zoneName", zoneName).Str("zone", zone).Msg("looked up Cloudflare zone ID")
+	return zone
+}
+
+// mustLoadCloudflareZone returns --cloudflare-zone, or the ID of --cloudflare-zone-name.
+func mustLoadCloudflareZone(cloudflareToken string) string {
+	zone := cloudflareZoneID(cloudflareToken, viper.GetString("cloudflare-zone"), viper.GetString("cloudflare-zone-name"))
+	if zone == "" {
+		log.Fatal().Msg("Must specify a Cloudflare zone ID or name via environment variable or flag")
+	}
+	return zone
+}
@@ -15,7 +15,7 @@ limitations under the License.
 */
 package main
 
-import "github.com/mark-ignacio/tailscale-cloudflare/cmd"
+import "github.com/mark-ignacio/tailscale2cloudflare/cmd"
 
 func main() {
 	cmd.Execute()
@@ -0,0 +1,222 @@
+// Package cassette records HTTP interactions to disk with secrets redacted and replays them later, so
+// bug reports can include reproducible API traffic and regressions can be tested against real-world
+// response shapes.
+package cassette
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	stdsync "sync"
+)
+
+const redacted = "REDACTED"
+
+// Interaction is a single recorded request and response.
+type Interaction struct {
+	Request struct {
+		Method string      `json:"method"`
+		URL    string      `json:"url"`
+		Header http.Header `json:"header,omitempty"`
+		Body   string      `json:"body,omitempty"`
+	} `json:"request"`
+	Response struct {
+		StatusCode int         `json:"statusCode"`
+		Header     http.Header `json:"header,omitempty"`
+		Body       string      `json:"body,omitempty"`
+	} `json:"response"`
+}
+
+var (
+	secretHeaders = []string{"Authorization", "X-Amz-Security-Token", "X-Consul-Token", "X-Auth-Key", "X-Auth-Email", "Cookie", "Set-Cookie"}
+	// JSON string fields that hold credentials
+	secretFields = regexp.MustCompile(`("(?:password|pass|client_secret|access_token|auth_token|token|routing_key)"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+	// form fields that hold credentials
+	secretForm = regexp.MustCompile(`((?:^|&)(?:client_secret|client_id|password)=)[^&]*`)
+	// hosts whose URLs are recorded as is. Others are webhooks and push monitors, whose paths can hold
+	// secrets and whose queries can change every run.
+	apiHosts = map[string]bool{"api.tailscale.com": true, "api.cloudflare.com": true, "route53.amazonaws.com": true}
+)
+
+// Recorder is an http.RoundTripper that saves each interaction as a numbered JSON file in Dir.
+type Recorder struct {
+	Dir       string
+	Transport http.RoundTripper
+
+	mu stdsync.Mutex
+	n  int
+}
+
+func (r *Recorder) RoundTrip(request *http.Request) (*http.Response, error) {
+	var requestBody []byte
+	if request.Body != nil {
+		var err error
+		if requestBody, err = ioutil.ReadAll(request.Body); err != nil {
+			return nil, err
+		}
+		request.Body.Close()
+		request.Body = ioutil.NopCloser(bytes.NewReader(requestBody))
+	}
+	transport := r.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	response, err := transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+	responseBody, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	response.Body = ioutil.NopCloser(bytes.NewReader(responseBody))
+
+	var interaction Interaction
+	interaction.Request.Method = request.Method
+	interaction.Request.URL = redactURL(request.URL)
+	interaction.Request.Header = redactHeader(request.Header)
+	interaction.Request.Body = redactBody(requestBody)
+	interaction.Response.StatusCode = response.StatusCode
+	interaction.Response.Header = redactHeader(response.Header)
+	interaction.Response.Body = redactBody(responseBody)
+	// redaction can change the length
+	interaction.Response.Header.Del("Content-Length")
+	if err := r.save(&interaction); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (r *Recorder) save(interaction *Interaction) error {
+	body, err := json.MarshalIndent(interaction, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling HTTP interaction: %s", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := os.MkdirAll(r.Dir, 0755); err != nil {
+		return fmt.Errorf("error creating cassette directory: %s", err)
+	}
+	r.n++
+	path := filepath.Join(r.Dir, fmt.Sprintf("%04d.json", r.n))
+	if err := ioutil.WriteFile(path, body, 0644); err != nil {
+		return fmt.Errorf("error writing HTTP interaction: %s", err)
+	}
+	return nil
+}
+
+// Replayer is an http.RoundTripper that answers requests from recorded interactions instead of the
+// network. Each interaction is used once, matched by method and URL in recorded order.
+type Replayer struct {
+	mu           stdsync.Mutex
+	interactions []Interaction
+	used         []bool
+}
+
+// LoadReplayer reads the interactions a Recorder saved in dir.
+func LoadReplayer(dir string) (*Replayer, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no HTTP interactions found in %s", dir)
+	}
+	sort.Strings(paths)
+	replayer := &Replayer{}
+	for _, path := range paths {
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading HTTP interaction: %s", err)
+		}
+		var interaction Interaction
+		if err := json.Unmarshal(body, &interaction); err != nil {
+			return nil, fmt.Errorf("error unmarshalling HTTP interaction %s as JSON: %s", path, err)
+		}
+		replayer.interactions = append(replayer.interactions, interaction)
+	}
+	replayer.used = make([]bool, len(replayer.interactions))
+	return replayer, nil
+}
+
+func (r *Replayer) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.Body != nil {
+		request.Body.Close()
+	}
+	// like a real transport, don't answer requests that were canceled or timed out
+	if err := request.Context().Err(); err != nil {
+		return nil, err
+	}
+	requestURL := redactURL(request.URL)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, interaction := range r.interactions {
+		if r.used[i] || interaction.Request.Method != request.Method || interaction.Request.URL != requestURL {
+			continue
+		}
+		r.used[i] = true
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", interaction.Response.StatusCode, http.StatusText(interaction.Response.StatusCode)),
+			StatusCode:    interaction.Response.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        interaction.Response.Header,
+			Body:          ioutil.NopCloser(bytes.NewBufferString(interaction.Response.Body)),
+			ContentLength: int64(len(interaction.Response.Body)),
+			Request:       request,
+		}, nil
+	}
+	return nil, fmt.Errorf("no recorded HTTP interaction left for %s %s", request.Method, requestURL)
+}
+
+func redactURL(u *url.URL) string {
+	redactedURL := *u
+	if redactedURL.User != nil {
+		redactedURL.User = url.User(redacted)
+	}
+	if apiHosts[u.Hostname()] {
+		return redactedURL.String()
+	}
+	// a hash keeps requests to different paths apart when replaying without giving away the path
+	if u.Path != "" && u.Path != "/" {
+		sum := sha256.Sum256([]byte(u.EscapedPath()))
+		redactedURL.Path, redactedURL.RawPath = fmt.Sprintf("/%s-%x", redacted, sum[:4]), ""
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		for key := range query {
+			query[key] = []string{redacted}
+		}
+		redactedURL.RawQuery = query.Encode()
+	}
+	return redactedURL.String()
+}
+
+func redactHeader(header http.Header) http.Header {
+	if len(header) == 0 {
+		return nil
+	}
+	redactedHeader := header.Clone()
+	for _, name := range secretHeaders {
+		if redactedHeader.Get(name) != "" {
+			redactedHeader.Set(name, redacted)
+		}
+	}
+	return redactedHeader
+}
+
+func redactBody(body []byte) string {
+	redactedBody := secretFields.ReplaceAll(body, []byte(`$1"`+redacted+`"`))
+	redactedBody = secretForm.ReplaceAll(redactedBody, []byte("${1}"+redacted))
+	return string(redactedBody)
+}
@@ -0,0 +1,153 @@
+// Package consul registers tailnet devices as external nodes in a Consul catalog.
+package consul
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	managedByKey   = "managed-by"
+	managedByValue = "tailscale2cloudflare"
+)
+
+type Options struct {
+	// Address of the Consul HTTP API, e.g. http://127.0.0.1:8500.
+	Address    string
+	Token      string
+	Datacenter string
+	// Service is the name each device is registered under, with its Tailscale tags as service tags.
+	Service string
+	Port    int
+	DryRun  bool
+}
+
+type catalogNode struct {
+	Node    string
+	Address string
+}
+
+// Sync registers each device as an external node and deregisters nodes this created for devices
+// that are gone.
+func Sync(devices map[string]sync.Device, opts Options) error {
+	query := url.Values{}
+	query.Set("node-meta", managedByKey+":"+managedByValue)
+	var existing []catalogNode
+	if err := call(opts, http.MethodGet, "/v1/catalog/nodes?"+query.Encode(), nil, &existing); err != nil {
+		return err
+	}
+	existingAddresses := make(map[string]string, len(existing))
+	for _, node := range existing {
+		existingAddresses[node.Node] = node.Address
+	}
+	labels := make([]string, 0, len(devices))
+	for label := range devices {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		device := devices[label]
+		ipv4s := device.IPv4s()
+		if len(ipv4s) == 0 {
+			continue
+		}
+		logger := log.With().Str("node", label).Str("address", ipv4s[0]).Logger()
+		if address, ok := existingAddresses[label]; ok && address == ipv4s[0] {
+			logger.Debug().Msg("Consul node up to date")
+			continue
+		}
+		logger.Info().Bool("dryRun", opts.DryRun).Msg("registering Consul node")
+		if opts.DryRun {
+			continue
+		}
+		tags := make([]string, 0, len(device.Tags))
+		for _, tag := range device.Tags {
+			tags = append(tags, strings.TrimPrefix(tag, "tag:"))
+		}
+		err := call(opts, http.MethodPut, "/v1/catalog/register", map[string]interface{}{
+			"Node":    label,
+			"Address": ipv4s[0],
+			"NodeMeta": map[string]string{
+				managedByKey:     managedByValue,
+				"external-node":  "true",
+				"external-probe": "false",
+			},
+			"Service": map[string]interface{}{
+				"ID":      opts.Service + "-" + label,
+				"Service": opts.Service,
+				"Tags":    tags,
+				"Address": ipv4s[0],
+				"Port":    opts.Port,
+			},
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	for _, node := range existing {
+		if _, ok := devices[node.Node]; ok {
+			continue
+		}
+		log.Info().Str("node", node.Node).Bool("dryRun", opts.DryRun).Msg("deregistering Consul node")
+		if opts.DryRun {
+			continue
+		}
+		if err := call(opts, http.MethodPut, "/v1/catalog/deregister", map[string]string{"Node": node.Node}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func call(opts Options, method, path string, payload interface{}, out interface{}) error {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return fmt.Errorf("error creating Consul %s request body: %s", method, err)
+		}
+	}
+	endpoint := strings.TrimSuffix(opts.Address, "/") + path
+	if opts.Datacenter != "" {
+		separator := "?"
+		if strings.Contains(endpoint, "?") {
+			separator = "&"
+		}
+		endpoint += separator + "dc=" + url.QueryEscape(opts.Datacenter)
+	}
+	request, err := http.NewRequest(method, endpoint, bytes.NewBuffer(body))
+	if err != nil {
+		return fmt.Errorf("error creating Consul %s request: %s", method, err)
+	}
+	if opts.Token != "" {
+		request.Header.Set("X-Consul-Token", opts.Token)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("error performing Consul %s %s: %s", method, path, err)
+	}
+	defer response.Body.Close()
+	body, err = ioutil.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("error reading Consul %s %s body: %s", method, path, err)
+	}
+	if response.StatusCode > http.StatusOK {
+		return fmt.Errorf("non-200 response to Consul %s %s: %d: %s", method, path, response.StatusCode, body)
+	}
+	if out != nil {
+		if err := json.Unmarshal(body, out); err != nil {
+			return fmt.Errorf("error unmarshalling Consul %s %s as JSON: %s", method, path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+// Package dnsserver answers DNS queries for tailnet devices directly, as an authoritative server for a
+// single domain.
+package dnsserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	stdsync "sync"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/dns/dnsmessage"
+	"inet.af/netaddr"
+)
+
+// Server is authoritative for Domain and answers A queries for <label>.<Domain>.
+type Server struct {
+	Domain string
+	TTL    uint32
+
+	mu      stdsync.RWMutex
+	records map[string][][4]byte // lowercase FQDN with trailing dot -> IPv4s
+	serial  uint32
+}
+
+// SetDevices replaces the records being served.
+func (s *Server) SetDevices(devices map[string]sync.Device) {
+	records := make(map[string][][4]byte, len(devices))
+	for label, device := range devices {
+		name := strings.ToLower(label + "." + s.fqdn())
+		for _, ipv4 := range device.IPv4s() {
+			parsed, err := netaddr.ParseIP(ipv4)
+			if err != nil {
+				continue
+			}
+			records[name] = append(records[name], parsed.As4())
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = records
+	s.serial++
+}
+
+// ServeUDP answers queries on conn until it's closed.
+func (s *Server) ServeUDP(conn net.PacketConn) error {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		response, err := s.handle(buf[:n])
+		if err != nil {
+			log.Debug().Err(err).Str("remote", addr.String()).Msg("dropping bad DNS query")
+			continue
+		}
+		if _, err := conn.WriteTo(response, addr); err != nil {
+			log.Debug().Err(err).Str("remote", addr.String()).Msg("error writing DNS response")
+		}
+	}
+}
+
+// ServeTCP answers queries on connections accepted from l until it's closed.
+func (s *Server) ServeTCP(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveTCPConn(conn)
+	}
+}
+
+func (s *Server) serveTCPConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+		query := make([]byte, length)
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		response, err := s.handle(query)
+		if err != nil {
+			log.Debug().Err(err).Str("remote", conn.RemoteAddr().String()).Msg("dropping bad DNS query")
+			return
+		}
+		framed := make([]byte, 2, 2+len(response))
+		binary.BigEndian.PutUint16(framed, uint16(len(response)))
+		if _, err := conn.Write(append(framed, response...)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) fqdn() string {
+	return strings.TrimSuffix(s.Domain, ".") + "."
+}
+
+func (s *Server) handle(query []byte) ([]byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing DNS header: %s", err)
+	}
+	if header.Response {
+		return nil, errors.New("not a query")
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil, fmt.Errorf("error parsing DNS question: %s", err)
+	}
+	var (
+		name       = strings.ToLower(question.Name.String())
+		domain     = strings.ToLower(s.fqdn())
+		inZone     = name == domain || strings.HasSuffix(name, "."+domain)
+		responseHd = dnsmessage.Header{
+			ID:                 header.ID,
+			Response:           true,
+			OpCode:             header.OpCode,
+			Authoritative:      inZone,
+			RecursionDesired:   header.RecursionDesired,
+			RecursionAvailable: false,
+			RCode:              dnsmessage.RCodeSuccess,
+		}
+	)
+	s.mu.RLock()
+	addresses, exists := s.records[name]
+	serial := s.serial
+	s.mu.RUnlock()
+	switch {
+	case header.OpCode != 0:
+		responseHd.RCode = dnsmessage.RCodeNotImplemented
+	case !inZone:
+		responseHd.RCode = dnsmessage.RCodeRefused
+	case !exists && name != domain:
+		responseHd.RCode = dnsmessage.RCodeNameError
+	}
+
+	builder := dnsmessage.NewBuilder(make([]byte, 0, 512), responseHd)
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(question); err != nil {
+		return nil, err
+	}
+	if err := builder.StartAnswers(); err != nil {
+		return nil, err
+	}
+	answers := 0
+	if responseHd.RCode == dnsmessage.RCodeSuccess && question.Class == dnsmessage.ClassINET {
+		switch question.Type {
+		case dnsmessage.TypeA, dnsmessage.TypeALL:
+			for _, address := range addresses {
+				answers++
+				err := builder.AResource(dnsmessage.ResourceHeader{
+					Name:  question.Name,
+					Class: dnsmessage.ClassINET,
+					TTL:   s.TTL,
+				}, dnsmessage.AResource{A: address})
+				if err != nil {
+					return nil, err
+				}
+			}
+		case dnsmessage.TypeSOA:
+			if name == domain {
+				answers++
+				if err := s.soa(&builder, serial); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if err := builder.StartAuthorities(); err != nil {
+		return nil, err
+	}
+	// negative answers carry the SOA so resolvers know how long to cache them
+	if inZone && answers == 0 && responseHd.RCode != dnsmessage.RCodeNotImplemented {
+		if err := s.soa(&builder, serial); err != nil {
+			return nil, err
+		}
+	}
+	return builder.Finish()
+}
+
+func (s *Server) soa(builder *dnsmessage.Builder, serial uint32) error {
+	domain := dnsmessage.MustNewName(s.fqdn())
+	return builder.SOAResource(dnsmessage.ResourceHeader{
+		Name:  domain,
+		Class: dnsmessage.ClassINET,
+		TTL:   s.TTL,
+	}, dnsmessage.SOAResource{
+		NS:      dnsmessage.MustNewName("ns." + s.fqdn()),
+		MBox:    dnsmessage.MustNewName("hostmaster." + s.fqdn()),
+		Serial:  serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		MinTTL:  s.TTL,
+	})
+}
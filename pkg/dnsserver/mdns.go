@@ -0,0 +1,196 @@
+package dnsserver
+
+import (
+	"net"
+	"sort"
+	"strings"
+	stdsync "sync"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/dns/dnsmessage"
+	"inet.af/netaddr"
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+const (
+	mdnsTTL = 120
+	// the top bit of the class is cache-flush in answers and unicast-response in questions
+	mdnsClassTopBit = 1 << 15
+	// keep announcements comfortably under a typical MTU
+	mdnsAnnounceBatch = 20
+)
+
+// MDNSResponder answers multicast DNS queries for <label>.local with device Tailscale IPs.
+type MDNSResponder struct {
+	mu      stdsync.RWMutex
+	records map[string][4]byte // lowercase name with trailing dot -> IPv4
+	conn    *net.UDPConn
+}
+
+// Listen joins the mDNS multicast group on iface, or the system default interface if nil.
+func (m *MDNSResponder) Listen(iface *net.Interface) error {
+	conn, err := net.ListenMulticastUDP("udp4", iface, mdnsGroup)
+	if err != nil {
+		return err
+	}
+	m.conn = conn
+	return nil
+}
+
+// SetDevices replaces the announced records, announcing new and changed names and sending goodbyes
+// for removed ones.
+func (m *MDNSResponder) SetDevices(devices map[string]sync.Device) {
+	records := make(map[string][4]byte, len(devices))
+	for label, device := range devices {
+		ipv4s := device.IPv4s()
+		if len(ipv4s) == 0 || strings.Contains(label, ".") {
+			continue
+		}
+		parsed, err := netaddr.ParseIP(ipv4s[0])
+		if err != nil {
+			continue
+		}
+		records[strings.ToLower(label)+".local."] = parsed.As4()
+	}
+	m.mu.Lock()
+	previous := m.records
+	m.records = records
+	m.mu.Unlock()
+
+	var announce, goodbye []string
+	for name, address := range records {
+		if old, ok := previous[name]; !ok || old != address {
+			announce = append(announce, name)
+		}
+	}
+	for name := range previous {
+		if _, ok := records[name]; !ok {
+			goodbye = append(goodbye, name)
+		}
+	}
+	m.announce(announce, records, mdnsTTL)
+	m.announce(goodbye, previous, 0)
+}
+
+func (m *MDNSResponder) announce(names []string, records map[string][4]byte, ttl uint32) {
+	if m.conn == nil {
+		return
+	}
+	sort.Strings(names)
+	for start := 0; start < len(names); start += mdnsAnnounceBatch {
+		end := start + mdnsAnnounceBatch
+		if end > len(names) {
+			end = len(names)
+		}
+		response, err := m.response(0, nil, names[start:end], records, ttl)
+		if err != nil {
+			log.Warn().Err(err).Msg("error building mDNS announcement")
+			return
+		}
+		if _, err := m.conn.WriteTo(response, mdnsGroup); err != nil {
+			log.Warn().Err(err).Msg("error sending mDNS announcement")
+		}
+	}
+}
+
+// Serve answers queries until the connection is closed.
+func (m *MDNSResponder) Serve() error {
+	buf := make([]byte, 9000)
+	for {
+		n, addr, err := m.conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		m.handle(buf[:n], addr)
+	}
+}
+
+func (m *MDNSResponder) handle(packet []byte, from *net.UDPAddr) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(packet)
+	if err != nil || header.Response {
+		return
+	}
+	questions, err := parser.AllQuestions()
+	if err != nil {
+		return
+	}
+	m.mu.RLock()
+	records := m.records
+	m.mu.RUnlock()
+	var (
+		names   []string
+		unicast bool
+	)
+	for _, question := range questions {
+		name := strings.ToLower(question.Name.String())
+		if _, ok := records[name]; !ok {
+			continue
+		}
+		if question.Type != dnsmessage.TypeA && question.Type != dnsmessage.TypeALL {
+			continue
+		}
+		names = append(names, name)
+		if question.Class&mdnsClassTopBit != 0 {
+			unicast = true
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	destination := mdnsGroup
+	// legacy unicast resolvers query from an ephemeral port and expect their question echoed back
+	legacy := from.Port != mdnsGroup.Port
+	if unicast || legacy {
+		destination = from
+	}
+	var (
+		id           uint16
+		echoQuestion []dnsmessage.Question
+	)
+	if legacy {
+		id = header.ID
+		echoQuestion = questions
+	}
+	response, err := m.response(id, echoQuestion, names, records, mdnsTTL)
+	if err != nil {
+		log.Debug().Err(err).Msg("error building mDNS response")
+		return
+	}
+	if _, err := m.conn.WriteTo(response, destination); err != nil {
+		log.Debug().Err(err).Str("remote", destination.String()).Msg("error sending mDNS response")
+	}
+}
+
+func (m *MDNSResponder) response(id uint16, questions []dnsmessage.Question, names []string, records map[string][4]byte, ttl uint32) ([]byte, error) {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: true, Authoritative: true})
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	for _, question := range questions {
+		if err := builder.Question(question); err != nil {
+			return nil, err
+		}
+	}
+	if err := builder.StartAnswers(); err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		parsedName, err := dnsmessage.NewName(name)
+		if err != nil {
+			continue
+		}
+		err = builder.AResource(dnsmessage.ResourceHeader{
+			Name:  parsedName,
+			Class: dnsmessage.ClassINET | mdnsClassTopBit,
+			TTL:   ttl,
+		}, dnsmessage.AResource{A: records[name]})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return builder.Finish()
+}
@@ -0,0 +1,210 @@
+// Package etcd writes tailnet devices into etcd as SkyDNS records, so CoreDNS's etcd plugin can serve
+// them. It talks to etcd's v3 JSON gateway, so no gRPC client is needed.
+package etcd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+	"github.com/rs/zerolog/log"
+)
+
+// managedBy marks records written by tailscale2cloudflare, so that only those are ever deleted.
+// CoreDNS ignores fields it doesn't know.
+const managedBy = "tailscale2cloudflare"
+
+type Options struct {
+	// Endpoint of an etcd server, e.g. http://127.0.0.1:2379.
+	Endpoint string
+	Username string
+	Password string
+	// Prefix is the CoreDNS etcd plugin path, /skydns by default.
+	Prefix string
+	// Domain the devices are published under, e.g. ts.example.com.
+	Domain string
+	TTL    int
+	DryRun bool
+}
+
+type skyDNSRecord struct {
+	Host      string `json:"host"`
+	TTL       int    `json:"ttl,omitempty"`
+	ManagedBy string `json:"managedBy,omitempty"`
+}
+
+type keyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type rangeResponse struct {
+	KVs []keyValue `json:"kvs"`
+}
+
+type authenticateResponse struct {
+	Token string `json:"token"`
+}
+
+// Sync writes a SkyDNS record for each device under Domain and deletes records it wrote for devices
+// that are gone.
+func Sync(devices map[string]sync.Device, opts Options) error {
+	client := &client{opts: opts}
+	if opts.Username != "" {
+		var auth authenticateResponse
+		err := client.call("/v3/auth/authenticate", map[string]string{
+			"name":     opts.Username,
+			"password": opts.Password,
+		}, &auth)
+		if err != nil {
+			return err
+		}
+		client.token = auth.Token
+	}
+	domainKey := domainPath(opts.Prefix, opts.Domain) + "/"
+	var existing rangeResponse
+	err := client.call("/v3/kv/range", map[string]string{
+		"key":       encode(domainKey),
+		"range_end": encode(prefixEnd(domainKey)),
+	}, &existing)
+	if err != nil {
+		return err
+	}
+	existingRecords := map[string]skyDNSRecord{}
+	for _, kv := range existing.KVs {
+		key, value, err := decodeKeyValue(kv)
+		if err != nil {
+			return err
+		}
+		var record skyDNSRecord
+		if err := json.Unmarshal(value, &record); err != nil || record.ManagedBy != managedBy {
+			continue
+		}
+		existingRecords[key] = record
+	}
+	desired := map[string]skyDNSRecord{}
+	for label, device := range devices {
+		ipv4s := device.IPv4s()
+		if len(ipv4s) == 0 {
+			continue
+		}
+		key := domainPath(opts.Prefix, label+"."+opts.Domain)
+		desired[key] = skyDNSRecord{Host: ipv4s[0], TTL: opts.TTL, ManagedBy: managedBy}
+	}
+	for _, key := range sortedKeys(desired) {
+		record := desired[key]
+		if existingRecords[key] == record {
+			continue
+		}
+		log.Info().Str("key", key).Str("host", record.Host).Bool("dryRun", opts.DryRun).Msg("putting etcd record")
+		if opts.DryRun {
+			continue
+		}
+		value, _ := json.Marshal(record)
+		if err := client.call("/v3/kv/put", map[string]string{"key": encode(key), "value": encode(string(value))}, nil); err != nil {
+			return err
+		}
+	}
+	for _, key := range sortedKeys(existingRecords) {
+		if _, ok := desired[key]; ok {
+			continue
+		}
+		log.Info().Str("key", key).Bool("dryRun", opts.DryRun).Msg("deleting etcd record")
+		if opts.DryRun {
+			continue
+		}
+		if err := client.call("/v3/kv/deleterange", map[string]string{"key": encode(key)}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// domainPath turns machine.ts.example.com into /skydns/com/example/ts/machine.
+func domainPath(prefix, domain string) string {
+	if prefix == "" {
+		prefix = "/skydns"
+	}
+	labels := strings.Split(strings.Trim(domain, "."), ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return strings.TrimSuffix(prefix, "/") + "/" + strings.Join(labels, "/")
+}
+
+// prefixEnd is the range_end that selects every key starting with prefix.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	end[len(end)-1]++
+	return string(end)
+}
+
+func encode(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func decodeKeyValue(kv keyValue) (string, []byte, error) {
+	key, err := base64.StdEncoding.DecodeString(kv.Key)
+	if err != nil {
+		return "", nil, fmt.Errorf("error decoding etcd key: %s", err)
+	}
+	value, err := base64.StdEncoding.DecodeString(kv.Value)
+	if err != nil {
+		return "", nil, fmt.Errorf("error decoding etcd value: %s", err)
+	}
+	return string(key), value, nil
+}
+
+func sortedKeys(m map[string]skyDNSRecord) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type client struct {
+	opts  Options
+	token string
+}
+
+// call POSTs to an etcd v3 JSON gateway endpoint.
+func (c *client) call(path string, payload interface{}, out interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error creating etcd %s request body: %s", path, err)
+	}
+	request, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(c.opts.Endpoint, "/")+path, bytes.NewBuffer(body))
+	if err != nil {
+		return fmt.Errorf("error creating etcd %s request: %s", path, err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		request.Header.Set("Authorization", c.token)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("error performing etcd %s POST: %s", path, err)
+	}
+	defer response.Body.Close()
+	body, err = ioutil.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("error reading etcd %s POST body: %s", path, err)
+	}
+	if response.StatusCode > http.StatusOK {
+		return fmt.Errorf("non-200 response to etcd %s POST: %d: %s", path, response.StatusCode, body)
+	}
+	if out != nil {
+		if err := json.Unmarshal(body, out); err != nil {
+			return fmt.Errorf("error unmarshalling etcd %s POST as JSON: %s", path, err)
+		}
+	}
+	return nil
+}
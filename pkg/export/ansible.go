@@ -0,0 +1,103 @@
+package export
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+	"gopkg.in/yaml.v3"
+)
+
+var invalidGroupChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// ansibleGroupName turns a Tailscale tag like "tag:web-server" into a valid group or label name,
+// "tag_web_server".
+func ansibleGroupName(tag string) string {
+	return invalidGroupChars.ReplaceAllString(tag, "_")
+}
+
+// ansibleInventory returns label -> ansible_host and group -> sorted labels.
+func ansibleInventory(devices map[string]sync.Device) (map[string]string, map[string][]string) {
+	var (
+		hosts  = map[string]string{}
+		groups = map[string][]string{}
+	)
+	for _, label := range sortedKeys(devices) {
+		device := devices[label]
+		ipv4s := device.IPv4s()
+		if len(ipv4s) == 0 {
+			continue
+		}
+		hosts[label] = ipv4s[0]
+		for _, tag := range device.Tags {
+			group := ansibleGroupName(tag)
+			groups[group] = append(groups[group], label)
+		}
+	}
+	return hosts, groups
+}
+
+// AnsibleINI writes an INI inventory with every device in "all" and a group per Tailscale tag.
+func AnsibleINI(w io.Writer, devices map[string]sync.Device) error {
+	hosts, groups := ansibleInventory(devices)
+	if _, err := fmt.Fprintln(w, "[all]"); err != nil {
+		return err
+	}
+	for _, label := range sortedKeys(hosts) {
+		if _, err := fmt.Fprintf(w, "%s ansible_host=%s\n", label, hosts[label]); err != nil {
+			return err
+		}
+	}
+	for _, group := range sortedKeys(groups) {
+		if _, err := fmt.Fprintf(w, "\n[%s]\n", group); err != nil {
+			return err
+		}
+		for _, label := range groups[group] {
+			if _, err := fmt.Fprintln(w, label); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type ansibleYAMLGroup struct {
+	Hosts    map[string]map[string]string `yaml:"hosts,omitempty"`
+	Children map[string]ansibleYAMLGroup  `yaml:"children,omitempty"`
+}
+
+// AnsibleYAML writes the same inventory as AnsibleINI in YAML.
+func AnsibleYAML(w io.Writer, devices map[string]sync.Device) error {
+	hosts, groups := ansibleInventory(devices)
+	all := ansibleYAMLGroup{
+		Hosts:    map[string]map[string]string{},
+		Children: map[string]ansibleYAMLGroup{},
+	}
+	for label, address := range hosts {
+		all.Hosts[label] = map[string]string{"ansible_host": address}
+	}
+	for group, labels := range groups {
+		child := ansibleYAMLGroup{Hosts: map[string]map[string]string{}}
+		for _, label := range labels {
+			child.Hosts[label] = nil
+		}
+		all.Children[group] = child
+	}
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(map[string]ansibleYAMLGroup{"all": all}); err != nil {
+		return fmt.Errorf("error encoding Ansible inventory as YAML: %s", err)
+	}
+	return encoder.Close()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,109 @@
+package export
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+)
+
+// dnsRecord is one of a device's addresses under its name in domain.
+type dnsRecord struct {
+	name    string // FQDN with trailing dot
+	address net.IP
+}
+
+func (r dnsRecord) recordType() string {
+	if r.address.To4() != nil {
+		return "A"
+	}
+	return "AAAA"
+}
+
+// dnsRecords lists every device address as a record under domain, sorted by name.
+func dnsRecords(devices map[string]sync.Device, domain string) []dnsRecord {
+	var records []dnsRecord
+	for _, label := range sortedKeys(devices) {
+		name := label + "." + strings.TrimSuffix(domain, ".") + "."
+		for _, address := range devices[label].Addresses {
+			if ip := net.ParseIP(address); ip != nil {
+				records = append(records, dnsRecord{name: name, address: ip})
+			}
+		}
+	}
+	return records
+}
+
+// reverseName returns the in-addr.arpa or ip6.arpa name for ip, with a trailing dot.
+func reverseName(ip net.IP) string {
+	var labels []string
+	if ipv4 := ip.To4(); ipv4 != nil {
+		for i := len(ipv4) - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprint(ipv4[i]))
+		}
+		return strings.Join(labels, ".") + ".in-addr.arpa."
+	}
+	ipv6 := ip.To16()
+	for i := len(ipv6) - 1; i >= 0; i-- {
+		labels = append(labels, fmt.Sprintf("%x", ipv6[i]&0xf), fmt.Sprintf("%x", ipv6[i]>>4))
+	}
+	return strings.Join(labels, ".") + ".ip6.arpa."
+}
+
+// ZoneFile writes A and AAAA records for each device under domain as a zone file fragment, e.g. for
+// an $INCLUDE.
+func ZoneFile(w io.Writer, devices map[string]sync.Device, domain string, ttl int) error {
+	for _, record := range dnsRecords(devices, domain) {
+		if _, err := fmt.Fprintf(w, "%s\t%d\tIN\t%s\t%s\n", record.name, ttl, record.recordType(), record.address); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReverseZoneFile writes PTR records pointing each device address back at its name under domain, as a
+// zone file fragment with absolute names, so it fits in any in-addr.arpa or ip6.arpa zone covering
+// the tailnet, e.g. 64.100.in-addr.arpa.
+func ReverseZoneFile(w io.Writer, devices map[string]sync.Device, domain string, ttl int) error {
+	for _, record := range dnsRecords(devices, domain) {
+		if _, err := fmt.Fprintf(w, "%s\t%d\tIN\tPTR\t%s\n", reverseName(record.address), ttl, record.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Dnsmasq writes a host-record line per device, which dnsmasq answers forward and reverse lookups
+// from.
+func Dnsmasq(w io.Writer, devices map[string]sync.Device, domain string) error {
+	for _, label := range sortedKeys(devices) {
+		fields := []string{label + "." + strings.TrimSuffix(domain, ".")}
+		for _, address := range devices[label].Addresses {
+			if net.ParseIP(address) != nil {
+				fields = append(fields, address)
+			}
+		}
+		if len(fields) == 1 {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "host-record=%s\n", strings.Join(fields, ",")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unbound writes local-data and local-data-ptr lines for each device address, to include in a
+// server: clause.
+func Unbound(w io.Writer, devices map[string]sync.Device, domain string, ttl int) error {
+	for _, record := range dnsRecords(devices, domain) {
+		if _, err := fmt.Fprintf(w, "local-data: \"%s %d IN %s %s\"\nlocal-data-ptr: \"%s %d %s\"\n",
+			record.name, ttl, record.recordType(), record.address, record.address, ttl, record.name,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
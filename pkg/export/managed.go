@@ -0,0 +1,64 @@
+// Package export renders the tailnet devices that tailscale2cloudflare syncs into formats other tools
+// consume.
+package export
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	managedBegin = "# BEGIN tailscale2cloudflare managed section - edits will be overwritten"
+	managedEnd   = "# END tailscale2cloudflare managed section"
+)
+
+// WriteManagedSection replaces the marked section of the file at path with content, appending the
+// section if the file doesn't have one yet. Everything outside of the markers is left alone.
+func WriteManagedSection(path string, content []byte) error {
+	mode := os.FileMode(0600)
+	existing, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return fmt.Errorf("error reading %s: %s", path, err)
+	default:
+		if info, err := os.Stat(path); err == nil {
+			mode = info.Mode().Perm()
+		}
+	}
+	var section bytes.Buffer
+	section.WriteString(managedBegin + "\n")
+	section.Write(content)
+	if len(content) > 0 && !bytes.HasSuffix(content, []byte("\n")) {
+		section.WriteString("\n")
+	}
+	section.WriteString(managedEnd + "\n")
+
+	var updated []byte
+	begin := bytes.Index(existing, []byte(managedBegin))
+	end := bytes.Index(existing, []byte(managedEnd))
+	switch {
+	case begin >= 0 && end > begin:
+		end += len(managedEnd)
+		if end < len(existing) && existing[end] == '\n' {
+			end++
+		}
+		updated = append(updated, existing[:begin]...)
+		updated = append(updated, section.Bytes()...)
+		updated = append(updated, existing[end:]...)
+	case begin >= 0 || end >= 0:
+		return fmt.Errorf("%s has a mangled tailscale2cloudflare managed section, fix or remove its markers", path)
+	default:
+		updated = append(updated, existing...)
+		if len(updated) > 0 && !bytes.HasSuffix(updated, []byte("\n")) {
+			updated = append(updated, '\n')
+		}
+		updated = append(updated, section.Bytes()...)
+	}
+	if err := ioutil.WriteFile(path, updated, mode); err != nil {
+		return fmt.Errorf("error writing %s: %s", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+)
+
+type prometheusTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// PrometheusSD writes a target group per device in the JSON format shared by Prometheus's file_sd
+// and http_sd. Targets are the device's Tailscale IPv4 and port, and labels are __meta_tailscale_*
+// so they can be picked up with relabeling:
+//
+//	__meta_tailscale_name      record label
+//	__meta_tailscale_dns_name  MagicDNS name
+//	__meta_tailscale_os        operating system, e.g. linux
+//	__meta_tailscale_version   Tailscale client version
+//	__meta_tailscale_tags      comma-separated tags, with leading and trailing commas
+//	__meta_tailscale_tag_<tag> "true" for each tag, e.g. __meta_tailscale_tag_tag_server
+func PrometheusSD(w io.Writer, devices map[string]sync.Device, port int) error {
+	groups := []prometheusTargetGroup{}
+	for _, label := range sortedKeys(devices) {
+		device := devices[label]
+		ipv4s := device.IPv4s()
+		if len(ipv4s) == 0 {
+			continue
+		}
+		labels := map[string]string{
+			"__meta_tailscale_name":     label,
+			"__meta_tailscale_dns_name": device.Name,
+			"__meta_tailscale_os":       device.OS,
+			"__meta_tailscale_version":  device.ClientVersion,
+			"__meta_tailscale_tags":     "," + strings.Join(device.Tags, ",") + ",",
+		}
+		for _, tag := range device.Tags {
+			labels["__meta_tailscale_tag_"+ansibleGroupName(tag)] = "true"
+		}
+		groups = append(groups, prometheusTargetGroup{
+			Targets: []string{net.JoinHostPort(ipv4s[0], fmt.Sprint(port))},
+			Labels:  labels,
+		})
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(groups); err != nil {
+		return fmt.Errorf("error encoding Prometheus targets as JSON: %s", err)
+	}
+	return nil
+}
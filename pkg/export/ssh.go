@@ -0,0 +1,55 @@
+package export
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+)
+
+type SSHOptions struct {
+	// UseDNSNames sets HostName to the device's MagicDNS name instead of its Tailscale IPv4.
+	UseDNSNames bool
+	// TagUsers and TagPorts set User and Port for devices with a tag, e.g. "tag:server" -> "root".
+	// The first of a device's tags with a setting wins.
+	TagUsers map[string]string
+	TagPorts map[string]string
+}
+
+// SSHConfig writes an ssh_config(5) Host block for each device, keyed by record label.
+func SSHConfig(w io.Writer, devices map[string]sync.Device, opts SSHOptions) error {
+	for _, label := range sortedKeys(devices) {
+		device := devices[label]
+		hostName := device.Name
+		if !opts.UseDNSNames {
+			ipv4s := device.IPv4s()
+			if len(ipv4s) == 0 {
+				continue
+			}
+			hostName = ipv4s[0]
+		}
+		if _, err := fmt.Fprintf(w, "Host %s\n  HostName %s\n", label, hostName); err != nil {
+			return err
+		}
+		if user := tagSetting(device, opts.TagUsers); user != "" {
+			if _, err := fmt.Fprintf(w, "  User %s\n", user); err != nil {
+				return err
+			}
+		}
+		if port := tagSetting(device, opts.TagPorts); port != "" {
+			if _, err := fmt.Fprintf(w, "  Port %s\n", port); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func tagSetting(device sync.Device, settings map[string]string) string {
+	for _, tag := range device.Tags {
+		if value, ok := settings[tag]; ok {
+			return value
+		}
+	}
+	return ""
+}
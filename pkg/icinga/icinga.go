@@ -0,0 +1,176 @@
+// Package icinga creates Icinga hosts for tailnet devices through the Icinga Director REST API, and
+// disables the ones it created once their devices are gone.
+package icinga
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+	"github.com/rs/zerolog/log"
+)
+
+// managedBy is the value of the managed_by custom variable on hosts created by tailscale2cloudflare,
+// so that only those are ever disabled.
+const managedBy = "tailscale2cloudflare"
+
+type Options struct {
+	// URL of Icinga Director, e.g. https://icinga.example.com/icingaweb2/director.
+	URL      string
+	Username string
+	Password string
+	// Template is the host template imported by created hosts, which should set a check command.
+	Template string
+	// Domain, if set, is appended to device names, so hosts are named like their DNS records.
+	Domain string
+	DryRun bool
+}
+
+type directorHost struct {
+	ObjectName string                 `json:"object_name"`
+	Address    string                 `json:"address"`
+	Disabled   bool                   `json:"disabled"`
+	Vars       map[string]interface{} `json:"vars"`
+}
+
+type hostsResponse struct {
+	Objects []directorHost `json:"objects"`
+}
+
+// Sync creates a host for each device, re-enabling and re-addressing hosts it created before, and
+// disables hosts it created for devices that are gone. Hosts aren't deleted so that their history is
+// kept. Changes are deployed once at the end, if there were any.
+func Sync(devices map[string]sync.Device, opts Options) error {
+	var all hostsResponse
+	if err := call(opts, http.MethodGet, "/hosts", nil, &all); err != nil {
+		return err
+	}
+	existing := map[string]directorHost{}
+	for _, h := range all.Objects {
+		if h.Vars["managed_by"] == managedBy {
+			existing[h.ObjectName] = h
+		}
+	}
+	labels := make([]string, 0, len(devices))
+	for label := range devices {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	changed := false
+	for _, label := range labels {
+		device := devices[label]
+		ipv4s := device.IPv4s()
+		if len(ipv4s) == 0 {
+			continue
+		}
+		name := label
+		if opts.Domain != "" {
+			name += "." + opts.Domain
+		}
+		logger := log.With().Str("host", name).Str("address", ipv4s[0]).Logger()
+		tags := make([]string, 0, len(device.Tags))
+		for _, tag := range device.Tags {
+			tags = append(tags, strings.TrimPrefix(tag, "tag:"))
+		}
+		vars := map[string]interface{}{
+			"managed_by":     managedBy,
+			"tailscale_tags": tags,
+		}
+		if h, ok := existing[name]; ok {
+			if !h.Disabled && h.Address == ipv4s[0] {
+				logger.Debug().Msg("Icinga host up to date")
+				continue
+			}
+			logger.Info().Bool("dryRun", opts.DryRun).Msg("updating Icinga host")
+			if opts.DryRun {
+				continue
+			}
+			err := call(opts, http.MethodPost, "/host?name="+url.QueryEscape(name), map[string]interface{}{
+				"address":  ipv4s[0],
+				"disabled": false,
+				"vars":     vars,
+			}, nil)
+			if err != nil {
+				return err
+			}
+			changed = true
+			continue
+		}
+		logger.Info().Bool("dryRun", opts.DryRun).Msg("creating Icinga host")
+		if opts.DryRun {
+			continue
+		}
+		err := call(opts, http.MethodPost, "/host", map[string]interface{}{
+			"object_name": name,
+			"object_type": "object",
+			"address":     ipv4s[0],
+			"imports":     []string{opts.Template},
+			"vars":        vars,
+		}, nil)
+		if err != nil {
+			return err
+		}
+		changed = true
+	}
+	for name, h := range existing {
+		if _, ok := devices[strings.TrimSuffix(name, "."+opts.Domain)]; ok || h.Disabled {
+			continue
+		}
+		log.Info().Str("host", name).Bool("dryRun", opts.DryRun).Msg("disabling Icinga host")
+		if opts.DryRun {
+			continue
+		}
+		if err := call(opts, http.MethodPost, "/host?name="+url.QueryEscape(name), map[string]bool{"disabled": true}, nil); err != nil {
+			return err
+		}
+		changed = true
+	}
+	if changed {
+		log.Info().Msg("deploying Icinga Director config")
+		return call(opts, http.MethodPost, "/config/deploy", nil, nil)
+	}
+	return nil
+}
+
+func call(opts Options, method, path string, payload interface{}, out interface{}) error {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return fmt.Errorf("error creating Icinga Director %s request body: %s", method, err)
+		}
+	}
+	request, err := http.NewRequest(method, strings.TrimSuffix(opts.URL, "/")+path, bytes.NewBuffer(body))
+	if err != nil {
+		return fmt.Errorf("error creating Icinga Director %s request: %s", method, err)
+	}
+	request.SetBasicAuth(opts.Username, opts.Password)
+	// Director serves its web UI instead of JSON without this
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set("Content-Type", "application/json")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("error performing Icinga Director %s %s: %s", method, path, err)
+	}
+	defer response.Body.Close()
+	body, err = ioutil.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("error reading Icinga Director %s %s body: %s", method, path, err)
+	}
+	// 201 on creation, 304 when nothing changed
+	if response.StatusCode > http.StatusCreated && response.StatusCode != http.StatusNotModified {
+		return fmt.Errorf("non-2xx response to Icinga Director %s %s: %d: %s", method, path, response.StatusCode, body)
+	}
+	if out != nil {
+		if err := json.Unmarshal(body, out); err != nil {
+			return fmt.Errorf("error unmarshalling Icinga Director %s %s as JSON: %s", method, path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package leader
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+)
+
+// DNSLease is a Backend keeping the lease in a TXT record, e.g. in the zone being synced, so
+// instances need nothing but the DNS provider they already use to coordinate. Its content names the
+// holder and when the lease expires.
+//
+// DNS providers can't compare-and-swap records, so when two instances take a free lease at the same
+// moment, both can briefly lead. Each rereads the record after taking the lease, and renewals
+// resolve any remaining conflict in favor of one holder, within a third of the TTL.
+type DNSLease struct {
+	// DNS returns the provider to use for each Acquire or Release, so that rotated credentials are
+	// picked up.
+	DNS  func() (sync.DNSProvider, error)
+	Zone string
+	// Name is the TXT record's full name, e.g. _tailscale2cloudflare-leader.ts.example.com.
+	Name string
+}
+
+// recordTTL is the TXT record's own DNS TTL. Nothing resolves it, so it hardly matters.
+const recordTTL = 60
+
+// lease is a TXT record's claim on the lease.
+type lease struct {
+	record  sync.Record
+	holder  string
+	expires time.Time
+}
+
+// parseLease parses "holder=<holder>,expires=<unix seconds>".
+func parseLease(record sync.Record) (lease, bool) {
+	l := lease{record: record}
+	for _, field := range strings.Split(strings.Trim(record.Content, `"`), ",") {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "holder":
+			l.holder = value
+		case "expires":
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return l, false
+			}
+			l.expires = time.Unix(seconds, 0)
+		}
+	}
+	return l, l.holder != "" && !l.expires.IsZero()
+}
+
+// leases lists the claims on the lease, ordered by record ID so that every instance sees the same
+// one first.
+func (d *DNSLease) leases(ctx context.Context, dns sync.DNSProvider) ([]lease, error) {
+	records, err := dns.ListRecords(ctx, d.Zone, "TXT")
+	if err != nil {
+		return nil, err
+	}
+	var leases []lease
+	for _, record := range records {
+		if !strings.EqualFold(record.Name, d.Name) {
+			continue
+		}
+		// a record that isn't a lease is treated as an expired one, and taken over
+		l, _ := parseLease(record)
+		leases = append(leases, l)
+	}
+	sort.Slice(leases, func(i, j int) bool { return leases[i].record.ID < leases[j].record.ID })
+	return leases, nil
+}
+
+// current returns the first claim that hasn't expired, if any.
+func current(leases []lease, now time.Time) *lease {
+	for i := range leases {
+		if now.Before(leases[i].expires) {
+			return &leases[i]
+		}
+	}
+	return nil
+}
+
+// Acquire creates or renews the lease's TXT record if no other holder's claim is live.
+func (d *DNSLease) Acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error) {
+	dns, err := d.DNS()
+	if err != nil {
+		return false, err
+	}
+	leases, err := d.leases(ctx, dns)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	live := current(leases, now)
+	if live != nil && live.holder != holder {
+		// drop any claim of ours that lost out, which the next renewal retries if this fails
+		for _, l := range leases {
+			if l.holder == holder {
+				d.delete(ctx, dns, l.record)
+			}
+		}
+		return false, nil
+	}
+	mutation := sync.Mutation{
+		Action:  sync.MutationCreate,
+		Type:    "TXT",
+		Name:    d.Name,
+		Content: fmt.Sprintf(`"holder=%s,expires=%d"`, holder, now.Add(ttl).Unix()),
+		TTL:     recordTTL,
+	}
+	// renew our live claim, or take over an expired one rather than piling up records
+	renewing := live != nil
+	if renewing {
+		mutation.Action, mutation.RecordID = sync.MutationUpdate, live.record.ID
+	} else if len(leases) > 0 {
+		mutation.Action, mutation.RecordID = sync.MutationUpdate, leases[0].record.ID
+	}
+	if _, err := dns.Apply(ctx, d.Zone, mutation); err != nil {
+		return false, fmt.Errorf("error writing leader lease record: %s", err)
+	}
+	if renewing {
+		return true, nil
+	}
+	// make sure another instance didn't take it at the same time
+	if leases, err = d.leases(ctx, dns); err != nil {
+		return false, err
+	}
+	if live := current(leases, now); live == nil || live.holder != holder {
+		return false, nil
+	}
+	return true, nil
+}
+
+// Release deletes holder's claims on the lease.
+func (d *DNSLease) Release(ctx context.Context, holder string) error {
+	dns, err := d.DNS()
+	if err != nil {
+		return err
+	}
+	leases, err := d.leases(ctx, dns)
+	if err != nil {
+		return err
+	}
+	for _, l := range leases {
+		if l.holder == holder {
+			if err := d.delete(ctx, dns, l.record); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *DNSLease) delete(ctx context.Context, dns sync.DNSProvider, record sync.Record) error {
+	_, err := dns.Apply(ctx, d.Zone, sync.Mutation{
+		Action:   sync.MutationDelete,
+		Type:     "TXT",
+		Name:     record.Name,
+		Content:  record.Content,
+		RecordID: record.ID,
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting leader lease record: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package leader
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+)
+
+const leaseName = "_tailscale2cloudflare-leader.ts.example.com"
+
+// fakeDNS is an in-memory DNS provider.
+type fakeDNS struct {
+	records []sync.Record
+	nextID  int
+}
+
+func (f *fakeDNS) ListRecords(ctx context.Context, zone, recordType string) ([]sync.Record, error) {
+	var records []sync.Record
+	for _, record := range f.records {
+		if record.Type == recordType {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+func (f *fakeDNS) Apply(ctx context.Context, zone string, mutation sync.Mutation) (*sync.Record, error) {
+	switch mutation.Action {
+	case sync.MutationCreate:
+		f.nextID++
+		f.records = append(f.records, sync.Record{ID: fmt.Sprintf("new%d", f.nextID), Type: mutation.Type, Name: mutation.Name, Content: mutation.Content})
+		return nil, nil
+	case sync.MutationUpdate, sync.MutationDelete:
+		for i, record := range f.records {
+			if record.ID != mutation.RecordID {
+				continue
+			}
+			if mutation.Action == sync.MutationDelete {
+				f.records = append(f.records[:i], f.records[i+1:]...)
+			} else {
+				f.records[i].Content = mutation.Content
+			}
+			return nil, nil
+		}
+		return nil, fmt.Errorf("no record %s", mutation.RecordID)
+	}
+	return nil, fmt.Errorf("unexpected mutation %s", mutation.Action)
+}
+
+// holders lists the holders of the fake's lease records by record ID, e.g. "r1 a".
+func (f *fakeDNS) holders() []string {
+	var holders []string
+	for _, record := range f.records {
+		l, ok := parseLease(record)
+		if !ok {
+			holders = append(holders, record.ID+" ?")
+			continue
+		}
+		holders = append(holders, record.ID+" "+l.holder)
+	}
+	sort.Strings(holders)
+	return holders
+}
+
+func leaseRecord(id, holder string, expires time.Time) sync.Record {
+	return sync.Record{ID: id, Type: "TXT", Name: leaseName, Content: fmt.Sprintf(`"holder=%s,expires=%d"`, holder, expires.Unix())}
+}
+
+func TestDNSLeaseAcquire(t *testing.T) {
+	var (
+		live    = time.Now().Add(time.Minute)
+		expired = time.Now().Add(-time.Minute)
+	)
+	tests := []struct {
+		name        string
+		records     []sync.Record
+		wantLeading bool
+		wantHolders []string
+	}{
+		{
+			name:        "free",
+			wantLeading: true,
+			wantHolders: []string{"new1 a"},
+		},
+		{
+			name:        "held",
+			records:     []sync.Record{leaseRecord("r1", "b", live)},
+			wantHolders: []string{"r1 b"},
+		},
+		{
+			name:        "expired",
+			records:     []sync.Record{leaseRecord("r1", "b", expired)},
+			wantLeading: true,
+			wantHolders: []string{"r1 a"},
+		},
+		{
+			name:        "renewing",
+			records:     []sync.Record{leaseRecord("r1", "a", live)},
+			wantLeading: true,
+			wantHolders: []string{"r1 a"},
+		},
+		{
+			name:        "lost a race",
+			records:     []sync.Record{leaseRecord("r1", "b", live), leaseRecord("r2", "a", live)},
+			wantHolders: []string{"r1 b"},
+		},
+		{
+			name:        "won a race",
+			records:     []sync.Record{leaseRecord("r1", "a", live), leaseRecord("r2", "b", live)},
+			wantLeading: true,
+			wantHolders: []string{"r1 a", "r2 b"},
+		},
+		{
+			name:        "not a lease",
+			records:     []sync.Record{{ID: "r1", Type: "TXT", Name: leaseName, Content: "hello"}},
+			wantLeading: true,
+			wantHolders: []string{"r1 a"},
+		},
+		{
+			name:        "other names",
+			records:     []sync.Record{{ID: "r1", Type: "TXT", Name: "other.ts.example.com", Content: "holder=b,expires=9999999999"}},
+			wantLeading: true,
+			wantHolders: []string{"new1 a", "r1 b"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dns := &fakeDNS{records: append([]sync.Record(nil), test.records...)}
+			lease := &DNSLease{
+				DNS:  func() (sync.DNSProvider, error) { return dns, nil },
+				Zone: "z",
+				Name: leaseName,
+			}
+			leading, err := lease.Acquire(context.Background(), "a", time.Minute)
+			if err != nil {
+				t.Fatalf("error acquiring lease: %s", err)
+			}
+			if leading != test.wantLeading {
+				t.Errorf("leading = %t, want %t", leading, test.wantLeading)
+			}
+			if holders := dns.holders(); !reflect.DeepEqual(holders, test.wantHolders) {
+				t.Errorf("holders = %q, want %q", holders, test.wantHolders)
+			}
+		})
+	}
+}
+
+func TestDNSLeaseRelease(t *testing.T) {
+	live := time.Now().Add(time.Minute)
+	dns := &fakeDNS{records: []sync.Record{leaseRecord("r1", "a", live), leaseRecord("r2", "b", live)}}
+	lease := &DNSLease{
+		DNS:  func() (sync.DNSProvider, error) { return dns, nil },
+		Zone: "z",
+		Name: leaseName,
+	}
+	if err := lease.Release(context.Background(), "a"); err != nil {
+		t.Fatalf("error releasing lease: %s", err)
+	}
+	if holders, want := dns.holders(), []string{"r2 b"}; !reflect.DeepEqual(holders, want) {
+		t.Errorf("holders = %q, want %q", holders, want)
+	}
+}
@@ -0,0 +1,158 @@
+// Package leader elects one of several redundant daemons to apply changes, while the others stand by
+// ready to take over once its lease runs out.
+package leader
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Backend stores a lease that at most one holder has at a time.
+type Backend interface {
+	// Acquire takes the lease for holder until ttl from now if it's free, expired, or already
+	// holder's, reporting whether holder has it.
+	Acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error)
+	// Release gives up holder's lease, if it still has it, so that another holder can take over
+	// without waiting for it to expire.
+	Release(ctx context.Context, holder string) error
+}
+
+// releaseTimeout bounds how long releasing the lease can hold up shutting down.
+const releaseTimeout = 10 * time.Second
+
+// Elector keeps trying to hold Backend's lease as Holder, renewing it every third of TTL.
+type Elector struct {
+	Backend Backend
+	Holder  string
+	TTL     time.Duration
+	// OnChange, if set, is called whenever Holder gains or loses the lease.
+	OnChange func(leading bool)
+	// Logger receives the Elector's logs. Defaults to zerolog's global logger.
+	Logger *zerolog.Logger
+
+	leading atomic.Bool
+
+	mu sync.Mutex
+	// term is canceled when Holder steps down, which expiry does once the lease has gone unrenewed
+	// until expires
+	term    context.Context
+	endTerm context.CancelFunc
+	expiry  *time.Timer
+	expires time.Time
+}
+
+// New returns an Elector. Call Run to start campaigning.
+func New(backend Backend, holder string, ttl time.Duration, onChange func(leading bool)) *Elector {
+	return &Elector{
+		Backend:  backend,
+		Holder:   holder,
+		TTL:      ttl,
+		OnChange: onChange,
+	}
+}
+
+// Leading reports whether Holder has the lease.
+func (e *Elector) Leading() bool {
+	return e.leading.Load()
+}
+
+// Term returns a context that's canceled as soon as Holder stops leading, for work only the leader
+// should do. If Holder isn't leading, it's already canceled.
+func (e *Elector) Term() context.Context {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.term == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		return ctx
+	}
+	return e.term
+}
+
+func (e *Elector) logger() *zerolog.Logger {
+	if e.Logger == nil {
+		return &log.Logger
+	}
+	return e.Logger
+}
+
+// Run acquires and renews the lease until ctx is done, then releases it. If renewing fails, e.g.
+// because the backend is unreachable, Holder keeps leading until half of TTL has passed since the
+// last renewal, stepping down well before another holder could take over.
+func (e *Elector) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.TTL / 3)
+	defer ticker.Stop()
+	for {
+		// a hung backend mustn't hold up the next renewal
+		acquireCtx, cancel := context.WithTimeout(ctx, e.TTL/3)
+		acquired, err := e.Backend.Acquire(acquireCtx, e.Holder, e.TTL)
+		cancel()
+		switch {
+		case err != nil && ctx.Err() == nil:
+			e.logger().Warn().Err(err).Str("holder", e.Holder).Msg("error acquiring leader lease")
+		case acquired:
+			e.lead(ctx)
+		case err == nil:
+			e.stepDown(false)
+		}
+		select {
+		case <-ctx.Done():
+			if e.Leading() {
+				e.stepDown(false)
+				releaseCtx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+				if err := e.Backend.Release(releaseCtx, e.Holder); err != nil {
+					e.logger().Warn().Err(err).Str("holder", e.Holder).Msg("error releasing leader lease")
+				}
+				cancel()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// lead starts a term as leader, or extends the current one, after the lease was renewed.
+func (e *Elector) lead(ctx context.Context) {
+	e.mu.Lock()
+	e.expires = time.Now().Add(e.TTL / 2)
+	if e.term != nil {
+		e.expiry.Reset(e.TTL / 2)
+		e.mu.Unlock()
+		return
+	}
+	e.term, e.endTerm = context.WithCancel(ctx)
+	e.expiry = time.AfterFunc(e.TTL/2, func() { e.stepDown(true) })
+	e.mu.Unlock()
+	e.leading.Store(true)
+	e.logger().Info().Str("holder", e.Holder).Msg("acquired leader lease, applying changes")
+	if e.OnChange != nil {
+		e.OnChange(true)
+	}
+}
+
+// stepDown ends the current term, if any, canceling work started during it. If expired, it only
+// does so if the lease hasn't been renewed in the meantime.
+func (e *Elector) stepDown(expired bool) {
+	e.mu.Lock()
+	if e.term == nil || expired && time.Now().Before(e.expires) {
+		e.mu.Unlock()
+		return
+	}
+	if expired {
+		e.logger().Warn().Str("holder", e.Holder).Msg("couldn't renew leader lease in time")
+	}
+	e.expiry.Stop()
+	e.endTerm()
+	e.term = nil
+	e.mu.Unlock()
+	e.leading.Store(false)
+	e.logger().Info().Str("holder", e.Holder).Msg("lost leader lease, standing by")
+	if e.OnChange != nil {
+		e.OnChange(false)
+	}
+}
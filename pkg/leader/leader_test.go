@@ -0,0 +1,125 @@
+package leader
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// fakeBackend answers the nth Acquire (counting from 0) with acquire(n).
+type fakeBackend struct {
+	acquire func(n int) (bool, error)
+
+	mu       gosync.Mutex
+	acquires int
+	released bool
+}
+
+func (b *fakeBackend) Acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error) {
+	b.mu.Lock()
+	n := b.acquires
+	b.acquires++
+	b.mu.Unlock()
+	return b.acquire(n)
+}
+
+func (b *fakeBackend) Release(ctx context.Context, holder string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.released = true
+	return nil
+}
+
+func TestElector(t *testing.T) {
+	const ttl = 60 * time.Millisecond
+	errUnreachable := errors.New("unreachable")
+	tests := []struct {
+		name    string
+		acquire func(n int) (bool, error)
+		// wantLeading is whether the holder leads after a few renewals
+		wantLeading bool
+		wantChanges []bool
+		wantRelease bool
+	}{
+		{
+			name:        "leads",
+			acquire:     func(int) (bool, error) { return true, nil },
+			wantLeading: true,
+			wantChanges: []bool{true, false},
+			wantRelease: true,
+		},
+		{
+			name:    "stands by",
+			acquire: func(int) (bool, error) { return false, nil },
+		},
+		{
+			name: "loses the lease",
+			acquire: func(n int) (bool, error) {
+				return n == 0, nil
+			},
+			wantChanges: []bool{true, false},
+		},
+		{
+			name: "can't renew",
+			acquire: func(n int) (bool, error) {
+				if n == 0 {
+					return true, nil
+				}
+				return false, errUnreachable
+			},
+			wantChanges: []bool{true, false},
+		},
+		{
+			name:    "backend unreachable",
+			acquire: func(int) (bool, error) { return false, errUnreachable },
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				backend = &fakeBackend{acquire: test.acquire}
+				mu      gosync.Mutex
+				changes []bool
+			)
+			elector := New(backend, "a", ttl, func(leading bool) {
+				mu.Lock()
+				defer mu.Unlock()
+				changes = append(changes, leading)
+			})
+			logger := zerolog.Nop()
+			elector.Logger = &logger
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				elector.Run(ctx)
+				close(done)
+			}()
+			time.Sleep(2 * ttl)
+			term := elector.Term()
+			if elector.Leading() != test.wantLeading {
+				t.Errorf("leading = %t, want %t", elector.Leading(), test.wantLeading)
+			}
+			if (term.Err() == nil) != test.wantLeading {
+				t.Errorf("term error = %v while leading = %t", term.Err(), test.wantLeading)
+			}
+			cancel()
+			<-done
+			if term.Err() == nil {
+				t.Error("term wasn't canceled after Run returned")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !reflect.DeepEqual(changes, test.wantChanges) {
+				t.Errorf("changes = %v, want %v", changes, test.wantChanges)
+			}
+			if backend.released != test.wantRelease {
+				t.Errorf("released = %t, want %t", backend.released, test.wantRelease)
+			}
+		})
+	}
+}
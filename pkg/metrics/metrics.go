@@ -0,0 +1,181 @@
+// Package metrics keeps sync and API error counters for long-running syncs and serves them in the
+// Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics holds the values exposed to Prometheus. The zero value is not usable; use New.
+type Metrics struct {
+	mu          sync.Mutex
+	lastSync    time.Time
+	lastSuccess time.Time
+	lastError   string
+	duration    time.Duration
+	syncs       map[string]float64 // by result
+	records     map[string]float64 // by mutation action
+	apiErrors   map[string]float64 // by API
+}
+
+// New returns Metrics with every series at zero.
+func New() *Metrics {
+	return &Metrics{
+		syncs:     map[string]float64{"success": 0, "failure": 0},
+		records:   map[string]float64{"create": 0, "update": 0, "delete": 0, "retune": 0},
+		apiErrors: map[string]float64{"tailscale": 0, "cloudflare": 0},
+	}
+}
+
+// RecordSync records a finished sync, counting the records it changed by action.
+func (m *Metrics) RecordSync(start time.Time, elapsed time.Duration, changed map[string]int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastSync = start.Add(elapsed)
+	m.duration = elapsed
+	if err != nil {
+		m.syncs["failure"]++
+		m.lastError = err.Error()
+	} else {
+		m.syncs["success"]++
+		m.lastSuccess = m.lastSync
+		m.lastError = ""
+	}
+	for action, count := range changed {
+		m.records[action] += float64(count)
+	}
+}
+
+// Health is whether syncs are keeping up, as reported to readiness probes.
+type Health struct {
+	Ready       bool       `json:"ready"`
+	Reason      string     `json:"reason,omitempty"`
+	LastSync    *time.Time `json:"lastSync,omitempty"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	// LastError is why the last sync failed, if it did.
+	LastError string `json:"lastError,omitempty"`
+	// Leading is whether this instance holds the leader lease, with leader election.
+	Leading *bool `json:"leading,omitempty"`
+}
+
+// Standby reports h for an instance that isn't leading, which is ready since it's doing its job by
+// standing by, however long ago it last synced.
+func (h Health) Standby() Health {
+	leading := false
+	h.Leading = &leading
+	h.Ready = true
+	h.Reason = "standing by while another instance leads"
+	return h
+}
+
+// Health reports syncs as ready if one succeeded within maxAge of now. Without a maxAge, the last sync
+// has to have succeeded instead.
+func (m *Metrics) Health(maxAge time.Duration, now time.Time) Health {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	health := Health{LastError: m.lastError}
+	if !m.lastSync.IsZero() {
+		lastSync := m.lastSync
+		health.LastSync = &lastSync
+	}
+	if !m.lastSuccess.IsZero() {
+		lastSuccess := m.lastSuccess
+		health.LastSuccess = &lastSuccess
+	}
+	switch {
+	case m.lastSync.IsZero():
+		health.Reason = "no sync has finished yet"
+	case m.lastSuccess.IsZero():
+		health.Reason = "no sync has succeeded yet"
+	case maxAge == 0 && m.lastError != "":
+		health.Reason = "the last sync failed"
+	case maxAge > 0 && now.Sub(m.lastSuccess) > maxAge:
+		health.Reason = fmt.Sprintf("no sync has succeeded in %s", now.Sub(m.lastSuccess).Round(time.Second))
+	default:
+		health.Ready = true
+	}
+	return health
+}
+
+// APIError counts a failed request to api, e.g. "cloudflare".
+func (m *Metrics) APIError(api string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.apiErrors[api]++
+}
+
+// WriteTo writes every metric in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var b strings.Builder
+	writeMetric(&b, "tailscale2cloudflare_last_sync_timestamp_seconds", "gauge", "When the last sync finished, successful or not.", unixSeconds(m.lastSync))
+	writeMetric(&b, "tailscale2cloudflare_last_success_timestamp_seconds", "gauge", "When the last successful sync finished.", unixSeconds(m.lastSuccess))
+	writeMetric(&b, "tailscale2cloudflare_sync_duration_seconds", "gauge", "How long the last sync took.", m.duration.Seconds())
+	writeLabeled(&b, "tailscale2cloudflare_syncs_total", "counter", "Syncs run, by result.", "result", m.syncs)
+	writeLabeled(&b, "tailscale2cloudflare_records_changed_total", "counter", "DNS records changed, by action.", "action", m.records)
+	writeLabeled(&b, "tailscale2cloudflare_api_errors_total", "counter", "Failed API requests, including error responses, by API.", "api", m.apiErrors)
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ServeHTTP serves the metrics for scraping.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// Transport counts failed requests to the Tailscale and Cloudflare APIs going through it.
+type Transport struct {
+	Metrics   *Metrics
+	Transport http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(request *http.Request) (*http.Response, error) {
+	response, err := t.Transport.RoundTrip(request)
+	if err != nil || response.StatusCode >= http.StatusBadRequest {
+		if api := apiName(request.URL.Hostname()); api != "" {
+			t.Metrics.APIError(api)
+		}
+	}
+	return response, err
+}
+
+func apiName(host string) string {
+	switch {
+	case host == "tailscale.com" || strings.HasSuffix(host, ".tailscale.com"):
+		return "tailscale"
+	case host == "cloudflare.com" || strings.HasSuffix(host, ".cloudflare.com"):
+		return "cloudflare"
+	}
+	return ""
+}
+
+func writeMetric(b *strings.Builder, name, kind, help string, value float64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, help, name, kind, name, value)
+}
+
+func writeLabeled(b *strings.Builder, name, kind, help, label string, values map[string]float64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(b, "%s{%s=%q} %g\n", name, label, key, values[key])
+	}
+}
+
+func unixSeconds(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / float64(time.Second)
+}
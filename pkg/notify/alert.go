@@ -0,0 +1,118 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// Alerter opens an incident when syncs keep failing and resolves it once they recover.
+type Alerter interface {
+	Trigger(ctx context.Context, summary, details string) error
+	Resolve(ctx context.Context) error
+}
+
+// PagerDuty sends alerts through the PagerDuty Events API v2.
+type PagerDuty struct {
+	RoutingKey string
+	// DedupKey ties trigger and resolve events to the same incident.
+	DedupKey string
+}
+
+func (p *PagerDuty) Trigger(ctx context.Context, summary, details string) error {
+	return p.enqueue(ctx, map[string]interface{}{
+		"routing_key":  p.RoutingKey,
+		"event_action": "trigger",
+		"dedup_key":    p.DedupKey,
+		"payload": map[string]interface{}{
+			"summary":  summary,
+			"source":   "tailscale2cloudflare",
+			"severity": "error",
+			"custom_details": map[string]string{
+				"error": details,
+			},
+		},
+	})
+}
+
+func (p *PagerDuty) Resolve(ctx context.Context) error {
+	return p.enqueue(ctx, map[string]interface{}{
+		"routing_key":  p.RoutingKey,
+		"event_action": "resolve",
+		"dedup_key":    p.DedupKey,
+	})
+}
+
+func (p *PagerDuty) enqueue(ctx context.Context, event map[string]interface{}) error {
+	return postJSON(ctx, "PagerDuty event", "https://events.pagerduty.com/v2/enqueue", nil, event)
+}
+
+// Opsgenie sends alerts through the Opsgenie Alert API.
+type Opsgenie struct {
+	APIKey string
+	// APIURL defaults to https://api.opsgenie.com; EU accounts use https://api.eu.opsgenie.com.
+	APIURL string
+	// Alias ties create and close requests to the same alert.
+	Alias string
+}
+
+func (o *Opsgenie) Trigger(ctx context.Context, summary, details string) error {
+	return postJSON(ctx, "Opsgenie alert", o.apiURL()+"/v2/alerts", o.headers(), map[string]interface{}{
+		"message":     summary,
+		"alias":       o.Alias,
+		"description": details,
+		"source":      "tailscale2cloudflare",
+		"priority":    "P2",
+	})
+}
+
+func (o *Opsgenie) Resolve(ctx context.Context) error {
+	closeURL := fmt.Sprintf("%s/v2/alerts/%s/close?identifierType=alias", o.apiURL(), url.PathEscape(o.Alias))
+	return postJSON(ctx, "Opsgenie alert close", closeURL, o.headers(), map[string]interface{}{
+		"source": "tailscale2cloudflare",
+	})
+}
+
+func (o *Opsgenie) apiURL() string {
+	if o.APIURL != "" {
+		return o.APIURL
+	}
+	return "https://api.opsgenie.com"
+}
+
+func (o *Opsgenie) headers() map[string]string {
+	return map[string]string{"Authorization": "GenieKey " + o.APIKey}
+}
+
+// postJSON POSTs a JSON body, treating anything above 202 as an error.
+func postJSON(ctx context.Context, what, postURL string, headers map[string]string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error creating %s POST request body: %s", what, err)
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, postURL, bytes.NewBuffer(body))
+	if err != nil {
+		return fmt.Errorf("error creating %s POST request: %s", what, err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("error performing %s POST: %s", what, err)
+	}
+	defer response.Body.Close()
+	body, err = ioutil.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("error reading %s POST body: %s", what, err)
+	}
+	if response.StatusCode > http.StatusAccepted {
+		return fmt.Errorf(">202 response to %s POST: %d: %s", what, response.StatusCode, body)
+	}
+	return nil
+}
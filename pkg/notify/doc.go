@@ -0,0 +1,2 @@
+// Package notify reports the outcome of sync runs to monitoring, alerting, and messaging systems.
+package notify
@@ -0,0 +1,87 @@
+package notify
+
+import (
+	"time"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+)
+
+// ChangeEvent is published for each record change a run applied.
+type ChangeEvent struct {
+	Type     string              `json:"type"` // always "change"
+	Action   sync.MutationAction `json:"action"`
+	Name     string              `json:"name"`
+	Content  string              `json:"content,omitempty"`
+	RecordID string              `json:"recordID,omitempty"`
+	TTL      int                 `json:"ttl,omitempty"`
+	Time     time.Time           `json:"time"`
+}
+
+// SummaryEvent is published once per run.
+type SummaryEvent struct {
+	Type    string    `json:"type"` // always "summary"
+	Summary string    `json:"summary"`
+	Applied int       `json:"applied"`
+	Failed  int       `json:"failed"`
+	DryRun  bool      `json:"dryRun"`
+	Error   string    `json:"error,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// PlanEvent is published once per run with everything the run planned to change.
+type PlanEvent struct {
+	Type     string              `json:"type"` // always "plan"
+	ToCreate map[string][]string `json:"toCreate"`
+	ToUpdate map[string][]string `json:"toUpdate"`
+	ToDelete map[string][]string `json:"toDelete"`
+	ToRetune map[string]int      `json:"toRetune,omitempty"`
+	DryRun   bool                `json:"dryRun"`
+	Time     time.Time           `json:"time"`
+}
+
+// NewPlanEvent describes what result planned to change.
+func NewPlanEvent(result *sync.Result) PlanEvent {
+	return PlanEvent{
+		Type:     "plan",
+		ToCreate: result.ToCreate,
+		ToUpdate: result.ToUpdate,
+		ToDelete: result.ToDelete,
+		ToRetune: result.ToRetune,
+		DryRun:   result.DryRun,
+		Time:     time.Now().UTC(),
+	}
+}
+
+// RunEvents turns the outcome of a run into events. result may be nil if the run failed early.
+func RunEvents(result *sync.Result, syncErr error) ([]ChangeEvent, SummaryEvent) {
+	var (
+		now     = time.Now().UTC()
+		changes []ChangeEvent
+		summary = SummaryEvent{Type: "summary", Time: now}
+	)
+	if syncErr != nil {
+		summary.Error = syncErr.Error()
+		summary.Summary = syncErr.Error()
+	}
+	if result == nil {
+		return nil, summary
+	}
+	if syncErr == nil {
+		summary.Summary = result.Summary()
+	}
+	summary.DryRun = result.DryRun
+	summary.Failed = len(result.Failed)
+	for _, mutation := range result.Applied() {
+		changes = append(changes, ChangeEvent{
+			Type:     "change",
+			Action:   mutation.Action,
+			Name:     mutation.Name,
+			Content:  mutation.Content,
+			RecordID: mutation.RecordID,
+			TTL:      mutation.TTL,
+			Time:     now,
+		})
+	}
+	summary.Applied = len(changes)
+	return changes, summary
+}
@@ -0,0 +1,32 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AnnotateGrafana posts an organization-wide annotation spanning start to end that lists the applied
+// changes, so they show up on dashboards. token is a Grafana service account token.
+func AnnotateGrafana(ctx context.Context, grafanaURL, token string, tags []string, start, end time.Time, changes []ChangeEvent) error {
+	lines := make([]string, 0, len(changes))
+	for _, change := range changes {
+		line := fmt.Sprintf("%s %s", change.Action, change.Name)
+		if change.Content != "" {
+			line += " " + change.Content
+		}
+		if change.TTL != 0 {
+			line += fmt.Sprintf(" (TTL %d)", change.TTL)
+		}
+		lines = append(lines, line)
+	}
+	return postJSON(ctx, "Grafana annotation", strings.TrimSuffix(grafanaURL, "/")+"/api/annotations", map[string]string{
+		"Authorization": "Bearer " + token,
+	}, map[string]interface{}{
+		"time":    start.UnixMilli(),
+		"timeEnd": end.UnixMilli(),
+		"tags":    tags,
+		"text":    fmt.Sprintf("tailscale2cloudflare applied %d DNS changes:\n%s", len(changes), strings.Join(lines, "\n")),
+	})
+}
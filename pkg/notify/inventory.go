@@ -0,0 +1,32 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// InventoryEvent is published when a device appears in or vanishes from a tailnet.
+type InventoryEvent struct {
+	Type      string    `json:"type"`   // always "device"
+	Action    string    `json:"action"` // "appeared" or "vanished"
+	Tailnet   string    `json:"tailnet"`
+	Name      string    `json:"name"`
+	Hostname  string    `json:"hostname"`
+	Addresses []string  `json:"addresses"`
+	Time      time.Time `json:"time"`
+}
+
+// PostInventoryWebhook POSTs inventory events as JSON. The payload's "text" field is a readable
+// summary, which is what Slack and Mattermost incoming webhooks display.
+func PostInventoryWebhook(ctx context.Context, webhookURL string, events []InventoryEvent) error {
+	lines := make([]string, 0, len(events))
+	for _, event := range events {
+		lines = append(lines, fmt.Sprintf("%s %s (%s) in %s: %s", event.Action, event.Name, event.Hostname, event.Tailnet, strings.Join(event.Addresses, ", ")))
+	}
+	return postJSON(ctx, "inventory webhook", webhookURL, nil, map[string]interface{}{
+		"text":   fmt.Sprintf("tailscale2cloudflare saw %d tailnet device changes:\n%s", len(events), strings.Join(lines, "\n")),
+		"events": events,
+	})
+}
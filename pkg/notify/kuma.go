@@ -0,0 +1,60 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type kumaPushResponse struct {
+	OK  bool
+	Msg string
+}
+
+// PushUptimeKuma reports the outcome of a run to an Uptime Kuma push monitor, e.g.
+// https://kuma.example.com/api/push/deadbeef?status=up&msg=OK&ping= as copied from the Kuma UI.
+// The status, msg, and ping query parameters are overwritten.
+func PushUptimeKuma(ctx context.Context, pushURL string, up bool, msg string, ping time.Duration) error {
+	parsed, err := url.Parse(pushURL)
+	if err != nil {
+		return fmt.Errorf("error parsing Uptime Kuma push URL: %s", err)
+	}
+	status := "up"
+	if !up {
+		status = "down"
+	}
+	query := parsed.Query()
+	query.Set("status", status)
+	query.Set("msg", msg)
+	query.Set("ping", strconv.FormatInt(ping.Milliseconds(), 10))
+	parsed.RawQuery = query.Encode()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, parsed.String(), nil)
+	if err != nil {
+		return fmt.Errorf("error creating Uptime Kuma push GET request: %s", err)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("error performing Uptime Kuma push GET: %s", err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("error reading Uptime Kuma push GET body: %s", err)
+	}
+	if response.StatusCode > http.StatusOK {
+		return fmt.Errorf("non-200 response to Uptime Kuma push GET: %d: %s", response.StatusCode, body)
+	}
+	var pushResponse kumaPushResponse
+	if err := json.Unmarshal(body, &pushResponse); err != nil {
+		return fmt.Errorf("error unmarshalling Uptime Kuma push GET as JSON: %s", err)
+	}
+	if !pushResponse.OK {
+		return fmt.Errorf("Uptime Kuma rejected push: %s", pushResponse.Msg)
+	}
+	return nil
+}
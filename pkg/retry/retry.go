@@ -0,0 +1,130 @@
+// Package retry retries HTTP requests that fail transiently, e.g. on rate limiting, so that one bad
+// response doesn't abort a sync halfway through.
+package retry
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// maxDelay caps the exponential backoff between attempts, but not waits asked for by Retry-After.
+const maxDelay = time.Minute
+
+// Transport retries requests that fail with a network error, 429 Too Many Requests, or a 5xx status,
+// waiting with jittered exponential backoff between attempts, or as long as Retry-After asks.
+// Requests whose body can't be replayed are only tried once.
+type Transport struct {
+	Transport http.RoundTripper
+	// Attempts is how many times a request is tried in total. Less than 2 disables retrying.
+	Attempts int
+	// Delay is the backoff before the first retry, doubling for each one after.
+	Delay time.Duration
+	// AttemptTimeout bounds each attempt, if set.
+	AttemptTimeout time.Duration
+	// Logger receives a warning for each retry. Defaults to zerolog's global logger.
+	Logger *zerolog.Logger
+}
+
+func (t *Transport) logger() *zerolog.Logger {
+	if t.Logger == nil {
+		return &log.Logger
+	}
+	return t.Logger
+}
+
+func (t *Transport) RoundTrip(request *http.Request) (*http.Response, error) {
+	delay := t.Delay
+	for attempt := 1; ; attempt++ {
+		response, err := t.attempt(request)
+		retryable := err != nil || response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= http.StatusInternalServerError
+		if !retryable || attempt >= t.Attempts || request.Body != nil && request.GetBody == nil {
+			return response, err
+		}
+		// +/- 20% so that concurrent requests don't retry in lockstep
+		wait := min(delay, maxDelay)
+		wait += time.Duration((rand.Float64() - 0.5) * 0.4 * float64(wait))
+		event := t.logger().Warn().Str("method", request.Method).Str("url", request.URL.Redacted()).Int("attempt", attempt)
+		if err != nil {
+			event = event.Err(err)
+		} else {
+			event = event.Int("status", response.StatusCode)
+			if retryAfter, ok := parseRetryAfter(response.Header.Get("Retry-After"), time.Now()); ok {
+				wait = retryAfter
+			}
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+		}
+		event.Dur("retryIn", wait).Msg("retrying API request")
+		if err := sleep(request.Context(), wait); err != nil {
+			return nil, err
+		}
+		if request.GetBody != nil {
+			body, err := request.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			request = request.Clone(request.Context())
+			request.Body = body
+		}
+		delay *= 2
+	}
+}
+
+// attempt makes one attempt, bounded by AttemptTimeout.
+func (t *Transport) attempt(request *http.Request) (*http.Response, error) {
+	if t.AttemptTimeout <= 0 {
+		return t.Transport.RoundTrip(request)
+	}
+	ctx, cancel := context.WithTimeout(request.Context(), t.AttemptTimeout)
+	response, err := t.Transport.RoundTrip(request.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// the deadline has to keep covering the body until it's read
+	response.Body = &cancelBody{ReadCloser: response.Body, cancel: cancel}
+	return response, nil
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// parseRetryAfter parses a Retry-After header, which is either seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(at.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,102 @@
+package retry
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestTransport(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		body         string
+		attempts     int
+		statuses     []int
+		retryAfter   string
+		wantAttempts int
+		wantStatus   int
+	}{
+		{name: "success", attempts: 3, statuses: []int{200}, wantAttempts: 1, wantStatus: 200},
+		{name: "server error", attempts: 3, statuses: []int{500, 200}, wantAttempts: 2, wantStatus: 200},
+		{name: "rate limited", attempts: 3, statuses: []int{429, 429, 200}, retryAfter: "0", wantAttempts: 3, wantStatus: 200},
+		{name: "out of attempts", attempts: 3, statuses: []int{503, 503, 503, 200}, wantAttempts: 3, wantStatus: 503},
+		{name: "client error", attempts: 3, statuses: []int{404, 200}, wantAttempts: 1, wantStatus: 404},
+		{name: "retrying disabled", attempts: 1, statuses: []int{500, 200}, wantAttempts: 1, wantStatus: 500},
+		{name: "body replayed", method: http.MethodPost, body: "hello", attempts: 3, statuses: []int{502, 200}, wantAttempts: 2, wantStatus: 200},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				mu     gosync.Mutex
+				served int
+			)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				status := test.statuses[served]
+				served++
+				mu.Unlock()
+				if body, _ := io.ReadAll(r.Body); string(body) != test.body {
+					t.Errorf("attempt %d got body %q, want %q", served, body, test.body)
+				}
+				if test.retryAfter != "" {
+					w.Header().Set("Retry-After", test.retryAfter)
+				}
+				w.WriteHeader(status)
+			}))
+			defer server.Close()
+			logger := zerolog.Nop()
+			client := &http.Client{Transport: &Transport{
+				Transport: http.DefaultTransport,
+				Attempts:  test.attempts,
+				Delay:     time.Millisecond,
+				Logger:    &logger,
+			}}
+			method := test.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			request, _ := http.NewRequest(method, server.URL, strings.NewReader(test.body))
+			response, err := client.Do(request)
+			if err != nil {
+				t.Fatalf("error making request: %s", err)
+			}
+			response.Body.Close()
+			if response.StatusCode != test.wantStatus {
+				t.Errorf("status = %d, want %d", response.StatusCode, test.wantStatus)
+			}
+			if served != test.wantAttempts {
+				t.Errorf("made %d attempts, want %d", served, test.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{value: ""},
+		{value: "120", want: 2 * time.Minute, wantOK: true},
+		{value: "0", wantOK: true},
+		{value: "-5"},
+		{value: "soon"},
+		{value: now.Add(30 * time.Second).Format(http.TimeFormat), want: 30 * time.Second, wantOK: true},
+		{value: now.Add(-time.Minute).Format(http.TimeFormat), wantOK: true},
+	}
+	for _, test := range tests {
+		got, ok := parseRetryAfter(test.value, now)
+		if got != test.want || ok != test.wantOK {
+			t.Errorf("parseRetryAfter(%q) = %s, %t, want %s, %t", test.value, got, ok, test.want, test.wantOK)
+		}
+	}
+}
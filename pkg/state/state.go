@@ -0,0 +1,129 @@
+// Package state persists information between tailscale2cloudflare runs in a local JSON file.
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+)
+
+// State is everything remembered between runs.
+type State struct {
+	// ConsecutiveFailures counts failed syncs since the last successful one.
+	ConsecutiveFailures int `json:"consecutiveFailures"`
+	// AlertOpen is set while an incident has been opened for failing syncs.
+	AlertOpen bool `json:"alertOpen"`
+	// PendingMutations failed on the last run and will be retried on the next one, keyed like Snapshots
+	// by the job they failed in.
+	PendingMutations map[string][]sync.Mutation `json:"pendingMutationsByJob,omitempty"`
+	// UnkeyedPendingMutations were queued before pending mutations were kept by job, and are retried by
+	// the jobs syncing their zone.
+	UnkeyedPendingMutations []sync.Mutation `json:"pendingMutations,omitempty"`
+	// History records every applied mutation, oldest first.
+	History []HistoryEntry `json:"history,omitempty"`
+	// Devices are the devices listed on the last run, by tailnet and then device name.
+	Devices map[string]map[string]KnownDevice `json:"devices,omitempty"`
+	// Snapshots are what each job last published, keyed by tailnet, zone, and subdomain.
+	Snapshots map[string]*sync.Snapshot `json:"snapshots,omitempty"`
+}
+
+// KnownDevice is a tailnet device as of the last time it was listed.
+type KnownDevice struct {
+	Name      string    `json:"name"`
+	Hostname  string    `json:"hostname"`
+	Addresses []string  `json:"addresses"`
+	FirstSeen time.Time `json:"firstSeen"`
+}
+
+// HistoryEntry is a mutation and when it was applied.
+type HistoryEntry struct {
+	Time time.Time `json:"time"`
+	sync.Mutation
+}
+
+// RecordHistory appends applied mutations to the history, dropping the oldest entries past limit.
+// A limit of 0 keeps everything.
+func (s *State) RecordHistory(at time.Time, applied []sync.Mutation, limit int) {
+	for _, mutation := range applied {
+		s.History = append(s.History, HistoryEntry{Time: at, Mutation: mutation})
+	}
+	if limit > 0 && len(s.History) > limit {
+		s.History = append([]HistoryEntry(nil), s.History[len(s.History)-limit:]...)
+	}
+}
+
+// TrackDevices replaces the known devices for tailnet with devices, returning the ones that weren't
+// known before and the known ones that are gone. Nothing is reported the first time a tailnet is
+// tracked.
+func (s *State) TrackDevices(tailnet string, devices []sync.Device, at time.Time) (appeared, vanished []KnownDevice) {
+	known, tracked := s.Devices[tailnet]
+	current := make(map[string]KnownDevice, len(devices))
+	for _, device := range devices {
+		knownDevice, ok := known[device.Name]
+		if !ok {
+			knownDevice.FirstSeen = at
+		}
+		knownDevice.Name = device.Name
+		knownDevice.Hostname = device.Hostname
+		knownDevice.Addresses = device.Addresses
+		current[device.Name] = knownDevice
+		if tracked && !ok {
+			appeared = append(appeared, knownDevice)
+		}
+	}
+	for name, knownDevice := range known {
+		if _, ok := current[name]; !ok {
+			vanished = append(vanished, knownDevice)
+		}
+	}
+	if s.Devices == nil {
+		s.Devices = map[string]map[string]KnownDevice{}
+	}
+	s.Devices[tailnet] = current
+	return appeared, vanished
+}
+
+// Load reads the state file at path. A missing file is treated as empty state.
+func Load(path string) (*State, error) {
+	body, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &State{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading state file: %s", err)
+	}
+	var s State
+	if err := json.Unmarshal(body, &s); err != nil {
+		return nil, fmt.Errorf("error unmarshalling state file as JSON: %s", err)
+	}
+	return &s, nil
+}
+
+// Save atomically replaces the state file at path.
+func (s *State) Save(path string) error {
+	body, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling state: %s", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tailscale2cloudflare-state-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary state file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing temporary state file: %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing temporary state file: %s", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error replacing state file: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+)
+
+func TestRecordHistory(t *testing.T) {
+	at := time.Unix(1700000000, 0).UTC()
+	mutations := func(names ...string) []sync.Mutation {
+		var mutations []sync.Mutation
+		for _, name := range names {
+			mutations = append(mutations, sync.Mutation{Action: sync.MutationCreate, Name: name})
+		}
+		return mutations
+	}
+	tests := []struct {
+		name    string
+		history []string
+		applied []string
+		limit   int
+		want    []string
+	}{
+		{name: "unlimited", history: []string{"a", "b"}, applied: []string{"c"}, want: []string{"a", "b", "c"}},
+		{name: "under limit", history: []string{"a"}, applied: []string{"b"}, limit: 3, want: []string{"a", "b"}},
+		{name: "drops oldest", history: []string{"a", "b"}, applied: []string{"c", "d"}, limit: 3, want: []string{"b", "c", "d"}},
+		{name: "more applied than limit", applied: []string{"a", "b", "c"}, limit: 2, want: []string{"b", "c"}},
+		{name: "nothing applied", history: []string{"a"}, limit: 1, want: []string{"a"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var s State
+			s.RecordHistory(at, mutations(test.history...), 0)
+			s.RecordHistory(at, mutations(test.applied...), test.limit)
+			var names []string
+			for _, entry := range s.History {
+				names = append(names, entry.Name)
+			}
+			if !reflect.DeepEqual(names, test.want) {
+				t.Errorf("history = %q, want %q", names, test.want)
+			}
+		})
+	}
+}
+
+func TestTrackDevices(t *testing.T) {
+	var (
+		first  = time.Unix(1700000000, 0).UTC()
+		second = first.Add(time.Hour)
+	)
+	devices := func(names ...string) []sync.Device {
+		var devices []sync.Device
+		for _, name := range names {
+			devices = append(devices, sync.Device{Name: name})
+		}
+		return devices
+	}
+	tests := []struct {
+		name         string
+		before       []string
+		after        []string
+		wantAppeared []string
+		wantVanished []string
+	}{
+		{name: "unchanged", before: []string{"a", "b"}, after: []string{"b", "a"}},
+		{name: "appeared", before: []string{"a"}, after: []string{"a", "b"}, wantAppeared: []string{"b"}},
+		{name: "vanished", before: []string{"a", "b"}, after: []string{"a"}, wantVanished: []string{"b"}},
+		{name: "replaced", before: []string{"a"}, after: []string{"b"}, wantAppeared: []string{"b"}, wantVanished: []string{"a"}},
+	}
+	names := func(known []KnownDevice) []string {
+		var names []string
+		for _, device := range known {
+			names = append(names, device.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var s State
+			// nothing is reported the first time
+			if appeared, vanished := s.TrackDevices("t", devices(test.before...), first); appeared != nil || vanished != nil {
+				t.Errorf("first run reported %v appearing and %v vanishing", appeared, vanished)
+			}
+			appeared, vanished := s.TrackDevices("t", devices(test.after...), second)
+			if got := names(appeared); !reflect.DeepEqual(got, test.wantAppeared) {
+				t.Errorf("appeared = %q, want %q", got, test.wantAppeared)
+			}
+			if got := names(vanished); !reflect.DeepEqual(got, test.wantVanished) {
+				t.Errorf("vanished = %q, want %q", got, test.wantVanished)
+			}
+			// devices keep when they were first seen
+			for _, device := range s.Devices["t"] {
+				want := first
+				if containsString(test.wantAppeared, device.Name) {
+					want = second
+				}
+				if !device.FirstSeen.Equal(want) {
+					t.Errorf("%s first seen %s, want %s", device.Name, device.FirstSeen, want)
+				}
+			}
+		})
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	empty, err := Load(path)
+	if err != nil {
+		t.Fatalf("error loading missing state file: %s", err)
+	}
+	if !reflect.DeepEqual(empty, &State{}) {
+		t.Errorf("missing state file loaded as %+v", empty)
+	}
+	saved := &State{
+		ConsecutiveFailures: 2,
+		AlertOpen:           true,
+		PendingMutations: map[string][]sync.Mutation{
+			"t z ts": {{Action: sync.MutationDelete, Name: "gone.ts.example.com", RecordID: "r1", Zone: "z"}},
+		},
+	}
+	saved.RecordHistory(time.Unix(1700000000, 0).UTC(), []sync.Mutation{{Action: sync.MutationCreate, Name: "laptop.ts.example.com"}}, 0)
+	if err := saved.Save(path); err != nil {
+		t.Fatalf("error saving state: %s", err)
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("error loading state: %s", err)
+	}
+	if !reflect.DeepEqual(loaded, saved) {
+		t.Errorf("loaded %+v, want %+v", loaded, saved)
+	}
+	// saving leaves no temporary files behind
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("state directory has %d files, want 1", len(entries))
+	}
+	if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Error("loaded a corrupt state file")
+	}
+}
@@ -0,0 +1,71 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const acmeChallengePrefix = "_acme-challenge."
+
+// PresentACMEChallenge creates the TXT record for an ACME DNS-01 challenge. fqdn is the full
+// challenge record name, e.g. "_acme-challenge.machine.ts.example.com." as passed by lego's exec
+// provider.
+func PresentACMEChallenge(ctx context.Context, cloudflareToken, cloudflareZone, fqdn, value string) error {
+	name, err := acmeChallengeName(fqdn)
+	if err != nil {
+		return err
+	}
+	_, err = (&Cloudflare{Token: cloudflareToken}).Apply(ctx, cloudflareZone, Mutation{
+		Action:  MutationCreate,
+		Type:    "TXT",
+		Name:    name,
+		Content: value,
+	})
+	if err != nil {
+		return fmt.Errorf("error creating ACME challenge record: %s", err)
+	}
+	loggerFrom(ctx).Info().Str("name", name).Msg("created ACME challenge record")
+	return nil
+}
+
+// CleanupACMEChallenge deletes the TXT records created by PresentACMEChallenge.
+func CleanupACMEChallenge(ctx context.Context, cloudflareToken, cloudflareZone, fqdn, value string) error {
+	name, err := acmeChallengeName(fqdn)
+	if err != nil {
+		return err
+	}
+	query := url.Values{}
+	query.Set("type", "TXT")
+	query.Set("name", name)
+	query.Set("content", value)
+	dns := &Cloudflare{Token: cloudflareToken}
+	records, err := dns.listRecords(ctx, cloudflareZone, query)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		_, err := dns.Apply(ctx, cloudflareZone, Mutation{
+			Action:   MutationDelete,
+			Type:     "TXT",
+			Name:     record.Name,
+			RecordID: record.ID,
+		})
+		if err != nil {
+			return fmt.Errorf("error deleting ACME challenge record: %s", err)
+		}
+		loggerFrom(ctx).Info().Str("name", name).Msg("deleted ACME challenge record")
+	}
+	return nil
+}
+
+// acmeChallengeName strips the trailing dot off fqdn and makes sure it's only ever an ACME challenge
+// name, since the token is presumably good for the rest of the zone too.
+func acmeChallengeName(fqdn string) (string, error) {
+	name := strings.TrimSuffix(fqdn, ".")
+	if !strings.HasPrefix(name, acmeChallengePrefix) || len(name) == len(acmeChallengePrefix) {
+		return "", fmt.Errorf("%q is not an ACME challenge record name", fqdn)
+	}
+	return name, nil
+}
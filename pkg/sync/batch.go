@@ -0,0 +1,172 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// BatchApplier is implemented by DNS providers that can apply several mutations in one request.
+type BatchApplier interface {
+	// ApplyBatch performs mutations atomically, returning the record as stored for each mutation, in
+	// order, when the response includes one.
+	ApplyBatch(ctx context.Context, zone string, mutations []Mutation) ([]*Record, error)
+}
+
+// batchRecord is a record as the batch endpoint takes it.
+type batchRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Content string `json:"content,omitempty"`
+	TTL     int    `json:"ttl,omitempty"`
+	Proxied *bool  `json:"proxied,omitempty"`
+}
+
+// ApplyBatch POSTs mutations to the zone's dns_records/batch endpoint, which applies deletes, then
+// patches, then puts, then posts, all or none of them.
+func (c *Cloudflare) ApplyBatch(ctx context.Context, zone string, mutations []Mutation) ([]*Record, error) {
+	var (
+		batch struct {
+			Deletes []batchRecord `json:"deletes,omitempty"`
+			Patches []batchRecord `json:"patches,omitempty"`
+			Puts    []batchRecord `json:"puts,omitempty"`
+			Posts   []batchRecord `json:"posts,omitempty"`
+		}
+		// index of each mutation's record within its action's results
+		indexes = make([]int, len(mutations))
+		proxied = false
+	)
+	for i, mutation := range mutations {
+		recordType := mutation.Type
+		if recordType == "" {
+			recordType = "A"
+		}
+		ttl := mutation.TTL
+		if ttl == 0 {
+			ttl = 1
+		}
+		switch mutation.Action {
+		case MutationCreate:
+			indexes[i] = len(batch.Posts)
+			batch.Posts = append(batch.Posts, batchRecord{Type: recordType, Name: mutation.Name, Content: mutation.Content, TTL: ttl, Proxied: &proxied})
+		case MutationUpdate:
+			indexes[i] = len(batch.Puts)
+			batch.Puts = append(batch.Puts, batchRecord{ID: mutation.RecordID, Type: recordType, Name: mutation.Name, Content: mutation.Content, TTL: ttl, Proxied: &proxied})
+		case MutationRetune:
+			indexes[i] = len(batch.Patches)
+			batch.Patches = append(batch.Patches, batchRecord{ID: mutation.RecordID, TTL: mutation.TTL})
+		case MutationDelete:
+			indexes[i] = len(batch.Deletes)
+			batch.Deletes = append(batch.Deletes, batchRecord{ID: mutation.RecordID})
+		default:
+			return nil, fmt.Errorf("unknown mutation action %q", mutation.Action)
+		}
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return nil, fmt.Errorf("error creating DNS batch request body: %s", err)
+	}
+	loggerFrom(ctx).Debug().Str("body", string(body)).Msg("applying batch")
+	request, _ := http.NewRequestWithContext(ctx, "POST", c.url(fmt.Sprintf("/zones/%s/dns_records/batch", zone)), bytes.NewBuffer(body))
+	response, err := c.do(request)
+	if err != nil {
+		return nil, fmt.Errorf("error performing Cloudflare batch POST: %s", err)
+	}
+	defer response.Body.Close()
+	body, err = ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading Cloudflare batch POST: %s", err)
+	}
+	loggerFrom(ctx).Debug().Str("body", string(body)).Msg("batch response")
+	if response.StatusCode > http.StatusAccepted {
+		return nil, fmt.Errorf(">202 response to Cloudflare batch POST: %d: %s", response.StatusCode, body)
+	}
+	var batchResponse struct {
+		Result struct {
+			Deletes []*Record
+			Patches []*Record
+			Puts    []*Record
+			Posts   []*Record
+		}
+	}
+	if err := json.Unmarshal(body, &batchResponse); err != nil {
+		return nil, fmt.Errorf("error unmarshalling Cloudflare batch POST as JSON: %s", err)
+	}
+	results := map[MutationAction][]*Record{
+		MutationCreate: batchResponse.Result.Posts,
+		MutationUpdate: batchResponse.Result.Puts,
+		MutationRetune: batchResponse.Result.Patches,
+		MutationDelete: batchResponse.Result.Deletes,
+	}
+	records := make([]*Record, len(mutations))
+	for i, mutation := range mutations {
+		if actionRecords := results[mutation.Action]; indexes[i] < len(actionRecords) {
+			records[i] = actionRecords[indexes[i]]
+		}
+	}
+	return records, nil
+}
+
+// applyBatches applies each phase's groups in batches of up to size mutations, keeping each group
+// within one batch. A batch that fails is applied again one mutation at a time, which tolerates
+// mutations that had already taken effect. It returns the first error, if any mutations failed.
+func (r *Result) applyBatches(ctx context.Context, batcher BatchApplier, cloudflareZone string, size int, phases ...[]mutationGroup) error {
+	var (
+		groups   []mutationGroup
+		firstErr error
+	)
+	for _, phase := range phases {
+		groups = append(groups, phase...)
+	}
+	for len(groups) > 0 {
+		n, count := 0, 0
+		for n < len(groups) && (n == 0 || count+groups[n].len() <= size) {
+			count += groups[n].len()
+			n++
+		}
+		if err := r.applyBatch(ctx, batcher, cloudflareZone, groups[:n]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		groups = groups[n:]
+	}
+	return firstErr
+}
+
+func (r *Result) applyBatch(ctx context.Context, batcher BatchApplier, cloudflareZone string, groups []mutationGroup) error {
+	var mutations []Mutation
+	for _, group := range groups {
+		mutations = append(mutations, group.mutations...)
+		if group.ownership != nil {
+			mutations = append(mutations, *group.ownership)
+		}
+	}
+	for i := range mutations {
+		mutations[i].Zone = cloudflareZone
+	}
+	records, err := batcher.ApplyBatch(ctx, cloudflareZone, mutations)
+	if err != nil {
+		loggerFrom(ctx).Warn().Err(err).Int("mutations", len(mutations)).Msg("error applying batch, applying its mutations one at a time")
+		dns, ok := batcher.(DNSProvider)
+		if !ok {
+			for _, mutation := range mutations {
+				r.track(ctx, mutation, nil, err)
+			}
+			return fmt.Errorf("error applying batch: %s", err)
+		}
+		var firstErr error
+		for _, group := range groups {
+			if err := r.applyGroup(ctx, dns, cloudflareZone, group); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+	for i, mutation := range mutations {
+		r.track(ctx, mutation, records[i], nil)
+	}
+	return nil
+}
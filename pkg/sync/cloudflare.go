@@ -0,0 +1,241 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Cloudflare is the DNSProvider for Cloudflare zones, which are identified by zone ID.
+type Cloudflare struct {
+	Token string
+	// BaseURL replaces https://api.cloudflare.com/client/v4, e.g. to go through an egress proxy or to
+	// a mock server.
+	BaseURL string
+	// HTTPClient makes the API requests. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// url returns the API URL for path, e.g. "/zones/:zone/dns_records".
+func (c *Cloudflare) url(path string) string {
+	return apiURL(c.BaseURL, defaultCloudflareBaseURL, path)
+}
+
+// do makes an API request with the token.
+func (c *Cloudflare) do(request *http.Request) (*http.Response, error) {
+	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.Token))
+	request.Header.Set("Content-Type", "application/json")
+	return clientOrDefault(c.HTTPClient).Do(request)
+}
+
+// ListRecords lists the zone's unproxied records of recordType.
+func (c *Cloudflare) ListRecords(ctx context.Context, zone, recordType string) ([]Record, error) {
+	query := url.Values{}
+	query.Set("proxied", "false")
+	query.Set("type", recordType)
+	return c.listRecords(ctx, zone, query)
+}
+
+// Apply performs a mutation, returning the record as Cloudflare stored it when the response includes
+// one.
+func (c *Cloudflare) Apply(ctx context.Context, zone string, mutation Mutation) (*Record, error) {
+	return c.applyMutation(ctx, zone, mutation)
+}
+
+// ZoneName GETs the zone's name, e.g. example.com.
+func (c *Cloudflare) ZoneName(ctx context.Context, zone string) (string, error) {
+	request, _ := http.NewRequestWithContext(ctx, "GET", c.url(fmt.Sprintf("/zones/%s", zone)), nil)
+	response, err := c.do(request)
+	if err != nil {
+		return "", fmt.Errorf("error performing Cloudflare zone GET: %s", err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading Cloudflare zone GET body: %s", err)
+	}
+	if response.StatusCode > http.StatusOK {
+		return "", fmt.Errorf("non-200 response to Cloudflare zone GET: %d: %s", response.StatusCode, body)
+	}
+	var zoneResponse struct {
+		Result struct {
+			Name string
+		}
+	}
+	if err := json.Unmarshal(body, &zoneResponse); err != nil {
+		return "", fmt.Errorf("error unmarshalling Cloudflare zone GET as JSON: %s", err)
+	}
+	if zoneResponse.Result.Name == "" {
+		return "", fmt.Errorf("Cloudflare zone GET response has no zone name: %s", body)
+	}
+	return zoneResponse.Result.Name, nil
+}
+
+// VerifyAccess checks that the token is active and can read the zone's DNS records, so a sync with
+// the wrong token fails before planning anything rather than partway through applying it. Reading
+// records takes the same DNS:Edit permission syncs need, since Cloudflare tokens can't be granted
+// DNS:Edit without DNS:Read, but can't prove the token isn't read-only. Missing Zone:Read is only
+// logged, as syncs get by without it unless the zone is empty.
+func (c *Cloudflare) VerifyAccess(ctx context.Context, zone string) error {
+	var verifyResponse struct {
+		Result struct {
+			Status string
+		}
+	}
+	verifyStatus, verifyBody, err := c.get(ctx, "/user/tokens/verify", &verifyResponse)
+	if err != nil {
+		return err
+	}
+	var zoneResponse struct {
+		Result struct {
+			Account struct {
+				ID string
+			}
+		}
+	}
+	zoneStatus, zoneBody, err := c.get(ctx, fmt.Sprintf("/zones/%s", zone), &zoneResponse)
+	if err != nil {
+		return err
+	}
+	// account-owned tokens are verified under their account, which the zone says
+	if verifyStatus != http.StatusOK && zoneStatus == http.StatusOK && zoneResponse.Result.Account.ID != "" {
+		verifyStatus, verifyBody, err = c.get(ctx, fmt.Sprintf("/accounts/%s/tokens/verify", zoneResponse.Result.Account.ID), &verifyResponse)
+		if err != nil {
+			return err
+		}
+	}
+	if verifyStatus != http.StatusOK {
+		return fmt.Errorf("Cloudflare token didn't verify, make sure it's an API token and not an API key: %d: %s", verifyStatus, verifyBody)
+	}
+	if verifyResponse.Result.Status != "active" {
+		return fmt.Errorf("Cloudflare token is %s, not active", verifyResponse.Result.Status)
+	}
+	if zoneStatus != http.StatusOK {
+		loggerFrom(ctx).Warn().Int("status", zoneStatus).Str("body", string(zoneBody)).
+			Msg("Cloudflare token can't read the zone, grant it Zone:Read for the zone or syncs fail while it has no records")
+	}
+	recordsStatus, recordsBody, err := c.get(ctx, fmt.Sprintf("/zones/%s/dns_records?per_page=5", zone), nil)
+	if err != nil {
+		return err
+	}
+	if recordsStatus != http.StatusOK {
+		return fmt.Errorf("Cloudflare token can't access zone %s's DNS records, grant it DNS:Edit for the zone: %d: %s", zone, recordsStatus, recordsBody)
+	}
+	return nil
+}
+
+// get GETs path under the API, unmarshalling 200 responses into into if set. Only failing to make the
+// request is an error, so callers can tell which status they got.
+func (c *Cloudflare) get(ctx context.Context, path string, into interface{}) (int, []byte, error) {
+	request, _ := http.NewRequestWithContext(ctx, "GET", c.url(path), nil)
+	response, err := c.do(request)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error performing Cloudflare %s GET: %s", path, err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error reading Cloudflare %s GET body: %s", path, err)
+	}
+	if response.StatusCode == http.StatusOK && into != nil {
+		if err := json.Unmarshal(body, into); err != nil {
+			return 0, nil, fmt.Errorf("error unmarshalling Cloudflare %s GET as JSON: %s", path, err)
+		}
+	}
+	return response.StatusCode, body, nil
+}
+
+// ZoneID looks up the ID of the zone named name, e.g. example.com, among the zones the token can
+// access. It's an error for zones in several accounts to have the name, since either could be meant.
+func (c *Cloudflare) ZoneID(ctx context.Context, name string) (string, error) {
+	query := url.Values{}
+	query.Set("name", name)
+	request, _ := http.NewRequestWithContext(ctx, "GET", c.url("/zones?"+query.Encode()), nil)
+	response, err := c.do(request)
+	if err != nil {
+		return "", fmt.Errorf("error performing Cloudflare zones GET: %s", err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading Cloudflare zones GET body: %s", err)
+	}
+	if response.StatusCode > http.StatusOK {
+		return "", fmt.Errorf("non-200 response to Cloudflare zones GET: %d: %s", response.StatusCode, body)
+	}
+	var zonesResponse struct {
+		Result []struct {
+			ID      string
+			Name    string
+			Account struct {
+				ID   string
+				Name string
+			}
+		}
+	}
+	if err := json.Unmarshal(body, &zonesResponse); err != nil {
+		return "", fmt.Errorf("error unmarshalling Cloudflare zones GET as JSON: %s", err)
+	}
+	switch len(zonesResponse.Result) {
+	case 0:
+		return "", fmt.Errorf("no Cloudflare zone named %s is accessible with this token", name)
+	case 1:
+		return zonesResponse.Result[0].ID, nil
+	}
+	var candidates []string
+	for _, zone := range zonesResponse.Result {
+		candidates = append(candidates, fmt.Sprintf("%s (account %s %q)", zone.ID, zone.Account.ID, zone.Account.Name))
+	}
+	return "", fmt.Errorf("%d Cloudflare zones are named %s, pass one's ID instead: %s", len(candidates), name, strings.Join(candidates, ", "))
+}
+
+// listRecords GETs all of the zone's DNS records matching query, following pagination.
+func (c *Cloudflare) listRecords(ctx context.Context, cloudflareZone string, query url.Values) ([]Record, error) {
+	var records []Record
+	for page := 1; ; page++ {
+		query.Set("page", strconv.Itoa(page))
+		recordsResponse, err := c.listRecordsPage(ctx, cloudflareZone, query)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, recordsResponse.Result...)
+		if page >= recordsResponse.ResultInfo.TotalPages || len(recordsResponse.Result) == 0 {
+			break
+		}
+	}
+	loggerFrom(ctx).Debug().Interface("records", records).Msg("GET records")
+	return records, nil
+}
+
+// listRecordsPage GETs a page of the zone's DNS records.
+func (c *Cloudflare) listRecordsPage(ctx context.Context, cloudflareZone string, query url.Values) (*dnsRecordsResponse, error) {
+	query.Set("per_page", "100")
+	cfRecordsURL := c.url(fmt.Sprintf(
+		"/zones/%s/dns_records?%s",
+		cloudflareZone, query.Encode(),
+	))
+	request, _ := http.NewRequestWithContext(ctx, "GET", cfRecordsURL, nil)
+	response, err := c.do(request)
+	if err != nil {
+		return nil, fmt.Errorf("error performing Cloudflare records GET: %s", err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading Cloudflare records GET body: %s", err)
+	}
+	if response.StatusCode > http.StatusOK {
+		return nil, fmt.Errorf("non-200 response to Cloudflare records GET: %d: %s", response.StatusCode, body)
+	}
+	loggerFrom(ctx).Debug().Interface("body", json.RawMessage(body)).Str("page", query.Get("page")).Msg("GET records")
+	var recordsResponse dnsRecordsResponse
+	if err := json.Unmarshal(body, &recordsResponse); err != nil {
+		return nil, fmt.Errorf("error unmarshalling Cloudflare records GET as JSON: %s", err)
+	}
+	return &recordsResponse, nil
+}
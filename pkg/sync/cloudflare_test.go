@@ -0,0 +1,146 @@
+package sync
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestCloudflareListRecords(t *testing.T) {
+	var records []Record
+	for i := 1; i <= 5; i++ {
+		records = append(records, aRecord(fmt.Sprintf("r%d", i), fmt.Sprintf("device%d.ts.example.com", i), fmt.Sprintf("100.64.0.%d", i), 1))
+	}
+	records = append(records, Record{ID: "t1", Type: "TXT", Name: "device1.ts.example.com", Content: "hello", TTL: 1})
+	tests := []struct {
+		name      string
+		perPage   int
+		wantPages int
+	}{
+		{name: "one page", wantPages: 1},
+		{name: "exact pages", perPage: 5, wantPages: 1},
+		{name: "partial last page", perPage: 2, wantPages: 3},
+		{name: "page per record", perPage: 1, wantPages: 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cloudflare := &fakeCloudflare{zone: "z", zoneName: "example.com", records: records, perPage: test.perPage}
+			listed, err := serveFakeAPIs(t, nil, cloudflare).cloudflare().ListRecords(quietContext(), "z", "A")
+			if err != nil {
+				t.Fatalf("error listing records: %s", err)
+			}
+			if !reflect.DeepEqual(listed, records[:5]) {
+				t.Errorf("listed %v, want %v", listed, records[:5])
+			}
+			if len(cloudflare.requests) != test.wantPages {
+				t.Errorf("made %d requests, want %d: %q", len(cloudflare.requests), test.wantPages, cloudflare.requests)
+			}
+		})
+	}
+}
+
+func TestCloudflareApply(t *testing.T) {
+	tests := []struct {
+		name        string
+		mutation    Mutation
+		failures    map[string]int
+		wantRequest string
+		wantErr     bool
+		wantRecords []string
+	}{
+		{
+			name:        "create",
+			mutation:    Mutation{Action: MutationCreate, Name: "server.ts.example.com", Content: "100.64.0.2"},
+			wantRequest: "POST /zones/z/dns_records",
+			wantRecords: []string{"A laptop.ts.example.com 100.64.0.1 1", "A server.ts.example.com 100.64.0.2 1"},
+		},
+		{
+			name:        "create with TTL",
+			mutation:    Mutation{Action: MutationCreate, Name: "server.ts.example.com", Content: "100.64.0.2", TTL: 120},
+			wantRequest: "POST /zones/z/dns_records",
+			wantRecords: []string{"A laptop.ts.example.com 100.64.0.1 1", "A server.ts.example.com 100.64.0.2 120"},
+		},
+		{
+			name:        "create AAAA",
+			mutation:    Mutation{Action: MutationCreate, Type: "AAAA", Name: "laptop.ts.example.com", Content: "fd7a:115c:a1e0::1"},
+			wantRequest: "POST /zones/z/dns_records",
+			wantRecords: []string{"A laptop.ts.example.com 100.64.0.1 1", "AAAA laptop.ts.example.com fd7a:115c:a1e0::1 1"},
+		},
+		{
+			name:        "create existing record",
+			mutation:    Mutation{Action: MutationCreate, Name: "laptop.ts.example.com", Content: "100.64.0.1"},
+			wantRequest: "POST /zones/z/dns_records",
+			wantRecords: []string{"A laptop.ts.example.com 100.64.0.1 1"},
+		},
+		{
+			name:        "update",
+			mutation:    Mutation{Action: MutationUpdate, Name: "laptop.ts.example.com", Content: "100.64.0.9", RecordID: "r1"},
+			wantRequest: "PUT /zones/z/dns_records/r1",
+			wantRecords: []string{"A laptop.ts.example.com 100.64.0.9 1"},
+		},
+		{
+			name:        "update identical record",
+			mutation:    Mutation{Action: MutationUpdate, Name: "laptop.ts.example.com", Content: "100.64.0.1", RecordID: "r1"},
+			failures:    map[string]int{"r1": cfCodeIdenticalRecord},
+			wantRequest: "PUT /zones/z/dns_records/r1",
+			wantRecords: []string{"A laptop.ts.example.com 100.64.0.1 1"},
+		},
+		{
+			name:        "update missing record",
+			mutation:    Mutation{Action: MutationUpdate, Name: "gone.ts.example.com", Content: "100.64.0.9", RecordID: "r9"},
+			wantRequest: "PUT /zones/z/dns_records/r9",
+			wantErr:     true,
+			wantRecords: []string{"A laptop.ts.example.com 100.64.0.1 1"},
+		},
+		{
+			name:        "retune",
+			mutation:    Mutation{Action: MutationRetune, Name: "laptop.ts.example.com", Content: "100.64.0.1", RecordID: "r1", TTL: 300},
+			wantRequest: "PATCH /zones/z/dns_records/r1",
+			wantRecords: []string{"A laptop.ts.example.com 100.64.0.1 300"},
+		},
+		{
+			name:        "retune failure",
+			mutation:    Mutation{Action: MutationRetune, Name: "laptop.ts.example.com", Content: "100.64.0.1", RecordID: "r1", TTL: 300},
+			failures:    map[string]int{"r1": cfCodeIdenticalRecord},
+			wantRequest: "PATCH /zones/z/dns_records/r1",
+			wantErr:     true,
+			wantRecords: []string{"A laptop.ts.example.com 100.64.0.1 1"},
+		},
+		{
+			name:        "delete",
+			mutation:    Mutation{Action: MutationDelete, Name: "laptop.ts.example.com", Content: "100.64.0.1", RecordID: "r1"},
+			wantRequest: "DELETE /zones/z/dns_records/r1",
+		},
+		{
+			name:        "delete missing record",
+			mutation:    Mutation{Action: MutationDelete, Name: "gone.ts.example.com", Content: "100.64.0.9", RecordID: "r9"},
+			wantRequest: "DELETE /zones/z/dns_records/r9",
+			wantRecords: []string{"A laptop.ts.example.com 100.64.0.1 1"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cloudflare := &fakeCloudflare{
+				zone:     "z",
+				zoneName: "example.com",
+				records:  []Record{aRecord("r1", "laptop.ts.example.com", "100.64.0.1", 1)},
+				failures: test.failures,
+			}
+			record, err := serveFakeAPIs(t, nil, cloudflare).cloudflare().Apply(quietContext(), "z", test.mutation)
+			if test.wantErr != (err != nil) {
+				t.Errorf("error = %v, want error: %t", err, test.wantErr)
+			}
+			if err == nil {
+				if err := verifyMutation(test.mutation, record); err != nil {
+					t.Errorf("applied mutation doesn't match: %s", err)
+				}
+			}
+			if want := []string{test.wantRequest}; !reflect.DeepEqual(cloudflare.requests, want) {
+				t.Errorf("requests = %q, want %q", cloudflare.requests, want)
+			}
+			if records := cloudflare.dump(); !reflect.DeepEqual(records, test.wantRecords) {
+				t.Errorf("records = %q, want %q", records, test.wantRecords)
+			}
+		})
+	}
+}
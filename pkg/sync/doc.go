@@ -0,0 +1,60 @@
+/*
+Package sync reconciles the devices in a Tailscale tailnet with DNS records in a Cloudflare zone.
+
+The package name shadows the standard library's, so programs embedding the syncer usually import
+it as
+
+	import t2c "github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+
+and call Tailscale2Cloudflare, which lists the tailnet's devices, plans the record creations and
+deletions needed for the zone to match, and applies them unless DryRun is set:
+
+	result, err := t2c.Tailscale2Cloudflare(ctx, key, tailnet, token, zoneID, "ts", &t2c.Tailscale2CloudflareOptions{
+		DryRun: true,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println(result.Summary())
+
+API requests are made with ctx, so a deadline on it bounds how long a sync can hang on an
+unresponsive API.
+
+Syncs log through zerolog's global logger unless given their own, which also receives the logs of
+the API clients they use:
+
+	logger := zerolog.New(os.Stderr).Level(zerolog.WarnLevel)
+	opts := &t2c.Tailscale2CloudflareOptions{Logger: &logger}
+
+API requests go to the public Tailscale and Cloudflare APIs through http.DefaultClient. Point them
+at an egress proxy or a mock server in integration tests with TailscaleBaseURL, CloudflareBaseURL,
+and HTTPClient:
+
+	opts := &t2c.Tailscale2CloudflareOptions{
+		TailscaleBaseURL:  mock.URL + "/tailscale",
+		CloudflareBaseURL: mock.URL + "/cloudflare",
+		HTTPClient:        mock.Client(),
+	}
+
+SyncAll does the same for several zones or subdomains at once, publishing the devices matching
+each Target's DeviceFilter.
+
+Both are shorthands for a Syncer using TailscaleAPI and Cloudflare. A Syncer accepts any
+TailscaleClient and DNSProvider, e.g. fakes for testing code built on the syncer, or another DNS
+host:
+
+	syncer := &t2c.Syncer{
+		Tailscale: &t2c.TailscaleAPI{Key: key},
+		DNS:       myProvider,
+	}
+	result, err := syncer.Sync(ctx, tailnet, zone, "ts")
+
+A Syncer's clients ignore the options' base URLs and HTTP client, and take their own instead, as do
+TailscaleOAuthClient and Route53:
+
+	tailscale := &t2c.TailscaleAPI{Key: key, BaseURL: mock.URL + "/tailscale", HTTPClient: mock.Client()}
+
+The packages under pkg/ follow semantic versioning with the module's release tags: exported
+identifiers are only removed or changed incompatibly in a new major version.
+*/
+package sync
@@ -0,0 +1,28 @@
+package sync
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	defaultTailscaleBaseURL  = "https://api.tailscale.com"
+	defaultCloudflareBaseURL = "https://api.cloudflare.com/client/v4"
+)
+
+// apiURL returns the URL for path under base, e.g. a client's BaseURL, or under fallback if base is
+// blank.
+func apiURL(base, fallback, path string) string {
+	if base == "" {
+		base = fallback
+	}
+	return strings.TrimSuffix(base, "/") + path
+}
+
+// clientOrDefault returns client, or http.DefaultClient if it's nil.
+func clientOrDefault(client *http.Client) *http.Client {
+	if client == nil {
+		return http.DefaultClient
+	}
+	return client
+}
@@ -0,0 +1,262 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// fakeCloudflare serves the parts of the Cloudflare API syncs use for a single zone, keeping its
+// records in memory.
+type fakeCloudflare struct {
+	mu       gosync.Mutex
+	zone     string
+	zoneName string
+	records  []Record
+	// perPage caps the records listed per page, to exercise pagination with few records
+	perPage int
+	nextID  int
+	// requests is "METHOD /path" for each request served
+	requests []string
+	// failures makes mutations to a record ID fail with a Cloudflare error code
+	failures map[string]int
+}
+
+func (f *fakeCloudflare) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	var (
+		zonePath    = "/zones/" + f.zone
+		recordsPath = zonePath + "/dns_records"
+	)
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == zonePath:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"result": map[string]string{"name": f.zoneName}})
+	case r.Method == http.MethodGet && r.URL.Path == recordsPath:
+		f.list(w, r)
+	case r.Method == http.MethodPost && r.URL.Path == recordsPath:
+		f.create(w, r)
+	case strings.HasPrefix(r.URL.Path, recordsPath+"/"):
+		f.change(w, r, strings.TrimPrefix(r.URL.Path, recordsPath+"/"))
+	default:
+		writeCloudflareError(w, http.StatusNotFound, 7003, "no route for that URI")
+	}
+}
+
+func (f *fakeCloudflare) list(w http.ResponseWriter, r *http.Request) {
+	var matching []Record
+	for _, record := range f.records {
+		if recordType := r.URL.Query().Get("type"); recordType == "" || record.Type == recordType {
+			matching = append(matching, record)
+		}
+	}
+	perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+	if f.perPage > 0 && (perPage == 0 || f.perPage < perPage) {
+		perPage = f.perPage
+	}
+	if perPage == 0 {
+		perPage = 100
+	}
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page == 0 {
+		page = 1
+	}
+	totalPages := (len(matching) + perPage - 1) / perPage
+	start := min((page-1)*perPage, len(matching))
+	end := min(start+perPage, len(matching))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":     true,
+		"result":      matching[start:end],
+		"result_info": map[string]int{"page": page, "total_pages": totalPages},
+	})
+}
+
+type fakeRecordBody struct {
+	Type    string
+	Name    string
+	Content string
+	TTL     *int
+}
+
+func (f *fakeCloudflare) create(w http.ResponseWriter, r *http.Request) {
+	var body fakeRecordBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeCloudflareError(w, http.StatusBadRequest, 9207, err.Error())
+		return
+	}
+	for _, record := range f.records {
+		if record.Type == body.Type && record.Name == body.Name && record.Content == body.Content {
+			writeCloudflareError(w, http.StatusBadRequest, cfCodeRecordExists, "An identical record already exists.")
+			return
+		}
+	}
+	f.nextID++
+	record := Record{
+		ID:       fmt.Sprintf("new%d", f.nextID),
+		Type:     body.Type,
+		Name:     body.Name,
+		Content:  body.Content,
+		TTL:      1,
+		ZoneName: f.zoneName,
+	}
+	if body.TTL != nil {
+		record.TTL = *body.TTL
+	}
+	f.records = append(f.records, record)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "result": record})
+}
+
+func (f *fakeCloudflare) change(w http.ResponseWriter, r *http.Request, id string) {
+	if code, ok := f.failures[id]; ok {
+		writeCloudflareError(w, http.StatusBadRequest, code, "failing as told")
+		return
+	}
+	i := 0
+	for i < len(f.records) && f.records[i].ID != id {
+		i++
+	}
+	if i == len(f.records) {
+		writeCloudflareError(w, http.StatusNotFound, cfCodeRecordNotFound, "Record does not exist.")
+		return
+	}
+	if r.Method == http.MethodDelete {
+		f.records = append(f.records[:i], f.records[i+1:]...)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "result": map[string]string{"id": id}})
+		return
+	}
+	var body fakeRecordBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeCloudflareError(w, http.StatusBadRequest, 9207, err.Error())
+		return
+	}
+	record := &f.records[i]
+	switch r.Method {
+	case http.MethodPut:
+		record.Type, record.Name, record.Content = body.Type, body.Name, body.Content
+	case http.MethodPatch:
+	default:
+		writeCloudflareError(w, http.StatusMethodNotAllowed, 10000, "method not allowed")
+		return
+	}
+	if body.TTL != nil {
+		record.TTL = *body.TTL
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "result": record})
+}
+
+// dump lists the fake's records as "TYPE name content ttl", sorted.
+func (f *fakeCloudflare) dump() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var records []string
+	for _, record := range f.records {
+		records = append(records, fmt.Sprintf("%s %s %s %d", record.Type, record.Name, record.Content, record.TTL))
+	}
+	sort.Strings(records)
+	return records
+}
+
+// fakeTailscale serves a tailnet's devices like the Tailscale API, perPage at a time if set. Pages
+// link to the next one with a Link header if link is set, or a nextCursor field otherwise.
+type fakeTailscale struct {
+	tailnet string
+	devices []Device
+	perPage int
+	link    bool
+	// pages counts the pages served
+	pages int
+}
+
+func (f *fakeTailscale) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != fmt.Sprintf("/api/v2/tailnet/%s/devices", f.tailnet) {
+		http.NotFound(w, r)
+		return
+	}
+	f.pages++
+	var (
+		start, _ = strconv.Atoi(r.URL.Query().Get("cursor"))
+		end      = len(f.devices)
+		response = map[string]interface{}{}
+	)
+	if f.perPage > 0 && start+f.perPage < end {
+		end = start + f.perPage
+		if f.link {
+			next := *r.URL
+			query := next.Query()
+			query.Set("cursor", strconv.Itoa(end))
+			next.RawQuery = query.Encode()
+			w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.RequestURI()))
+		} else {
+			response["nextCursor"] = strconv.Itoa(end)
+		}
+	}
+	response["devices"] = f.devices[start:end]
+	writeJSON(w, http.StatusOK, response)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeCloudflareError(w http.ResponseWriter, status, code int, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"success": false,
+		"errors":  []map[string]interface{}{{"code": code, "message": message}},
+	})
+}
+
+// fakeAPIs serves the Tailscale and Cloudflare APIs at their usual paths.
+type fakeAPIs struct {
+	*httptest.Server
+}
+
+// serveFakeAPIs starts a server for tailscale and cloudflare, either of which may be nil.
+func serveFakeAPIs(t *testing.T, tailscale *fakeTailscale, cloudflare *fakeCloudflare) fakeAPIs {
+	t.Helper()
+	mux := http.NewServeMux()
+	if tailscale != nil {
+		mux.Handle("/api/v2/", tailscale)
+	}
+	if cloudflare != nil {
+		mux.Handle("/client/v4/", http.StripPrefix("/client/v4", cloudflare))
+	}
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return fakeAPIs{server}
+}
+
+// options points opts at the fakes, quieting its logs.
+func (f fakeAPIs) options(opts Tailscale2CloudflareOptions) *Tailscale2CloudflareOptions {
+	logger := zerolog.Nop()
+	opts.TailscaleBaseURL = f.URL
+	opts.CloudflareBaseURL = f.URL + "/client/v4"
+	opts.HTTPClient = f.Client()
+	opts.Logger = &logger
+	return &opts
+}
+
+func (f fakeAPIs) cloudflare() *Cloudflare {
+	return &Cloudflare{Token: "token", BaseURL: f.URL + "/client/v4", HTTPClient: f.Client()}
+}
+
+func (f fakeAPIs) tailscale() *TailscaleAPI {
+	return &TailscaleAPI{Key: "key", BaseURL: f.URL, HTTPClient: f.Client()}
+}
+
+// quietContext is a context whose logs are discarded.
+func quietContext() context.Context {
+	logger := zerolog.Nop()
+	return withLogger(context.Background(), &logger)
+}
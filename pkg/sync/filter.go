@@ -0,0 +1,126 @@
+package sync
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// DeviceFilter selects devices to publish. The zero value matches every device.
+type DeviceFilter struct {
+	// Tags only matches devices with at least one of these Tailscale tags, e.g. "tag:server" or just
+	// "server". Empty matches any device.
+	Tags []string
+	// ExcludeTags never matches devices with any of these tags.
+	ExcludeTags []string
+	// Names only matches devices whose record label matches one of these path.Match patterns, e.g.
+	// "k3s-*". Empty matches any device.
+	Names []string
+	// OS only matches devices running one of these operating systems, e.g. "linux", ignoring case.
+	// Empty matches any device.
+	OS []string
+	// ExcludeOS never matches devices running any of these operating systems, e.g. "iOS".
+	ExcludeOS []string
+}
+
+// Match reports whether device, published as label, passes the filter.
+func (f DeviceFilter) Match(device Device, label string) bool {
+	if len(f.Tags) > 0 && !hasAnyTag(device, f.Tags) {
+		return false
+	}
+	if hasAnyTag(device, f.ExcludeTags) {
+		return false
+	}
+	if len(f.OS) > 0 && !runsAnyOS(device, f.OS) {
+		return false
+	}
+	if runsAnyOS(device, f.ExcludeOS) {
+		return false
+	}
+	if len(f.Names) == 0 {
+		return true
+	}
+	for _, pattern := range f.Names {
+		if matched, _ := path.Match(pattern, label); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnyTag(device Device, tags []string) bool {
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, "tag:") {
+			tag = "tag:" + tag
+		}
+		for _, deviceTag := range device.Tags {
+			if deviceTag == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func runsAnyOS(device Device, systems []string) bool {
+	for _, system := range systems {
+		if strings.EqualFold(device.OS, system) {
+			return true
+		}
+	}
+	return false
+}
+
+// DeviceOverride changes how a single device is published.
+type DeviceOverride struct {
+	// Rename publishes the device under this record label instead of its own.
+	Rename string
+	// Exclude never publishes the device, deleting its records.
+	Exclude bool
+	// TTL overrides RecordTTL for the device's records.
+	TTL int
+}
+
+// recordPatterns matches record names against path.Match patterns, or regular expressions written
+// between slashes, e.g. "/^printer-[0-9]+$/".
+type recordPatterns struct {
+	globs   []string
+	regexps []*regexp.Regexp
+}
+
+func compileRecordPatterns(patterns []string) (*recordPatterns, error) {
+	compiled := &recordPatterns{}
+	for _, pattern := range patterns {
+		if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+			re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+			if err != nil {
+				return nil, fmt.Errorf("error compiling record pattern %q: %s", pattern, err)
+			}
+			compiled.regexps = append(compiled.regexps, re)
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("error compiling record pattern %q: %s", pattern, err)
+		}
+		compiled.globs = append(compiled.globs, pattern)
+	}
+	return compiled, nil
+}
+
+// match reports whether any pattern matches the record's full name or its label under the subdomain.
+func (p *recordPatterns) match(recordName, label string) bool {
+	for _, name := range []string{recordName, label} {
+		for _, glob := range p.globs {
+			if matched, _ := path.Match(glob, name); matched {
+				return true
+			}
+		}
+		for _, re := range p.regexps {
+			if re.MatchString(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,27 @@
+package sync
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+type loggerKey struct{}
+
+// withLogger makes logger the one loggerFrom returns for ctx. A nil logger leaves ctx alone.
+func withLogger(ctx context.Context, logger *zerolog.Logger) context.Context {
+	if logger == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerFrom returns the logger a sync was started with, or zerolog's global logger if it wasn't
+// given one.
+func loggerFrom(ctx context.Context) *zerolog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*zerolog.Logger); ok {
+		return logger
+	}
+	return &log.Logger
+}
@@ -0,0 +1,207 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// LegacyRecord is a record named after a device's OS hostname, as synced before machine names were
+// used, along with the machine-name record replacing it.
+type LegacyRecord struct {
+	Name            string
+	Content         string
+	RecordID        string
+	MachineName     string
+	MachineNameIsUp bool // whether the machine-name record already existed with the same IP
+}
+
+// MigrateOptions tweaks MigrateHostnameRecords.
+type MigrateOptions struct {
+	DryRun bool
+	// RemoveLegacy deletes hostname records once their machine-name records exist. Otherwise they're
+	// only reported.
+	RemoveLegacy bool
+	// Ownership marks the machine-name records it creates as its own with ownership TXT records, and
+	// only deletes hostname records marked as its own, like Tailscale2CloudflareOptions.Ownership.
+	Ownership bool
+	OwnerID   string
+	// Logger receives the migration's logs. Defaults to zerolog's global logger.
+	Logger *zerolog.Logger
+}
+
+// MigrateHostnameRecords moves records created with UseHostnames over to machine names. A record
+// named after a device's hostname is only considered legacy if it points at that same device's IPv4
+// address and no device's machine name is the same as the hostname, so records that are still in use
+// are never touched. The machine-name records are created before any legacy record is deleted.
+func MigrateHostnameRecords(ctx context.Context, tailscaleKey, tailscaleTailnet, cloudflareToken, cloudflareZone, cloudflareSubdomain string, opts *MigrateOptions) ([]LegacyRecord, *Result, error) {
+	syncer := &Syncer{
+		Tailscale: &TailscaleAPI{Key: tailscaleKey},
+		DNS:       &Cloudflare{Token: cloudflareToken},
+	}
+	return syncer.Migrate(ctx, tailscaleTailnet, cloudflareZone, cloudflareSubdomain, opts)
+}
+
+// Migrate is MigrateHostnameRecords with the Syncer's clients. The Syncer's Options don't apply.
+func (s *Syncer) Migrate(ctx context.Context, tailnet, zone, subdomain string, opts *MigrateOptions) ([]LegacyRecord, *Result, error) {
+	if opts == nil {
+		opts = &MigrateOptions{}
+	}
+	ctx = withLogger(ctx, opts.Logger)
+	devices, err := s.Tailscale.ListDevices(ctx, tailnet)
+	if err != nil {
+		return nil, nil, err
+	}
+	// DNS providers hand back names in lowercase, and machine names are published normalized
+	var (
+		hostnameDevices = map[string][]Device{}
+		machineNames    = map[string]bool{}
+	)
+	for _, device := range devices {
+		if !device.Authorized {
+			continue
+		}
+		machineName := device.RecordLabel(tailnet, false)
+		if isHelloDevice(machineName) {
+			continue
+		}
+		machineNames[NormalizeName(machineName)] = true
+		hostname := strings.ToLower(device.RecordLabel(tailnet, true))
+		hostnameDevices[hostname] = append(hostnameDevices[hostname], device)
+		// older versions published hostnames as is, newer ones normalized
+		if normalized := NormalizeName(hostname); normalized != hostname {
+			hostnameDevices[normalized] = append(hostnameDevices[normalized], device)
+		}
+	}
+	records, err := s.DNS.ListRecords(ctx, zone, "A")
+	if err != nil {
+		return nil, nil, err
+	}
+	recordSuffix, err := zoneNameOf(ctx, s.DNS, zone, records)
+	if err != nil {
+		return nil, nil, err
+	}
+	if subdomain != "" {
+		recordSuffix = fmt.Sprintf("%s.%s", subdomain, recordSuffix)
+	}
+	recordsByName := map[string][]Record{}
+	for _, record := range records {
+		name := strings.ToLower(record.Name)
+		recordsByName[name] = append(recordsByName[name], record)
+	}
+	var owners map[string]Record // record name -> ownership record
+	if opts.Ownership {
+		if owners, err = listOwnershipRecords(ctx, s.DNS, zone, opts.OwnerID); err != nil {
+			return nil, nil, err
+		}
+	}
+	var (
+		legacy []LegacyRecord
+		result = &Result{
+			ToCreate: map[string][]string{},
+			ToUpdate: map[string][]string{},
+			ToDelete: map[string][]string{},
+			ToRetune: map[string]int{},
+			DryRun:   opts.DryRun,
+		}
+	)
+	for _, record := range records {
+		name := strings.ToLower(record.Name)
+		if !strings.HasSuffix(name, "."+strings.ToLower(recordSuffix)) {
+			continue
+		}
+		hostname := strings.TrimSuffix(name, "."+strings.ToLower(recordSuffix))
+		if machineNames[hostname] {
+			continue
+		}
+		for _, device := range hostnameDevices[hostname] {
+			ipv4s := device.IPv4s()
+			if len(ipv4s) == 0 || ipv4s[0] != record.Content {
+				continue
+			}
+			machineName := fmt.Sprintf("%s.%s", NormalizeName(device.RecordLabel(tailnet, false)), recordSuffix)
+			legacyRecord := LegacyRecord{
+				Name:        record.Name,
+				Content:     record.Content,
+				RecordID:    record.ID,
+				MachineName: machineName,
+			}
+			existing := recordsByName[strings.ToLower(machineName)]
+			for _, machineNameRecord := range existing {
+				legacyRecord.MachineNameIsUp = legacyRecord.MachineNameIsUp || machineNameRecord.Content == record.Content
+			}
+			if !legacyRecord.MachineNameIsUp && existing != nil {
+				loggerFrom(ctx).Warn().Str("recordName", record.Name).Str("machineName", machineName).Msg("machine-name record points elsewhere, leaving hostname record alone")
+				continue
+			}
+			if _, ok := owners[record.Name]; opts.Ownership && !ok {
+				loggerFrom(ctx).Warn().Str("recordName", record.Name).Msg("hostname record has no ownership record, leaving it alone")
+				continue
+			}
+			legacy = append(legacy, legacyRecord)
+			if !legacyRecord.MachineNameIsUp {
+				result.ToCreate[machineName] = []string{record.Content}
+			}
+			if opts.RemoveLegacy {
+				result.ToDelete[record.Name] = append(result.ToDelete[record.Name], record.ID)
+			}
+			break
+		}
+	}
+	loggerFrom(ctx).Info().
+		Interface("toCreate", result.ToCreate).
+		Interface("toDelete", result.ToDelete).
+		Msg("queued migration changes")
+	if opts.DryRun {
+		return legacy, result, nil
+	}
+	var creates []mutationGroup
+	for name, ipv4s := range result.ToCreate {
+		var group mutationGroup
+		for _, ipv4 := range ipv4s {
+			group.mutations = append(group.mutations, Mutation{Action: MutationCreate, Name: name, Content: ipv4})
+		}
+		if _, ok := owners[name]; opts.Ownership && !ok {
+			group.ownership = &Mutation{
+				Action:  MutationCreate,
+				Type:    "TXT",
+				Name:    ownershipPrefix + name,
+				Content: ownershipMarker(opts.OwnerID),
+			}
+		}
+		creates = append(creates, group)
+	}
+	result.applyGroups(ctx, s.DNS, zone, 1, creates)
+	if len(result.Failed) > 0 {
+		return legacy, result, fmt.Errorf("%d Cloudflare record mutations failed, not removing any legacy records", len(result.Failed))
+	}
+	if opts.RemoveLegacy {
+		var deletes []mutationGroup
+		for _, legacyRecord := range legacy {
+			group := mutationGroup{mutations: []Mutation{{
+				Action:   MutationDelete,
+				Name:     legacyRecord.Name,
+				Content:  legacyRecord.Content,
+				RecordID: legacyRecord.RecordID,
+			}}}
+			// the ownership record goes once nothing is left under the name
+			if owner, ok := owners[legacyRecord.Name]; ok && len(recordsByName[strings.ToLower(legacyRecord.Name)]) == 1 {
+				group.ownership = &Mutation{
+					Action:   MutationDelete,
+					Type:     "TXT",
+					Name:     owner.Name,
+					Content:  owner.Content,
+					RecordID: owner.ID,
+				}
+			}
+			deletes = append(deletes, group)
+		}
+		result.applyGroups(ctx, s.DNS, zone, 1, deletes)
+	}
+	if len(result.Failed) > 0 {
+		return legacy, result, fmt.Errorf("%d Cloudflare record mutations failed", len(result.Failed))
+	}
+	return legacy, result, nil
+}
@@ -0,0 +1,216 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+type MutationAction string
+
+const (
+	MutationCreate MutationAction = "create"
+	// MutationUpdate replaces an existing record's content, e.g. after a device's IP changed.
+	MutationUpdate MutationAction = "update"
+	MutationDelete MutationAction = "delete"
+	// MutationRetune only changes an existing record's TTL.
+	MutationRetune MutationAction = "retune"
+)
+
+// Mutation is a single Cloudflare DNS record change.
+type Mutation struct {
+	Action   MutationAction `json:"action"`
+	Type     string         `json:"type,omitempty"` // defaults to A
+	Name     string         `json:"name"`
+	Content  string         `json:"content,omitempty"`
+	RecordID string         `json:"recordID,omitempty"`
+	TTL      int            `json:"ttl,omitempty"`
+	// Zone is the Cloudflare zone ID the mutation applies to.
+	Zone string `json:"zone,omitempty"`
+}
+
+type mutationResponse struct {
+	Success bool
+	Errors  []struct {
+		Code    int
+		Message string
+	}
+	Result *Record
+}
+
+// Cloudflare error codes that mean a retried mutation already took effect.
+const (
+	cfCodeRecordExists    = 81057
+	cfCodeIdenticalRecord = 81058
+	cfCodeRecordNotFound  = 81044
+)
+
+// retryPendingMutations re-applies mutations that failed on a previous run, returning the ones that
+// were applied and the ones that still fail.
+func retryPendingMutations(ctx context.Context, dns DNSProvider, cloudflareZone string, pending []Mutation) (applied, stillPending []Mutation) {
+	for _, mutation := range pending {
+		if mutation.Zone == "" {
+			mutation.Zone = cloudflareZone
+		}
+		logger := loggerFrom(ctx).With().Str("action", string(mutation.Action)).Str("name", mutation.Name).Logger()
+		record, err := dns.Apply(ctx, cloudflareZone, mutation)
+		if err != nil {
+			logger.Warn().Err(err).Msg("queued mutation failed again, keeping it queued")
+			stillPending = append(stillPending, mutation)
+			continue
+		}
+		if err := verifyMutation(mutation, record); err != nil {
+			logger.Warn().Err(err).Msg("queued mutation applied, but Cloudflare stored something different")
+		}
+		logger.Info().Msg("applied queued mutation")
+		applied = append(applied, mutation)
+	}
+	return applied, stillPending
+}
+
+// applyMutation performs a mutation, returning the record as Cloudflare stored it when the response
+// includes one.
+func (c *Cloudflare) applyMutation(ctx context.Context, cloudflareZone string, mutation Mutation) (*Record, error) {
+	var (
+		method  string
+		url     = c.url(fmt.Sprintf("/zones/%s/dns_records", cloudflareZone))
+		body    []byte
+		err     error
+		settled []int // error codes meaning there's nothing left to do
+	)
+	switch mutation.Action {
+	case MutationCreate:
+		method = http.MethodPost
+		recordType := mutation.Type
+		if recordType == "" {
+			recordType = "A"
+		}
+		ttl := mutation.TTL
+		if ttl == 0 {
+			ttl = 1
+		}
+		body, err = json.Marshal(map[string]interface{}{
+			"type":    recordType,
+			"name":    mutation.Name,
+			"content": mutation.Content,
+			"ttl":     ttl,
+			"proxied": false,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error creating DNS POST request body: %s", err)
+		}
+		loggerFrom(ctx).Debug().Str("body", string(body)).Msg("creating record")
+		settled = []int{cfCodeRecordExists, cfCodeIdenticalRecord}
+	case MutationUpdate:
+		method = http.MethodPut
+		url = fmt.Sprintf("%s/%s", url, mutation.RecordID)
+		recordType := mutation.Type
+		if recordType == "" {
+			recordType = "A"
+		}
+		ttl := mutation.TTL
+		if ttl == 0 {
+			ttl = 1
+		}
+		body, err = json.Marshal(map[string]interface{}{
+			"type":    recordType,
+			"name":    mutation.Name,
+			"content": mutation.Content,
+			"ttl":     ttl,
+			"proxied": false,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error creating DNS PUT request body: %s", err)
+		}
+		loggerFrom(ctx).Debug().Str("body", string(body)).Msg("updating record")
+		settled = []int{cfCodeIdenticalRecord}
+	case MutationRetune:
+		method = http.MethodPatch
+		url = fmt.Sprintf("%s/%s", url, mutation.RecordID)
+		body, err = json.Marshal(map[string]interface{}{
+			"ttl": mutation.TTL,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error creating DNS PATCH request body: %s", err)
+		}
+		loggerFrom(ctx).Debug().Str("body", string(body)).Msg("retuning record")
+	case MutationDelete:
+		method = http.MethodDelete
+		url = fmt.Sprintf("%s/%s", url, mutation.RecordID)
+		settled = []int{cfCodeRecordNotFound}
+	default:
+		return nil, fmt.Errorf("unknown mutation action %q", mutation.Action)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, fmt.Errorf("error creating DNS %s request: %s", method, err)
+	}
+	response, err := c.do(request)
+	if err != nil {
+		return nil, fmt.Errorf("error performing Cloudflare record %s: %s", method, err)
+	}
+	defer response.Body.Close()
+	body, err = ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading Cloudflare record %s: %s", method, err)
+	}
+	loggerFrom(ctx).Debug().Str("body", string(body)).Msgf("record %s response", method)
+	if response.StatusCode > http.StatusAccepted {
+		var parsed mutationResponse
+		if json.Unmarshal(body, &parsed) == nil {
+			for _, cfErr := range parsed.Errors {
+				for _, code := range settled {
+					if cfErr.Code == code {
+						loggerFrom(ctx).Debug().Int("code", code).Msg("mutation already applied")
+						return nil, nil
+					}
+				}
+			}
+		}
+		return nil, fmt.Errorf(">202 response to Cloudflare record %s: %d: %s", method, response.StatusCode, body)
+	}
+	var parsed mutationResponse
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return nil, fmt.Errorf("error unmarshalling Cloudflare record %s as JSON: %s", method, err)
+	}
+	return parsed.Result, nil
+}
+
+// verifyMutation checks that the record Cloudflare reports having stored matches what a create,
+// update, or retune asked for, catching silent normalization that a successful status code hides.
+func verifyMutation(mutation Mutation, record *Record) error {
+	if record == nil {
+		return nil
+	}
+	if mutation.Action == MutationRetune {
+		if record.TTL != mutation.TTL {
+			return fmt.Errorf("record %s mismatch: ttl %d != %d", record.ID, record.TTL, mutation.TTL)
+		}
+		return nil
+	}
+	if mutation.Action != MutationCreate && mutation.Action != MutationUpdate {
+		return nil
+	}
+	wantTTL := 1
+	if mutation.TTL != 0 {
+		wantTTL = mutation.TTL
+	}
+	var mismatches []string
+	if record.Name != mutation.Name {
+		mismatches = append(mismatches, fmt.Sprintf("name %q != %q", record.Name, mutation.Name))
+	}
+	if record.Content != mutation.Content {
+		mismatches = append(mismatches, fmt.Sprintf("content %q != %q", record.Content, mutation.Content))
+	}
+	if record.TTL != wantTTL {
+		mismatches = append(mismatches, fmt.Sprintf("ttl %d != %d", record.TTL, wantTTL))
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("record %s mismatch: %s", record.ID, strings.Join(mismatches, ", "))
+	}
+	return nil
+}
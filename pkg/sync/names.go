@@ -0,0 +1,51 @@
+package sync
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxLabelLength is the longest a DNS label can be.
+const maxLabelLength = 63
+
+// NormalizeName turns a record label into valid RFC 1123 DNS labels: lowercased, with anything but
+// letters, digits, and hyphens replaced by hyphens, no leading or trailing hyphens, and truncated to
+// 63 characters. Dots are kept, normalizing each label between them. It returns "" if nothing usable
+// is left.
+func NormalizeName(name string) string {
+	var labels []string
+	for _, label := range strings.Split(strings.ToLower(name), ".") {
+		label = strings.Map(func(r rune) rune {
+			if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' {
+				return r
+			}
+			return '-'
+		}, label)
+		label = strings.Trim(label, "-")
+		if len(label) > maxLabelLength {
+			label = strings.TrimRight(label[:maxLabelLength], "-")
+		}
+		if label != "" {
+			labels = append(labels, label)
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// recordLabel normalizes name, or with strict, errors if it would have to be changed.
+func recordLabel(name string, strict bool) (string, error) {
+	normalized := NormalizeName(name)
+	if normalized == name {
+		return name, nil
+	}
+	if strict {
+		if normalized == "" {
+			return "", fmt.Errorf("device name %q isn't a valid DNS name", name)
+		}
+		return "", fmt.Errorf("device name %q isn't a valid DNS name, it would have to be published as %q", name, normalized)
+	}
+	if normalized == "" {
+		return "", fmt.Errorf("device name %q has nothing usable as a DNS name", name)
+	}
+	return normalized, nil
+}
@@ -0,0 +1,78 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	stdsync "sync"
+	"time"
+)
+
+// TailscaleOAuthClient exchanges Tailscale OAuth client credentials for short-lived API access
+// tokens, which can be used anywhere an API key can. Unlike API keys, the client credentials don't
+// expire. It's safe for concurrent use.
+type TailscaleOAuthClient struct {
+	ClientID     string
+	ClientSecret string
+	// BaseURL replaces https://api.tailscale.com, e.g. to go through an egress proxy or to a mock
+	// server.
+	BaseURL string
+	// HTTPClient makes the token requests. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+
+	mu     stdsync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// tokenRefreshMargin is how long before an access token expires that a new one is requested.
+const tokenRefreshMargin = 5 * time.Minute
+
+type oauthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// Token returns an access token, requesting a new one if the last one is close to expiring.
+func (c *TailscaleOAuthClient) Token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Now().Add(tokenRefreshMargin).Before(c.expiry) {
+		return c.token, nil
+	}
+	form := url.Values{}
+	form.Set("client_id", c.ClientID)
+	form.Set("client_secret", c.ClientSecret)
+	form.Set("grant_type", "client_credentials")
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL(c.BaseURL, defaultTailscaleBaseURL, "/api/v2/oauth/token"), strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("error creating Tailscale OAuth token POST request: %s", err)
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response, err := clientOrDefault(c.HTTPClient).Do(request)
+	if err != nil {
+		return "", fmt.Errorf("error performing Tailscale OAuth token POST: %s", err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading Tailscale OAuth token POST body: %s", err)
+	}
+	if response.StatusCode > http.StatusOK {
+		return "", fmt.Errorf("non-200 response to Tailscale OAuth token POST: %d: %s", response.StatusCode, body)
+	}
+	var tokenResponse oauthTokenResponse
+	if err := json.Unmarshal(body, &tokenResponse); err != nil {
+		return "", fmt.Errorf("error unmarshalling Tailscale OAuth token POST as JSON: %s", err)
+	}
+	if tokenResponse.AccessToken == "" {
+		return "", fmt.Errorf("Tailscale OAuth token POST didn't return an access token")
+	}
+	c.token = tokenResponse.AccessToken
+	c.expiry = time.Now().Add(time.Duration(tokenResponse.ExpiresIn) * time.Second)
+	return c.token, nil
+}
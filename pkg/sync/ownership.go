@@ -0,0 +1,43 @@
+package sync
+
+import (
+	"context"
+	"strings"
+)
+
+// ownershipPrefix is prepended to a record's name to get its ownership TXT record's name. Keeping
+// ownership records off the record's own name leaves room for record types like CNAME that can't
+// share a name.
+const ownershipPrefix = "_tailscale2cloudflare."
+
+// ownershipMarker is the content of ownership TXT records.
+func ownershipMarker(ownerID string) string {
+	if ownerID == "" {
+		ownerID = "default"
+	}
+	return "managed-by=tailscale2cloudflare,owner=" + ownerID
+}
+
+// listOwnershipRecords maps record names to the ownership TXT records marking them as ours.
+func listOwnershipRecords(ctx context.Context, dns DNSProvider, zone, ownerID string) (map[string]Record, error) {
+	records, err := dns.ListRecords(ctx, zone, "TXT")
+	if err != nil {
+		return nil, err
+	}
+	var (
+		marker = ownershipMarker(ownerID)
+		owned  = map[string]Record{}
+	)
+	for _, record := range records {
+		if !strings.HasPrefix(record.Name, ownershipPrefix) {
+			continue
+		}
+		// Cloudflare may hand back TXT content in quotes
+		if strings.Trim(record.Content, `"`) != marker {
+			loggerFrom(ctx).Debug().Str("recordName", record.Name).Msg("ownership record belongs to another owner")
+			continue
+		}
+		owned[strings.TrimPrefix(record.Name, ownershipPrefix)] = record
+	}
+	return owned, nil
+}
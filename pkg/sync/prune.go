@@ -0,0 +1,179 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"inet.af/netaddr"
+)
+
+// PruneOptions tweaks PruneOrphanedRecords.
+type PruneOptions struct {
+	DryRun bool
+	// Protect lists record names never to delete, like Tailscale2CloudflareOptions.Protect.
+	Protect []string
+	// RecordPrefix limits the cleanup to records whose label starts with it, so that tailnets sharing
+	// a subdomain leave each other's records alone, like Tailscale2CloudflareOptions.RecordPrefix.
+	RecordPrefix string
+	// Ownership limits the cleanup to records marked as its own by an ownership TXT record, which is
+	// deleted along with them, like Tailscale2CloudflareOptions.Ownership.
+	Ownership bool
+	OwnerID   string
+	// Confirm, if set, is passed the planned deletions before any are made. Unless it returns true,
+	// nothing is deleted, and the result is returned as a dry run.
+	Confirm func(ctx context.Context, result *Result) (bool, error)
+	// Logger receives the cleanup's logs. Defaults to zerolog's global logger.
+	Logger *zerolog.Logger
+}
+
+// PruneOrphanedRecords deletes A records under the subdomain that point at a Tailscale address, i.e.
+// one in 100.64.0.0/10, that no device in the tailnet has, whatever they're named. Records like that
+// are left behind by older versions and naming schemes, e.g. hostname records for devices that have
+// since left the tailnet, which syncs don't recognize as their own. Records pointing at a current
+// device's address are left alone; MigrateHostnameRecords deals with those.
+func PruneOrphanedRecords(ctx context.Context, tailscaleKey, tailscaleTailnet, cloudflareToken, cloudflareZone, cloudflareSubdomain string, opts *PruneOptions) (*Result, error) {
+	syncer := &Syncer{
+		Tailscale: &TailscaleAPI{Key: tailscaleKey},
+		DNS:       &Cloudflare{Token: cloudflareToken},
+	}
+	return syncer.Prune(ctx, tailscaleTailnet, cloudflareZone, cloudflareSubdomain, opts)
+}
+
+// Prune is PruneOrphanedRecords with the Syncer's clients. The Syncer's Options don't apply.
+func (s *Syncer) Prune(ctx context.Context, tailnet, zone, subdomain string, opts *PruneOptions) (*Result, error) {
+	if opts == nil {
+		opts = &PruneOptions{}
+	}
+	ctx = withLogger(ctx, opts.Logger)
+	protected, err := compileRecordPatterns(opts.Protect)
+	if err != nil {
+		return nil, err
+	}
+	devices, err := s.Tailscale.ListDevices(ctx, tailnet)
+	if err != nil {
+		return nil, err
+	}
+	// unauthorized devices still hold on to their addresses
+	deviceAddresses := map[string]bool{}
+	for _, device := range devices {
+		for _, address := range device.Addresses {
+			deviceAddresses[address] = true
+		}
+	}
+	records, err := s.DNS.ListRecords(ctx, zone, "A")
+	if err != nil {
+		return nil, err
+	}
+	recordSuffix, err := zoneNameOf(ctx, s.DNS, zone, records)
+	if err != nil {
+		return nil, err
+	}
+	if subdomain != "" {
+		recordSuffix = fmt.Sprintf("%s.%s", subdomain, recordSuffix)
+	}
+	var owners map[string]Record // record name -> ownership record
+	if opts.Ownership {
+		if owners, err = listOwnershipRecords(ctx, s.DNS, zone, opts.OwnerID); err != nil {
+			return nil, err
+		}
+	}
+	result := &Result{
+		ToCreate: map[string][]string{},
+		ToUpdate: map[string][]string{},
+		ToDelete: map[string][]string{},
+		ToRetune: map[string]int{},
+		DryRun:   opts.DryRun,
+		Devices:  devices,
+	}
+	for _, record := range records {
+		if !strings.HasSuffix(record.Name, "."+recordSuffix) || deviceAddresses[record.Content] {
+			continue
+		}
+		if ip, err := netaddr.ParseIP(record.Content); err != nil || !sharedAddressSpace.Contains(ip) {
+			continue
+		}
+		label := strings.TrimSuffix(record.Name, "."+recordSuffix)
+		if !strings.HasPrefix(label, opts.RecordPrefix) {
+			// another tailnet's record
+			continue
+		}
+		if _, ok := owners[record.Name]; opts.Ownership && !ok {
+			loggerFrom(ctx).Debug().Str("recordName", record.Name).Msg("keeping record without an ownership record")
+			continue
+		}
+		if protected.match(record.Name, label) {
+			loggerFrom(ctx).Info().Str("recordName", record.Name).Str("content", record.Content).Msg("record is protected, not deleting it")
+			continue
+		}
+		result.ToDelete[record.Name] = append(result.ToDelete[record.Name], record.ID)
+		result.Plan = append(result.Plan, PlannedChange{
+			Action:   MutationDelete,
+			Type:     record.Type,
+			Name:     record.Name,
+			Content:  record.Content,
+			RecordID: record.ID,
+			Reason:   "address belongs to no device in the tailnet",
+		})
+	}
+	sort.SliceStable(result.Plan, func(i, j int) bool { return result.Plan[i].Name < result.Plan[j].Name })
+	for _, change := range result.Plan {
+		change.log(loggerFrom(ctx))
+	}
+	loggerFrom(ctx).Info().Int("changes", len(result.Plan)).Msg("planned cleanup")
+	if opts.DryRun || len(result.Plan) == 0 {
+		return result, nil
+	}
+	if opts.Confirm != nil {
+		confirmed, err := opts.Confirm(ctx, result)
+		if err != nil {
+			return nil, err
+		}
+		if !confirmed {
+			loggerFrom(ctx).Info().Msg("cleanup not confirmed, leaving records alone")
+			result.DryRun = true
+			return result, nil
+		}
+	}
+	deleted := map[string]bool{}
+	for _, change := range result.Plan {
+		deleted[change.RecordID] = true
+	}
+	kept := map[string]bool{} // record names with records left under them
+	for _, record := range records {
+		if !deleted[record.ID] {
+			kept[record.Name] = true
+		}
+	}
+	var groups []mutationGroup
+	for _, change := range result.Plan {
+		if len(groups) == 0 || groups[len(groups)-1].mutations[0].Name != change.Name {
+			groups = append(groups, mutationGroup{})
+		}
+		group := &groups[len(groups)-1]
+		group.mutations = append(group.mutations, Mutation{
+			Action:   MutationDelete,
+			Type:     change.Type,
+			Name:     change.Name,
+			Content:  change.Content,
+			RecordID: change.RecordID,
+		})
+		// the ownership record goes once nothing is left under the name
+		if owner, ok := owners[change.Name]; ok && !kept[change.Name] {
+			group.ownership = &Mutation{
+				Action:   MutationDelete,
+				Type:     "TXT",
+				Name:     owner.Name,
+				Content:  owner.Content,
+				RecordID: owner.ID,
+			}
+		}
+	}
+	result.applyGroups(ctx, s.DNS, zone, 1, groups)
+	if len(result.Failed) > 0 {
+		return result, fmt.Errorf("%d Cloudflare record mutations failed", len(result.Failed))
+	}
+	return result, nil
+}
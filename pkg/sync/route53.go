@@ -0,0 +1,351 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	route53API = "https://route53.amazonaws.com/2013-04-01"
+	// Route 53 has no automatic TTL, so this stands in for Cloudflare's, which is 1. Records are listed
+	// with their real TTL, so a sync asking for 300 gets it too.
+	route53AutoTTL = 300
+)
+
+// Route53 is the DNSProvider for AWS Route 53 hosted zones, which are identified by hosted zone ID.
+// Route 53 keeps all of a name's records of a type in one record set, so each of its values is listed
+// as a separate Record, and mutations rewrite the record set they belong to.
+type Route53 struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is only needed for temporary credentials.
+	SessionToken string
+	// HTTPClient makes the API requests. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+type route53RecordSet struct {
+	Name            string
+	Type            string
+	TTL             int       `xml:"TTL,omitempty"`
+	SetIdentifier   string    `xml:"SetIdentifier,omitempty"`
+	AliasTarget     *struct{} `xml:"AliasTarget,omitempty"`
+	ResourceRecords []struct {
+		Value string
+	} `xml:"ResourceRecords>ResourceRecord"`
+}
+
+type route53ListResponse struct {
+	ResourceRecordSets   []route53RecordSet `xml:"ResourceRecordSets>ResourceRecordSet"`
+	IsTruncated          bool
+	NextRecordName       string
+	NextRecordType       string
+	NextRecordIdentifier string
+}
+
+type route53ChangeRequest struct {
+	XMLName xml.Name `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ChangeResourceRecordSetsRequest"`
+	Changes []struct {
+		Action            string
+		ResourceRecordSet route53RecordSet
+	} `xml:"ChangeBatch>Changes>Change"`
+}
+
+// ListRecords lists the zone's records of recordType, skipping alias and routing-policy record sets.
+func (r *Route53) ListRecords(ctx context.Context, zone, recordType string) ([]Record, error) {
+	var (
+		records []Record
+		query   = url.Values{}
+	)
+	for {
+		var (
+			listResponse route53ListResponse
+			path         = route53ZonePath(zone) + "/rrset"
+		)
+		if len(query) > 0 {
+			path += "?" + query.Encode()
+		}
+		if err := r.do(ctx, http.MethodGet, path, nil, &listResponse); err != nil {
+			return nil, err
+		}
+		for _, recordSet := range listResponse.ResourceRecordSets {
+			if recordSet.Type == recordType && recordSet.AliasTarget == nil && recordSet.SetIdentifier == "" {
+				records = append(records, route53Records(recordSet)...)
+			}
+		}
+		if !listResponse.IsTruncated {
+			break
+		}
+		query.Set("name", listResponse.NextRecordName)
+		query.Set("type", listResponse.NextRecordType)
+		if listResponse.NextRecordIdentifier != "" {
+			query.Set("identifier", listResponse.NextRecordIdentifier)
+		}
+	}
+	loggerFrom(ctx).Debug().Interface("records", records).Msg("GET Route 53 records")
+	return records, nil
+}
+
+// ZoneName GETs the hosted zone's name, e.g. example.com.
+func (r *Route53) ZoneName(ctx context.Context, zone string) (string, error) {
+	var zoneResponse struct {
+		Name string `xml:"HostedZone>Name"`
+	}
+	if err := r.do(ctx, http.MethodGet, route53ZonePath(zone), nil, &zoneResponse); err != nil {
+		return "", err
+	}
+	if zoneResponse.Name == "" {
+		return "", fmt.Errorf("Route 53 hosted zone GET response has no zone name")
+	}
+	return strings.TrimSuffix(zoneResponse.Name, "."), nil
+}
+
+// Apply performs a mutation by rewriting the record set it belongs to. Route 53 doesn't report the
+// stored record back, so the returned Record is always nil.
+func (r *Route53) Apply(ctx context.Context, zone string, mutation Mutation) (*Record, error) {
+	recordType := mutation.Type
+	if recordType == "" {
+		recordType = "A"
+	}
+	current, err := r.recordSet(ctx, zone, mutation.Name, recordType)
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	if current != nil {
+		for _, record := range current.ResourceRecords {
+			values = append(values, record.Value)
+		}
+	}
+	ttl := route53AutoTTL
+	if current != nil {
+		ttl = current.TTL
+	}
+	content := mutation.Content
+	if recordType == "TXT" && !strings.HasPrefix(content, `"`) {
+		content = fmt.Sprintf("%q", content)
+	}
+	switch mutation.Action {
+	case MutationCreate:
+		if containsString(values, content) {
+			loggerFrom(ctx).Debug().Str("name", mutation.Name).Msg("mutation already applied")
+			return nil, nil
+		}
+		values = append(values, content)
+		ttl = route53TTL(mutation.TTL, ttl)
+	case MutationUpdate:
+		values = removeString(values, route53RecordValue(mutation.RecordID))
+		if !containsString(values, content) {
+			values = append(values, content)
+		}
+		ttl = route53TTL(mutation.TTL, ttl)
+	case MutationRetune:
+		ttl = route53TTL(mutation.TTL, ttl)
+	case MutationDelete:
+		values = removeString(values, route53RecordValue(mutation.RecordID))
+	default:
+		return nil, fmt.Errorf("unknown mutation action %q", mutation.Action)
+	}
+	var change route53ChangeRequest
+	change.Changes = make([]struct {
+		Action            string
+		ResourceRecordSet route53RecordSet
+	}, 1)
+	if len(values) == 0 {
+		if current == nil {
+			loggerFrom(ctx).Debug().Str("name", mutation.Name).Msg("mutation already applied")
+			return nil, nil
+		}
+		// deletes have to match the record set exactly
+		change.Changes[0].Action = "DELETE"
+		change.Changes[0].ResourceRecordSet = *current
+	} else {
+		change.Changes[0].Action = "UPSERT"
+		change.Changes[0].ResourceRecordSet = route53RecordSet{Name: mutation.Name, Type: recordType, TTL: ttl}
+		for _, value := range values {
+			change.Changes[0].ResourceRecordSet.ResourceRecords = append(change.Changes[0].ResourceRecordSet.ResourceRecords, struct{ Value string }{value})
+		}
+	}
+	body, err := xml.Marshal(change)
+	if err != nil {
+		return nil, fmt.Errorf("error creating Route 53 change request body: %s", err)
+	}
+	loggerFrom(ctx).Debug().Str("body", string(body)).Msg("changing Route 53 record set")
+	return nil, r.do(ctx, http.MethodPost, route53ZonePath(zone)+"/rrset/", body, nil)
+}
+
+// autoTTL is the TTL records asked for with an automatic TTL get.
+func (r *Route53) autoTTL() int {
+	return route53AutoTTL
+}
+
+// rewritesRecordSets keeps a sync from applying mutations to one record set concurrently.
+func (r *Route53) rewritesRecordSets() {}
+
+// recordSet GETs the record set for name and recordType, or nil if there isn't one.
+func (r *Route53) recordSet(ctx context.Context, zone, name, recordType string) (*route53RecordSet, error) {
+	query := url.Values{}
+	query.Set("name", name)
+	query.Set("type", recordType)
+	query.Set("maxitems", "1")
+	var listResponse route53ListResponse
+	if err := r.do(ctx, http.MethodGet, route53ZonePath(zone)+"/rrset?"+query.Encode(), nil, &listResponse); err != nil {
+		return nil, err
+	}
+	// listing starts at name, so the first record set may be a later one
+	for _, recordSet := range listResponse.ResourceRecordSets {
+		if route53Name(recordSet.Name) == strings.ToLower(name) && recordSet.Type == recordType && recordSet.SetIdentifier == "" {
+			return &recordSet, nil
+		}
+	}
+	return nil, nil
+}
+
+// do performs a signed Route 53 API request, unmarshalling the XML response into into if set.
+func (r *Route53) do(ctx context.Context, method, path string, body []byte, into interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, method, route53API+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating Route 53 %s request: %s", method, err)
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/xml")
+	}
+	signAWSv4(request, body, r.AccessKeyID, r.SecretAccessKey, r.SessionToken, "us-east-1", "route53", time.Now())
+	response, err := clientOrDefault(r.HTTPClient).Do(request)
+	if err != nil {
+		return fmt.Errorf("error performing Route 53 %s: %s", method, err)
+	}
+	defer response.Body.Close()
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("error reading Route 53 %s body: %s", method, err)
+	}
+	if response.StatusCode > http.StatusOK {
+		return fmt.Errorf("non-200 response to Route 53 %s: %d: %s", method, response.StatusCode, responseBody)
+	}
+	if into == nil {
+		return nil
+	}
+	if err := xml.Unmarshal(responseBody, into); err != nil {
+		return fmt.Errorf("error unmarshalling Route 53 %s as XML: %s", method, err)
+	}
+	return nil
+}
+
+// route53Records splits a record set into a Record per value. Record IDs are "name type value", since
+// Route 53 values have no IDs of their own.
+func route53Records(recordSet route53RecordSet) []Record {
+	var (
+		records []Record
+		name    = route53Name(recordSet.Name)
+	)
+	for _, value := range recordSet.ResourceRecords {
+		records = append(records, Record{
+			ID:      fmt.Sprintf("%s %s %s", name, recordSet.Type, value.Value),
+			Type:    recordSet.Type,
+			Name:    name,
+			Content: value.Value,
+			TTL:     recordSet.TTL,
+		})
+	}
+	return records
+}
+
+func route53RecordValue(recordID string) string {
+	parts := strings.SplitN(recordID, " ", 3)
+	return parts[len(parts)-1]
+}
+
+// route53Name undoes Route 53's trailing dot and octal escaping, e.g. of * in wildcards.
+func route53Name(name string) string {
+	return strings.ReplaceAll(strings.TrimSuffix(name, "."), `\052`, "*")
+}
+
+func route53TTL(ttl, fallback int) int {
+	switch ttl {
+	case 0:
+		return fallback
+	case 1:
+		return route53AutoTTL
+	}
+	return ttl
+}
+
+func route53ZonePath(zone string) string {
+	return "/hostedzone/" + strings.TrimPrefix(zone, "/hostedzone/")
+}
+
+func removeString(values []string, value string) []string {
+	var kept []string
+	for _, v := range values {
+		if v != value {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// signAWSv4 signs request with AWS Signature Version 4.
+func signAWSv4(request *http.Request, body []byte, accessKeyID, secretAccessKey, sessionToken, region, service string, now time.Time) {
+	var (
+		amzDate     = now.UTC().Format("20060102T150405Z")
+		date        = amzDate[:8]
+		payloadHash = sha256.Sum256(body)
+		scope       = fmt.Sprintf("%s/%s/%s/aws4_request", date, region, service)
+	)
+	request.Header.Set("X-Amz-Date", amzDate)
+	if sessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+	headers := map[string]string{"host": request.URL.Host}
+	for name := range request.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(request.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+	// AWS wants spaces as %20, and url.Values already sorts by key
+	canonicalQuery := strings.ReplaceAll(request.URL.Query().Encode(), "+", "%20")
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		canonicalQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(canonicalHash[:])}, "\n")
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	for _, part := range []string{region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	request.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign)),
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
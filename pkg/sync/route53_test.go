@@ -0,0 +1,237 @@
+package sync
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestSignAWSv4(t *testing.T) {
+	// from AWS's Signature Version 4 test suite
+	const (
+		accessKeyID     = "AKIDEXAMPLE"
+		secretAccessKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	)
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	tests := []struct {
+		name          string
+		method        string
+		url           string
+		wantSigned    string
+		wantSignature string
+	}{
+		{
+			name:          "get-vanilla",
+			method:        http.MethodGet,
+			url:           "https://example.amazonaws.com/",
+			wantSigned:    "host;x-amz-date",
+			wantSignature: "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name:          "get-vanilla-query-order-key-case",
+			method:        http.MethodGet,
+			url:           "https://example.amazonaws.com/?Param2=value2&Param1=value1",
+			wantSigned:    "host;x-amz-date",
+			wantSignature: "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+		{
+			name:          "post-vanilla",
+			method:        http.MethodPost,
+			url:           "https://example.amazonaws.com/",
+			wantSigned:    "host;x-amz-date",
+			wantSignature: "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, _ := http.NewRequest(test.method, test.url, nil)
+			signAWSv4(request, nil, accessKeyID, secretAccessKey, "", "us-east-1", "service", now)
+			want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=" + test.wantSigned + ", Signature=" + test.wantSignature
+			if got := request.Header.Get("Authorization"); got != want {
+				t.Errorf("Authorization = %s, want %s", got, want)
+			}
+			if got := request.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+				t.Errorf("X-Amz-Date = %s", got)
+			}
+		})
+	}
+}
+
+// fakeRoute53 serves the parts of the Route 53 API syncs use for hosted zone Z, keeping its record
+// sets in memory by name and type.
+type fakeRoute53 struct {
+	mu   gosync.Mutex
+	sets map[string]route53RecordSet
+}
+
+func (f *fakeRoute53) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/2013-04-01/hostedzone/Z":
+		io.WriteString(w, `<GetHostedZoneResponse><HostedZone><Name>example.com.</Name></HostedZone></GetHostedZoneResponse>`)
+	case r.Method == http.MethodGet && r.URL.Path == "/2013-04-01/hostedzone/Z/rrset":
+		var keys []string
+		for key := range f.sets {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var listResponse route53ListResponse
+		for _, key := range keys {
+			// listing starts at name, like the real thing
+			if name := r.URL.Query().Get("name"); name != "" && key < name+"." {
+				continue
+			}
+			listResponse.ResourceRecordSets = append(listResponse.ResourceRecordSets, f.sets[key])
+		}
+		body, _ := xml.Marshal(listResponse)
+		w.Write(body)
+	case r.Method == http.MethodPost && r.URL.Path == "/2013-04-01/hostedzone/Z/rrset/":
+		var change route53ChangeRequest
+		if err := xml.NewDecoder(r.Body).Decode(&change); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, c := range change.Changes {
+			set := c.ResourceRecordSet
+			set.Name = strings.TrimSuffix(set.Name, ".") + "."
+			key := set.Name + " " + set.Type
+			switch c.Action {
+			case "UPSERT":
+				f.sets[key] = set
+			case "DELETE":
+				if !reflect.DeepEqual(f.sets[key], set) {
+					http.Error(w, "record set doesn't match", http.StatusBadRequest)
+					return
+				}
+				delete(f.sets, key)
+			}
+		}
+		io.WriteString(w, `<ChangeResourceRecordSetsResponse/>`)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// dump lists the fake's record sets as "TYPE name ttl values", sorted.
+func (f *fakeRoute53) dump() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var sets []string
+	for _, set := range f.sets {
+		var values []string
+		for _, record := range set.ResourceRecords {
+			values = append(values, record.Value)
+		}
+		sets = append(sets, fmt.Sprintf("%s %s %d %s", set.Type, route53Name(set.Name), set.TTL, strings.Join(values, ",")))
+	}
+	sort.Strings(sets)
+	return sets
+}
+
+func route53Set(name string, ttl int, values ...string) route53RecordSet {
+	set := route53RecordSet{Name: name + ".", Type: "A", TTL: ttl}
+	for _, value := range values {
+		set.ResourceRecords = append(set.ResourceRecords, struct{ Value string }{value})
+	}
+	return set
+}
+
+// redirectTransport sends every request to target instead of the host it was made for.
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t redirectTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	request = request.Clone(request.Context())
+	request.URL.Scheme, request.URL.Host = t.target.Scheme, t.target.Host
+	return http.DefaultTransport.RoundTrip(request)
+}
+
+func TestRoute53TTLRoundTrip(t *testing.T) {
+	var (
+		laptop = Device{Name: "laptop.t", Addresses: []string{"100.64.0.1"}, Authorized: true}
+		server = Device{Name: "server.t", Addresses: []string{"100.64.0.2"}, Authorized: true}
+	)
+	tests := []struct {
+		name     string
+		sets     []route53RecordSet
+		opts     Tailscale2CloudflareOptions
+		wantPlan []string
+		wantSets []string
+	}{
+		{
+			name:     "create with automatic TTL",
+			opts:     Tailscale2CloudflareOptions{OfflineTTL: 600, OfflineAfter: time.Hour},
+			wantPlan: []string{"create laptop.ts.example.com 100.64.0.1", "create server.ts.example.com 100.64.0.2"},
+			wantSets: []string{"A laptop.ts.example.com 300 100.64.0.1", "A server.ts.example.com 300 100.64.0.2"},
+		},
+		{
+			name: "automatic TTL",
+			sets: []route53RecordSet{route53Set("laptop.ts.example.com", 300, "100.64.0.1"), route53Set("server.ts.example.com", 300, "100.64.0.2")},
+			// managing TTLs for offline devices compares every record's TTL to the automatic one
+			opts:     Tailscale2CloudflareOptions{OfflineTTL: 600, OfflineAfter: time.Hour},
+			wantSets: []string{"A laptop.ts.example.com 300 100.64.0.1", "A server.ts.example.com 300 100.64.0.2"},
+		},
+		{
+			name:     "record TTL of 300",
+			sets:     []route53RecordSet{route53Set("laptop.ts.example.com", 300, "100.64.0.1"), route53Set("server.ts.example.com", 300, "100.64.0.2")},
+			opts:     Tailscale2CloudflareOptions{RecordTTL: 300},
+			wantSets: []string{"A laptop.ts.example.com 300 100.64.0.1", "A server.ts.example.com 300 100.64.0.2"},
+		},
+		{
+			name:     "record TTL",
+			sets:     []route53RecordSet{route53Set("laptop.ts.example.com", 300, "100.64.0.1")},
+			opts:     Tailscale2CloudflareOptions{RecordTTL: 60},
+			wantPlan: []string{"create server.ts.example.com 100.64.0.2", "retune laptop.ts.example.com A 100.64.0.1 60"},
+			wantSets: []string{"A laptop.ts.example.com 60 100.64.0.1", "A server.ts.example.com 60 100.64.0.2"},
+		},
+		{
+			name:     "back to automatic TTL",
+			sets:     []route53RecordSet{route53Set("laptop.ts.example.com", 60, "100.64.0.1"), route53Set("server.ts.example.com", 300, "100.64.0.2")},
+			opts:     Tailscale2CloudflareOptions{RecordTTL: 1},
+			wantPlan: []string{"retune laptop.ts.example.com A 100.64.0.1 1"},
+			wantSets: []string{"A laptop.ts.example.com 300 100.64.0.1", "A server.ts.example.com 300 100.64.0.2"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			route53 := &fakeRoute53{sets: map[string]route53RecordSet{}}
+			for _, set := range test.sets {
+				route53.sets[set.Name+" "+set.Type] = set
+			}
+			fake := httptest.NewServer(route53)
+			defer fake.Close()
+			target, _ := url.Parse(fake.URL)
+			dns := &Route53{AccessKeyID: "id", SecretAccessKey: "secret", HTTPClient: &http.Client{Transport: redirectTransport{target}}}
+			logger := zerolog.Nop()
+			opts := test.opts
+			opts.Logger = &logger
+			// the second sync finds nothing left to change
+			for i, wantPlan := range [][]string{test.wantPlan, nil} {
+				result, err := syncDevices(context.Background(), []Device{laptop, server}, "t", dns, "Z", "ts", &opts)
+				if err != nil {
+					t.Fatalf("error syncing: %s", err)
+				}
+				if plan := planned(result); !reflect.DeepEqual(plan, wantPlan) {
+					t.Errorf("sync %d plan = %q, want %q", i+1, plan, wantPlan)
+				}
+			}
+			if sets := route53.dump(); !reflect.DeepEqual(sets, test.wantSets) {
+				t.Errorf("record sets = %q, want %q", sets, test.wantSets)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package sync
+
+// Snapshot is what a sync published to a zone, so that the next sync can plan against it without
+// listing the zone's records again. Changes made to the zone by anything else go unnoticed until a sync
+// runs without one.
+type Snapshot struct {
+	ZoneName string `json:"zoneName"`
+	// Names maps record types to record labels to the contents published under them.
+	Names   map[string]map[string][]string `json:"names"`
+	Records []Record                       `json:"records"`
+}
+
+// sameNames reports whether two record type -> label -> contents mappings match, treating missing and
+// empty contents alike.
+func sameNames(a, b map[string]map[string][]string) bool {
+	covers := func(a, b map[string]map[string][]string) bool {
+		for recordType, names := range a {
+			for name, contents := range names {
+				other := b[recordType][name]
+				if len(contents) != len(other) {
+					return false
+				}
+				for i := range contents {
+					if contents[i] != other[i] {
+						return false
+					}
+				}
+			}
+		}
+		return true
+	}
+	return covers(a, b) && covers(b, a)
+}
+
+// snapshotAfter works out the zone's records once applied took effect on records, returning nil if it
+// can't, e.g. because the DNS provider didn't report a created record's ID.
+func snapshotAfter(zoneName string, names map[string]map[string][]string, records []Record, applied []Mutation) *Snapshot {
+	var (
+		byID  = make(map[string]Record, len(records))
+		order = make([]string, 0, len(records))
+	)
+	for _, record := range records {
+		byID[record.ID] = record
+		order = append(order, record.ID)
+	}
+	for _, mutation := range applied {
+		record, ok := byID[mutation.RecordID]
+		switch mutation.Action {
+		case MutationCreate:
+			if mutation.RecordID == "" || ok {
+				return nil
+			}
+			recordType := mutation.Type
+			if recordType == "" {
+				recordType = "A"
+			}
+			ttl := mutation.TTL
+			if ttl == 0 {
+				ttl = 1
+			}
+			byID[mutation.RecordID] = Record{
+				ID:       mutation.RecordID,
+				Type:     recordType,
+				Name:     mutation.Name,
+				Content:  mutation.Content,
+				TTL:      ttl,
+				ZoneName: zoneName,
+			}
+			order = append(order, mutation.RecordID)
+		case MutationUpdate:
+			if !ok {
+				return nil
+			}
+			record.Content = mutation.Content
+			record.TTL = mutation.TTL
+			byID[mutation.RecordID] = record
+		case MutationRetune:
+			if !ok {
+				return nil
+			}
+			record.TTL = mutation.TTL
+			byID[mutation.RecordID] = record
+		case MutationDelete:
+			delete(byID, mutation.RecordID)
+		}
+	}
+	snapshot := &Snapshot{ZoneName: zoneName, Names: names}
+	for _, id := range order {
+		if record, ok := byID[id]; ok {
+			snapshot.Records = append(snapshot.Records, record)
+		}
+	}
+	return snapshot
+}
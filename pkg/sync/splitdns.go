@@ -0,0 +1,42 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// SetSplitDNS PATCHes the tailnet's split DNS settings so that MagicDNS resolves names under domain,
+// e.g. ts.example.com, with nameservers, leaving other domains' settings alone. Pointed at a tailnet
+// address serving the same records, this gives tailnet members a split-horizon view of the subdomain.
+// https://github.com/tailscale/tailscale/blob/main/api.md
+func SetSplitDNS(ctx context.Context, tailscaleKey, tailscaleTailnet, domain string, nameservers []string) error {
+	return (&TailscaleAPI{Key: tailscaleKey}).SetSplitDNS(ctx, tailscaleTailnet, domain, nameservers)
+}
+
+// SetSplitDNS is the package-level SetSplitDNS through t.
+func (t *TailscaleAPI) SetSplitDNS(ctx context.Context, tailscaleTailnet, domain string, nameservers []string) error {
+	body, err := json.Marshal(map[string][]string{domain: nameservers})
+	if err != nil {
+		return fmt.Errorf("error creating Tailscale split DNS PATCH request body: %s", err)
+	}
+	request, _ := http.NewRequestWithContext(ctx, "PATCH", t.url(fmt.Sprintf("/api/v2/tailnet/%s/dns/split-dns", tailscaleTailnet)), bytes.NewBuffer(body))
+	request.Header.Set("Content-Type", "application/json")
+	response, err := t.do(request)
+	if err != nil {
+		return fmt.Errorf("error performing Tailscale split DNS PATCH: %s", err)
+	}
+	defer response.Body.Close()
+	body, err = ioutil.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("error reading Tailscale split DNS PATCH body: %s", err)
+	}
+	if response.StatusCode > 200 {
+		return fmt.Errorf("non-200 response to Tailscale split DNS PATCH: %d: %s", response.StatusCode, body)
+	}
+	loggerFrom(ctx).Debug().Interface("body", json.RawMessage(body)).Msg("PATCH split DNS")
+	return nil
+}
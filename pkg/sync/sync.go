@@ -0,0 +1,1120 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	stdsync "sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/sync/errgroup"
+	"inet.af/netaddr"
+)
+
+type dnsRecordsResponse struct {
+	Success    bool
+	Errors     []interface{}
+	Messages   []interface{}
+	Result     []Record
+	ResultInfo struct {
+		Page       int
+		TotalPages int `json:"total_pages"`
+	} `json:"result_info"`
+}
+
+// Record is a DNS record as listed by a DNSProvider.
+type Record struct {
+	ID       string
+	Type     string
+	Name     string
+	Content  string
+	TTL      int
+	ZoneName string `json:"zone_name"` // handy field we'll use
+}
+
+// Tailscale2CloudflareOptions tweaks how Tailscale2Cloudflare syncs. The zero value is the
+// default behavior.
+type Tailscale2CloudflareOptions struct {
+	DryRun       bool
+	UseHostnames bool // old behavior - https://github.com/mark-ignacio/tailscale2cloudflare/issues/2
+	// RemoveUnauthorized deletes records for devices that are no longer authorized. Otherwise they're
+	// skipped entirely, leaving any existing records in place.
+	RemoveUnauthorized bool
+	// RemoveExpired deletes records for devices whose node key expired more than ExpiredGrace ago.
+	RemoveExpired bool
+	ExpiredGrace  time.Duration
+	// SkipEphemeral stops publishing ephemeral devices, e.g. CI runners and containers, which come and
+	// go too often to be worth a record. Their records are deleted.
+	SkipEphemeral bool
+	// OfflineTTL, if set, is the TTL for records of devices not seen in OfflineAfter. Their records are
+	// kept but retuned to signal reduced confidence, then restored to RecordTTL once the device is
+	// back.
+	OfflineTTL   int
+	OfflineAfter time.Duration
+	// MaxOffline, if set, stops publishing devices not seen in that long, deleting their records.
+	MaxOffline time.Duration
+	// PendingMutations failed on a previous run and are retried before planning this one.
+	PendingMutations []Mutation
+	// Filter selects which devices are published. Records under the subdomain for devices that don't
+	// match are deleted like those of devices that left the tailnet.
+	Filter DeviceFilter
+	// Overrides rename or exclude devices by record label, i.e. machine name (or hostname with
+	// UseHostnames). Filters see devices under their own labels.
+	Overrides map[string]DeviceOverride
+	// Ownership only lets the sync update or delete records marked as its own by a companion TXT
+	// record, which it creates alongside each record, so records it didn't create are never touched.
+	// OwnerID tells apart syncs sharing a zone, and defaults to "default".
+	Ownership bool
+	OwnerID   string
+	// DuplicateStrategy decides what happens when several devices share a record name. Defaults to
+	// DuplicateLastWins.
+	DuplicateStrategy DuplicateStrategy
+	// RecordTypes are the record types to manage: A for Tailscale IPv4 addresses and AAAA for IPv6
+	// ones. Defaults to only A.
+	RecordTypes []string
+	// RecordMode RecordModeCNAME publishes CNAME records pointing at devices' MagicDNS names instead of
+	// address records, ignoring RecordTypes. Defaults to RecordModeA.
+	RecordMode RecordMode
+	// SubnetRouterSuffix, if set, also publishes devices that serve approved subnet routes under their
+	// label with this suffix, e.g. "-subnet" for router-subnet.ts.example.com.
+	SubnetRouterSuffix string
+	// Protect lists record names that are never updated or deleted, e.g. hand-managed records under
+	// the subdomain. Patterns are path.Match globs, or regular expressions between slashes, and match
+	// either the full record name or its label under the subdomain.
+	Protect []string
+	// RecordPrefix is put in front of every published label, e.g. "staging-" for
+	// staging-laptop.ts.example.com, and records under the subdomain without it are left alone. Syncs
+	// of several tailnets can share a subdomain this way, as long as no prefix starts with another.
+	RecordPrefix string
+	// RecordTemplate, if set, is a text/template rendering each device's label under the subdomain
+	// from its RecordTemplateData, e.g. "{{.MachineName}}.{{.OS}}" for laptop.linux.ts.example.com.
+	// Rendered labels are normalized like device names, and records under the subdomain that the
+	// template couldn't have rendered are left alone.
+	RecordTemplate string
+	// GroupByUser publishes devices under a label for their owner, e.g. laptop.alice.ts.example.com
+	// for alice@example.com's laptop. Devices without an owner are published as usual.
+	GroupByUser bool
+	// StrictNames fails the sync when a device's record label isn't a valid DNS name, instead of
+	// publishing it under NormalizeName's version of it.
+	StrictNames bool
+	// RecordTTL is the TTL of published records, which DeviceOverride.TTL can override per device.
+	// Defaults to 1, Cloudflare's automatic TTL, and existing records' TTLs are left alone unless set.
+	RecordTTL int
+	// Proxied asks for records to be proxied by Cloudflare, which only works for publicly reachable
+	// addresses. Tailscale addresses never are, so syncs fail with an error saying why instead of
+	// publishing unreachable names.
+	Proxied bool
+	// Snapshot is the zone as the last sync left it. If devices still map to the same names, records
+	// are planned against it instead of listed, saving API calls when nothing changed. Ignored with
+	// Ownership or PendingMutations.
+	Snapshot *Snapshot
+	// BatchSize, if set, applies mutations through DNS providers that implement BatchApplier in
+	// batches of up to this many, instead of one request per mutation. Each batch takes effect
+	// atomically; batches that fail are retried one mutation at a time.
+	BatchSize int
+	// MaxDeletes, if set, fails the sync without applying anything when it would delete more than this
+	// many records, e.g. after being pointed at the wrong subdomain.
+	MaxDeletes int
+	// Confirm, if set, is passed the planned result before any of it is applied. Unless it returns
+	// true, nothing is, and the result is returned as a dry run.
+	Confirm func(ctx context.Context, result *Result) (bool, error)
+	// TailscaleBaseURL, CloudflareBaseURL, and HTTPClient set up the clients Tailscale2Cloudflare and
+	// SyncAll make their API requests with, as the fields of the same names on TailscaleAPI and
+	// Cloudflare. A Syncer's own clients are left as they are.
+	TailscaleBaseURL  string
+	CloudflareBaseURL string
+	HTTPClient        *http.Client
+	// Logger receives the sync's logs, including those of the Tailscale and DNS provider clients.
+	// Defaults to zerolog's global logger.
+	Logger *zerolog.Logger
+	// Concurrency is how many record mutations are applied at once. Defaults to 1.
+	Concurrency int
+}
+
+// RecordMode is what kind of records devices are published as.
+type RecordMode string
+
+const (
+	// RecordModeA publishes A (and AAAA) records with devices' Tailscale addresses.
+	RecordModeA RecordMode = "a"
+	// RecordModeCNAME publishes CNAME records pointing at devices' MagicDNS names, e.g.
+	// machine.tailnet.ts.net, which only resolve for tailnet members using MagicDNS.
+	RecordModeCNAME RecordMode = "cname"
+)
+
+// DuplicateStrategy is how devices sharing a record name are published.
+type DuplicateStrategy string
+
+const (
+	// DuplicateLastWins publishes the last listed device's addresses.
+	DuplicateLastWins DuplicateStrategy = "last-wins"
+	// DuplicateMerge publishes every device's addresses under the name, for round-robin DNS.
+	DuplicateMerge DuplicateStrategy = "merge"
+	// DuplicateError fails the sync.
+	DuplicateError DuplicateStrategy = "error"
+)
+
+// Result describes the changes a sync computed, and applied unless DryRun is set.
+type Result struct {
+	ToCreate map[string][]string // record name -> IPs
+	ToUpdate map[string][]string // record ID -> IPs
+	ToDelete map[string][]string // record name -> record IDs
+	ToRetune map[string]int      // record ID -> TTL
+	DryRun   bool
+	// Failed holds mutations that errored, including still-failing PendingMutations.
+	// Persist them and pass them back in as PendingMutations on the next run.
+	Failed []Mutation
+	// Mismatched holds applied mutations whose resulting record differs from what was requested.
+	Mismatched []Mutation
+	// Devices are the tailnet devices the plan was computed from.
+	Devices []Device
+	// Plan lists the planned changes by record name, with the reason for each.
+	Plan []PlannedChange
+	// Snapshot is the zone as of the end of the sync, to pass back in as Options.Snapshot on the next
+	// run. It's nil after dry runs, and whenever the sync can't be sure what the zone holds.
+	Snapshot *Snapshot
+
+	applied []Mutation
+	mu      stdsync.Mutex
+}
+
+// PlannedChange is one record change a sync planned, and why.
+type PlannedChange struct {
+	Action MutationAction `json:"action" yaml:"action"`
+	Type   string         `json:"type" yaml:"type"`
+	Name   string         `json:"name" yaml:"name"`
+	// Content is the record's new address, or the deleted record's address.
+	Content  string `json:"content,omitempty" yaml:"content,omitempty"`
+	Previous string `json:"previous,omitempty" yaml:"previous,omitempty"`
+	TTL      int    `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+	RecordID string `json:"recordID,omitempty" yaml:"recordID,omitempty"`
+	Reason   string `json:"reason" yaml:"reason"`
+}
+
+// log writes the change as one structured line, leaving out empty fields.
+func (c PlannedChange) log(logger *zerolog.Logger) {
+	event := logger.Info().
+		Str("action", string(c.Action)).
+		Str("type", c.Type).
+		Str("name", c.Name).
+		Str("reason", c.Reason)
+	if c.Content != "" {
+		event = event.Str("content", c.Content)
+	}
+	if c.Previous != "" {
+		event = event.Str("previous", c.Previous)
+	}
+	if c.TTL != 0 {
+		event = event.Int("ttl", c.TTL)
+	}
+	if c.RecordID != "" {
+		event = event.Str("recordID", c.RecordID)
+	}
+	event.Msg("planned change")
+}
+
+// Summary is a short human-readable description of the changes, suitable for status messages.
+func (r *Result) Summary() string {
+	updated := count(r.ToUpdate)
+	for recordID := range r.ToRetune {
+		if _, ok := r.ToUpdate[recordID]; !ok {
+			updated++
+		}
+	}
+	verb := "applied"
+	if r.DryRun {
+		verb = "planned (dry run)"
+	}
+	summary := fmt.Sprintf(
+		"%d created, %d updated, %d deleted %s",
+		count(r.ToCreate), updated, count(r.ToDelete), verb,
+	)
+	if len(r.Mismatched) > 0 {
+		summary += fmt.Sprintf(", %d mismatched after applying", len(r.Mismatched))
+	}
+	return summary
+}
+
+// count counts the records in a map of name or record ID -> IPs or record IDs.
+func count(m map[string][]string) (n int) {
+	for _, v := range m {
+		n += len(v)
+	}
+	return
+}
+
+// Changed reports whether the sync planned any record changes, or applied queued ones. A nil Result
+// has none.
+func (r *Result) Changed() bool {
+	return r != nil && (len(r.Plan) > 0 || len(r.applied) > 0)
+}
+
+// Applied lists the record mutations that actually took effect, which is none for a dry run.
+func (r *Result) Applied() []Mutation {
+	return r.applied
+}
+
+// MergeResults combines the results of syncing several zones, e.g. to report on them together. nil
+// results are skipped.
+func MergeResults(results ...*Result) *Result {
+	merged := &Result{
+		ToCreate: map[string][]string{},
+		ToUpdate: map[string][]string{},
+		ToDelete: map[string][]string{},
+		ToRetune: map[string]int{},
+	}
+	for _, result := range results {
+		if result == nil {
+			continue
+		}
+		for name, ipv4s := range result.ToCreate {
+			merged.ToCreate[name] = append(merged.ToCreate[name], ipv4s...)
+		}
+		for recordID, ipv4s := range result.ToUpdate {
+			merged.ToUpdate[recordID] = ipv4s
+		}
+		for name, recordIDs := range result.ToDelete {
+			merged.ToDelete[name] = append(merged.ToDelete[name], recordIDs...)
+		}
+		for recordID, ttl := range result.ToRetune {
+			merged.ToRetune[recordID] = ttl
+		}
+		merged.DryRun = merged.DryRun || result.DryRun
+		merged.Failed = append(merged.Failed, result.Failed...)
+		merged.Mismatched = append(merged.Mismatched, result.Mismatched...)
+		merged.Devices = append(merged.Devices, result.Devices...)
+		merged.Plan = append(merged.Plan, result.Plan...)
+		merged.applied = append(merged.applied, result.applied...)
+	}
+	return merged
+}
+
+// syncDevices reconciles the zone with devices.
+func syncDevices(ctx context.Context, devices []Device, tailscaleTailnet string, dns DNSProvider, cloudflareZone, cloudflareSubdomain string, opts *Tailscale2CloudflareOptions) (*Result, error) {
+	ctx = withLogger(ctx, opts.Logger)
+	recordTypes := opts.RecordTypes
+	if len(recordTypes) == 0 {
+		recordTypes = []string{"A"}
+	}
+	for _, recordType := range recordTypes {
+		if recordType != "A" && recordType != "AAAA" {
+			return nil, fmt.Errorf("unsupported record type %q, must be A or AAAA", recordType)
+		}
+	}
+	switch opts.RecordMode {
+	case "", RecordModeA:
+	case RecordModeCNAME:
+		if opts.DuplicateStrategy == DuplicateMerge {
+			return nil, fmt.Errorf("can't merge devices sharing a name into one CNAME record")
+		}
+		recordTypes = []string{"CNAME"}
+	default:
+		return nil, fmt.Errorf("unknown record mode %q, must be a or cname", opts.RecordMode)
+	}
+	switch opts.DuplicateStrategy {
+	case "", DuplicateLastWins, DuplicateMerge, DuplicateError:
+	default:
+		return nil, fmt.Errorf("unknown duplicate strategy %q, must be merge, error, or last-wins", opts.DuplicateStrategy)
+	}
+	if prefixed := opts.RecordPrefix + "x"; NormalizeName(prefixed) != prefixed {
+		return nil, fmt.Errorf("record prefix %q isn't valid at the start of a DNS name", opts.RecordPrefix)
+	}
+	recordTemplate, err := parseRecordTemplate(opts.RecordTemplate, tailscaleTailnet)
+	if err != nil {
+		return nil, err
+	}
+	protected, err := compileRecordPatterns(opts.Protect)
+	if err != nil {
+		return nil, err
+	}
+	var retried, stillPending []Mutation
+	if !opts.DryRun {
+		retried, stillPending = retryPendingMutations(ctx, dns, cloudflareZone, opts.PendingMutations)
+	}
+	// filter out authorized = false
+	var (
+		name2Addrs   = map[string]map[string][]string{} // record type -> name -> addresses
+		published    = map[string]bool{}
+		unauthorized = map[string]bool{}
+		offline      = map[string]bool{}
+		skipped      = map[string]string{} // name -> why a device isn't published
+		ttls         = map[string]int{}    // name -> TTL override
+	)
+	for _, recordType := range recordTypes {
+		name2Addrs[recordType] = map[string][]string{}
+	}
+	for _, device := range devices {
+		var (
+			name   = device.RecordLabel(tailscaleTailnet, opts.UseHostnames)
+			logger zerolog.Logger
+		)
+		if opts.UseHostnames {
+			logger = loggerFrom(ctx).With().Str("hostname", name).Logger()
+		} else {
+			logger = loggerFrom(ctx).With().Str("machineNmae", name).Logger()
+		}
+		override := opts.Overrides[name]
+		if override.Exclude {
+			logger.Debug().Msg("skipping excluded device")
+			skipped[name] = "device excluded by override"
+			continue
+		}
+		if !opts.Filter.Match(device, name) {
+			logger.Debug().Msg("skipping device that doesn't match filter")
+			skipped[name] = "device excluded by filter"
+			continue
+		}
+		if override.Rename != "" {
+			logger.Debug().Str("rename", override.Rename).Msg("renaming device")
+			skipped[name] = fmt.Sprintf("device renamed to %s", override.Rename)
+			name = override.Rename
+			logger = logger.With().Str("rename", name).Logger()
+		}
+		// the hello device is ignored whatever the template makes of it
+		hello := isHelloDevice(name)
+		if recordTemplate != nil {
+			rendered, err := recordTemplate.render(device, tailscaleTailnet, name)
+			if err != nil {
+				return nil, err
+			}
+			logger.Debug().Str("rendered", rendered).Msg("rendered record template")
+			name = rendered
+		}
+		normalized, err := recordLabel(name, opts.StrictNames)
+		if err != nil {
+			if opts.StrictNames {
+				return nil, err
+			}
+			logger.Warn().Err(err).Msg("skipping device without a usable name")
+			continue
+		}
+		if normalized != name {
+			logger.Info().Str("normalized", normalized).Msg("normalized device name into a valid DNS name")
+			name = normalized
+		}
+		name = opts.RecordPrefix + name
+		// with GroupByUser, name is label.owner
+		var (
+			label = name
+			owner string
+		)
+		if opts.GroupByUser {
+			if owner = device.OwnerLabel(); owner != "" {
+				name = label + "." + owner
+				skipped[label] = fmt.Sprintf("device grouped under its owner as %s", name)
+			}
+		}
+		if !device.Authorized {
+			logger.Info().Msg("skipping unauthorized device")
+			unauthorized[name] = true
+			skipped[name] = "device unauthorized"
+			continue
+		}
+		if hello {
+			continue
+		}
+		if opts.RemoveExpired && device.KeyExpired(time.Now().Add(-opts.ExpiredGrace)) {
+			logger.Info().Time("expires", device.Expires).Msg("skipping device with expired key")
+			skipped[name] = "device key expired"
+			continue
+		}
+		if opts.SkipEphemeral && device.Ephemeral {
+			logger.Debug().Msg("skipping ephemeral device")
+			skipped[name] = "device is ephemeral"
+			continue
+		}
+		if opts.MaxOffline > 0 && device.Offline(time.Now(), opts.MaxOffline) {
+			logger.Info().Time("lastSeen", device.LastSeen).Msg("skipping device that hasn't been seen in a while")
+			skipped[name] = fmt.Sprintf("device not seen since %s", device.LastSeen.Format(time.RFC3339))
+			continue
+		}
+		deviceOffline := opts.OfflineTTL > 0 && device.Offline(time.Now(), opts.OfflineAfter)
+		names := []string{name}
+		if opts.SubnetRouterSuffix != "" {
+			// subnet routers also get a record under the suffixed name, pointing at the router
+			// the suffix goes on the first label, e.g. laptop-subnet.internal with a record template
+			first, rest, _ := strings.Cut(label, ".")
+			subnetName := NormalizeName(first + opts.SubnetRouterSuffix)
+			if rest != "" {
+				subnetName += "." + rest
+			}
+			if owner != "" {
+				subnetName += "." + owner
+			}
+			if len(device.SubnetRoutes()) > 0 {
+				names = append(names, subnetName)
+			} else {
+				skipped[subnetName] = "device serves no approved subnet routes"
+			}
+		}
+		for _, name := range names {
+			// does this happen? probably to someone
+			if published[name] {
+				switch opts.DuplicateStrategy {
+				case DuplicateError:
+					return nil, fmt.Errorf("found multiple tailscale devices named %q", name)
+				case DuplicateMerge:
+					logger.Info().Msg("found multiple tailscale devices with the same name, publishing all of their addresses")
+					for _, recordType := range recordTypes {
+						for _, addr := range recordContents(recordType, device) {
+							if !containsString(name2Addrs[recordType][name], addr) {
+								name2Addrs[recordType][name] = append(name2Addrs[recordType][name], addr)
+							}
+						}
+					}
+					// merged names are only offline once every device is
+					offline[name] = offline[name] && deviceOffline
+					continue
+				default:
+					logger.Warn().Msg("found multiple tailscale devices with the same hostname - the last listed device with this hostname will be used")
+				}
+			}
+			published[name] = true
+			for _, recordType := range recordTypes {
+				name2Addrs[recordType][name] = recordContents(recordType, device)
+			}
+			offline[name] = deviceOffline
+			if override.TTL > 0 {
+				ttls[name] = override.TTL
+			} else {
+				delete(ttls, name)
+			}
+		}
+	}
+	loggerFrom(ctx).Debug().Interface("mapping", name2Addrs).Msg("address mappings")
+	if opts.Proxied {
+		for _, recordType := range recordTypes {
+			for name, contents := range name2Addrs[recordType] {
+				if len(contents) > 0 {
+					return nil, fmt.Errorf("can't proxy %s: %s", name, unproxiable(contents[0]))
+				}
+			}
+		}
+	}
+	// recordTTL is the TTL name's records should have, and whether it's managed at all
+	recordTTL := func(name string) (int, bool) {
+		if ttl, ok := ttls[name]; ok {
+			return ttl, true
+		}
+		if opts.RecordTTL > 0 {
+			return opts.RecordTTL, true
+		}
+		return 1, false
+	}
+	// get cloudflare records, or plan against the last sync's if devices still map to the same names
+	var (
+		records  []Record
+		zoneName string
+	)
+	if opts.Snapshot != nil && !opts.Ownership && len(opts.PendingMutations) == 0 && sameNames(opts.Snapshot.Names, name2Addrs) {
+		loggerFrom(ctx).Debug().Msg("devices unchanged since the last sync, planning against its records")
+		records, zoneName = opts.Snapshot.Records, opts.Snapshot.ZoneName
+	} else {
+		for _, recordType := range recordTypes {
+			typeRecords, err := dns.ListRecords(ctx, cloudflareZone, recordType)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, typeRecords...)
+		}
+		var err error
+		if zoneName, err = zoneNameOf(ctx, dns, cloudflareZone, records); err != nil {
+			return nil, err
+		}
+	}
+	var owners map[string]Record // record name -> ownership record
+	if opts.Ownership {
+		var err error
+		if owners, err = listOwnershipRecords(ctx, dns, cloudflareZone, opts.OwnerID); err != nil {
+			return nil, err
+		}
+	}
+	owned := func(recordName string) bool {
+		_, ok := owners[recordName]
+		return !opts.Ownership || ok
+	}
+	// find out what needs updating and creating
+	var (
+		recordsByName = map[string]map[string][]Record{} // record type -> name -> records
+		recordsByID   = make(map[string]Record, len(records))
+		toUpdate      = map[string][]string{}
+		toCreate      = map[string][]string{}
+		toDelete      = map[string][]string{}
+		toRetune      = map[string]int{}
+		plan          []PlannedChange
+		recordSuffix  string
+	)
+	if cloudflareSubdomain != "" {
+		recordSuffix = fmt.Sprintf("%s.%s", cloudflareSubdomain, zoneName)
+	} else {
+		recordSuffix = zoneName
+	}
+	// compute what needs updating
+	for _, recordType := range recordTypes {
+		recordsByName[recordType] = map[string][]Record{}
+	}
+	for _, record := range records {
+		if recordsByName[record.Type] == nil {
+			// e.g. a snapshot taken with other record types, or a provider listing more than asked for
+			loggerFrom(ctx).Debug().Str("recordName", record.Name).Str("type", record.Type).Msg("ignoring record of an unmanaged type")
+			continue
+		}
+		recordsByName[record.Type][record.Name] = append(recordsByName[record.Type][record.Name], record)
+		recordsByID[record.ID] = record
+		// compute what needs removing
+		if strings.HasSuffix(record.Name, recordSuffix) {
+			stripped := strings.ReplaceAll(record.Name, "."+recordSuffix, "")
+			if !strings.HasPrefix(stripped, opts.RecordPrefix) {
+				// another tailnet's record
+				continue
+			}
+			if !recordTemplate.match(strings.TrimPrefix(stripped, opts.RecordPrefix)) {
+				loggerFrom(ctx).Debug().Str("recordName", record.Name).Msg("keeping record the record template couldn't have rendered")
+				continue
+			}
+			if name2Addrs[record.Type][stripped] == nil {
+				if unauthorized[stripped] && !opts.RemoveUnauthorized {
+					loggerFrom(ctx).Debug().Str("recordName", record.Name).Msg("keeping record for unauthorized device")
+					continue
+				}
+				if !owned(record.Name) {
+					loggerFrom(ctx).Debug().Str("recordName", record.Name).Msg("keeping record without an ownership record")
+					continue
+				}
+				if protected.match(record.Name, stripped) {
+					loggerFrom(ctx).Info().Str("recordName", record.Name).Str("content", record.Content).Msg("record is protected, not deleting it")
+					continue
+				}
+				toDelete[record.Name] = append(toDelete[record.Name], record.ID)
+				reason, ok := skipped[stripped]
+				if !ok {
+					reason = "device removed"
+				}
+				plan = append(plan, PlannedChange{
+					Action:   MutationDelete,
+					Type:     record.Type,
+					Name:     record.Name,
+					Content:  record.Content,
+					RecordID: record.ID,
+					Reason:   reason,
+				})
+			}
+		}
+	}
+	// retune plans switching a record to its configured TTL, or the TTL for its device being offline
+	retune := func(existing Record, hostname string) {
+		// 1 is Cloudflare's automatic TTL
+		ttl, managed := recordTTL(hostname)
+		reason := fmt.Sprintf("TTL changed from %d to %d", existing.TTL, ttl)
+		if opts.OfflineTTL > 0 {
+			managed = true
+			if offline[hostname] {
+				ttl, reason = opts.OfflineTTL, "device offline"
+			} else if existing.TTL == opts.OfflineTTL {
+				reason = "device back online"
+			}
+		}
+		if managed && !sameTTL(dns, existing.TTL, ttl) {
+			toRetune[existing.ID] = ttl
+			plan = append(plan, PlannedChange{
+				Action:   MutationRetune,
+				Type:     existing.Type,
+				Name:     existing.Name,
+				Content:  existing.Content,
+				TTL:      ttl,
+				RecordID: existing.ID,
+				Reason:   reason,
+			})
+		}
+	}
+	for _, recordType := range recordTypes {
+		for hostname, addrs := range name2Addrs[recordType] {
+			if len(addrs) == 0 {
+				continue
+			}
+			recordName := fmt.Sprintf("%s.%s", hostname, recordSuffix)
+			// requires updating
+			if existingRecords := recordsByName[recordType][recordName]; existingRecords != nil {
+				if !owned(recordName) {
+					loggerFrom(ctx).Warn().Str("recordName", recordName).Msg("record exists without an ownership record, leaving it alone")
+					continue
+				}
+				if protected.match(recordName, hostname) {
+					if !sameContents(existingRecords, addrs) {
+						loggerFrom(ctx).Info().Str("recordName", recordName).Strs("contents", addrs).Msg("record is protected, not updating it")
+					}
+					continue
+				}
+				// reconcile the name's records with its addresses as a set, reusing records whose address
+				// went away for addresses that are missing before deleting or creating any
+				var (
+					matched []string
+					stale   []Record
+					missing []string
+				)
+				for _, existing := range existingRecords {
+					if containsString(addrs, existing.Content) && !containsString(matched, existing.Content) {
+						matched = append(matched, existing.Content)
+						retune(existing, hostname)
+						continue
+					}
+					stale = append(stale, existing)
+				}
+				for _, addr := range addrs {
+					if !containsString(matched, addr) {
+						missing = append(missing, addr)
+					}
+				}
+				for len(stale) > 0 && len(missing) > 0 {
+					existing, addr := stale[0], missing[0]
+					stale, missing = stale[1:], missing[1:]
+					toUpdate[existing.ID] = []string{addr}
+					plan = append(plan, PlannedChange{
+						Action:   MutationUpdate,
+						Type:     recordType,
+						Name:     recordName,
+						Content:  addr,
+						Previous: existing.Content,
+						RecordID: existing.ID,
+						Reason:   fmt.Sprintf("%s changed from %s to %s", contentNoun(recordType), existing.Content, addr),
+					})
+					retune(existing, hostname)
+				}
+				for _, existing := range stale {
+					reason := "address no longer used by the device"
+					switch {
+					case containsString(matched, existing.Content):
+						reason = "duplicate record"
+					case opts.DuplicateStrategy == DuplicateMerge:
+						reason = "address no longer used by a device with this name"
+					}
+					toDelete[recordName] = append(toDelete[recordName], existing.ID)
+					plan = append(plan, PlannedChange{
+						Action:   MutationDelete,
+						Type:     recordType,
+						Name:     recordName,
+						Content:  existing.Content,
+						RecordID: existing.ID,
+						Reason:   reason,
+					})
+				}
+				for _, addr := range missing {
+					reason := "new device address"
+					if opts.DuplicateStrategy == DuplicateMerge {
+						reason = "new device address for a shared name"
+					}
+					toCreate[recordName] = append(toCreate[recordName], addr)
+					ttl, _ := recordTTL(hostname)
+					plan = append(plan, PlannedChange{
+						Action:  MutationCreate,
+						Type:    recordType,
+						Name:    recordName,
+						Content: addr,
+						TTL:     ttl,
+						Reason:  reason,
+					})
+				}
+			} else {
+				// requires
+				toCreate[recordName] = append(toCreate[recordName], addrs...)
+				ttl, _ := recordTTL(hostname)
+				for _, addr := range addrs {
+					plan = append(plan, PlannedChange{
+						Action:  MutationCreate,
+						Type:    recordType,
+						Name:    recordName,
+						Content: addr,
+						TTL:     ttl,
+						Reason:  "new device",
+					})
+				}
+			}
+		}
+	}
+	loggerFrom(ctx).Debug().
+		Interface("toUpdate", toUpdate).
+		Interface("toCreate", toCreate).
+		Interface("toDelete", toDelete).
+		Interface("toRetune", toRetune).
+		Msg("queued Cloudflare changes")
+	sort.SliceStable(plan, func(i, j int) bool { return plan[i].Name < plan[j].Name })
+	for _, change := range plan {
+		change.log(loggerFrom(ctx))
+	}
+	loggerFrom(ctx).Info().Int("changes", len(plan)).Msg("planned Cloudflare changes")
+	// update 'em
+	// ...or just leave because it's a dry run!
+	result := &Result{
+		ToCreate: toCreate,
+		ToUpdate: toUpdate,
+		ToDelete: toDelete,
+		ToRetune: toRetune,
+		DryRun:   opts.DryRun,
+		Failed:   stillPending,
+		Devices:  devices,
+		Plan:     plan,
+		applied:  retried,
+	}
+	if opts.DryRun {
+		return result, nil
+	}
+	if deletes := count(toDelete); opts.MaxDeletes > 0 && deletes > opts.MaxDeletes {
+		result.DryRun = true
+		return result, fmt.Errorf("refusing to delete %d records, more than the maximum of %d", deletes, opts.MaxDeletes)
+	}
+	if opts.Confirm != nil && len(plan) > 0 {
+		confirmed, err := opts.Confirm(ctx, result)
+		if err != nil {
+			return nil, fmt.Errorf("error confirming changes: %s", err)
+		}
+		if !confirmed {
+			loggerFrom(ctx).Info().Msg("changes weren't confirmed, leaving the zone as is")
+			result.DryRun = true
+			return result, nil
+		}
+	}
+	// group each name's mutations, so that ownership records follow the records they mark
+	var creates, changes, deletes []mutationGroup
+	for name, addrs := range toCreate {
+		ttl, _ := recordTTL(strings.TrimSuffix(name, "."+recordSuffix))
+		var group mutationGroup
+		for _, addr := range addrs {
+			group.mutations = append(group.mutations, Mutation{Action: MutationCreate, Type: addressRecordType(addr), Name: name, Content: addr, TTL: ttl})
+		}
+		if _, ok := owners[name]; opts.Ownership && !ok {
+			group.ownership = &Mutation{
+				Action:  MutationCreate,
+				Type:    "TXT",
+				Name:    ownershipPrefix + name,
+				Content: ownershipMarker(opts.OwnerID),
+			}
+		}
+		creates = append(creates, group)
+	}
+	// update records, folding in any TTL change
+	for recordID, addrs := range toUpdate {
+		record := recordsByID[recordID]
+		ttl, retune := toRetune[recordID]
+		if !retune {
+			ttl = record.TTL
+		}
+		changes = append(changes, mutationGroup{mutations: []Mutation{{
+			Action:   MutationUpdate,
+			Type:     record.Type,
+			Name:     record.Name,
+			Content:  addrs[0],
+			RecordID: recordID,
+			TTL:      ttl,
+		}}})
+	}
+	// retune TTLs
+	for recordID, ttl := range toRetune {
+		if _, updated := toUpdate[recordID]; updated {
+			continue
+		}
+		record := recordsByID[recordID]
+		changes = append(changes, mutationGroup{mutations: []Mutation{{
+			Action:   MutationRetune,
+			Type:     record.Type,
+			Name:     record.Name,
+			Content:  record.Content,
+			RecordID: recordID,
+			TTL:      ttl,
+		}}})
+	}
+	// delete records
+	for name, recordIDs := range toDelete {
+		var group mutationGroup
+		for _, recordID := range recordIDs {
+			group.mutations = append(group.mutations, Mutation{
+				Action:   MutationDelete,
+				Type:     recordsByID[recordID].Type,
+				Name:     name,
+				Content:  recordsByID[recordID].Content,
+				RecordID: recordID,
+			})
+		}
+		// the ownership record goes once nothing is left under the name
+		if owner, ok := owners[name]; ok && !published[strings.TrimSuffix(name, "."+recordSuffix)] {
+			group.ownership = &Mutation{
+				Action:   MutationDelete,
+				Type:     "TXT",
+				Name:     owner.Name,
+				Content:  owner.Content,
+				RecordID: owner.ID,
+			}
+		}
+		deletes = append(deletes, group)
+	}
+	var firstErr error
+	if batcher, ok := dns.(BatchApplier); ok && opts.BatchSize > 0 {
+		firstErr = result.applyBatches(ctx, batcher, cloudflareZone, opts.BatchSize, creates, changes, deletes)
+	} else {
+		firstErr = result.applyGroups(ctx, dns, cloudflareZone, max(opts.Concurrency, 1), creates, changes, deletes)
+	}
+	if !opts.Ownership && len(result.Failed) == 0 && len(result.Mismatched) == 0 {
+		result.Snapshot = snapshotAfter(zoneName, name2Addrs, records, result.applied[len(retried):])
+	}
+	if len(result.Failed) > 0 {
+		if firstErr != nil {
+			return result, fmt.Errorf("%d Cloudflare record mutations failed, first error: %s", len(result.Failed), firstErr)
+		}
+		return result, fmt.Errorf("%d Cloudflare record mutations failed", len(result.Failed))
+	}
+	return result, nil
+}
+
+// mutationGroup is the mutations to one record name. Its ownership mutation is only applied once all of
+// the others were.
+type mutationGroup struct {
+	mutations []Mutation
+	ownership *Mutation
+}
+
+func (g mutationGroup) len() int {
+	if g.ownership != nil {
+		return len(g.mutations) + 1
+	}
+	return len(g.mutations)
+}
+
+// applyGroups applies each phase's groups, up to concurrency at a time, finishing a phase before
+// starting the next. It returns the first error, if any mutations failed.
+func (r *Result) applyGroups(ctx context.Context, dns DNSProvider, cloudflareZone string, concurrency int, phases ...[]mutationGroup) error {
+	var firstErr error
+	_, rewrites := dns.(recordSetRewriter)
+	for _, phase := range phases {
+		if rewrites {
+			phase = groupByName(phase)
+		}
+		var group errgroup.Group
+		group.SetLimit(concurrency)
+		for _, mutations := range phase {
+			group.Go(func() error {
+				return r.applyGroup(ctx, dns, cloudflareZone, mutations)
+			})
+		}
+		if err := group.Wait(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// autoTTLer is implemented by DNS providers without an automatic TTL, which publish records asked
+// for with Cloudflare's automatic TTL of 1 with a TTL of their own instead.
+type autoTTLer interface {
+	autoTTL() int
+}
+
+// sameTTL reports whether a record with TTL existing already has the TTL wanted, which it does if the
+// provider stands in its own TTL for an automatic one.
+func sameTTL(dns DNSProvider, existing, wanted int) bool {
+	if auto, ok := dns.(autoTTLer); ok && wanted == 1 {
+		return existing == auto.autoTTL()
+	}
+	return existing == wanted
+}
+
+// recordSetRewriter is implemented by DNS providers that apply each mutation by reading and rewriting
+// the whole record set it belongs to, so concurrent mutations to one name would overwrite each other.
+type recordSetRewriter interface {
+	rewritesRecordSets()
+}
+
+// groupByName merges groups with mutations to the same record name, so that they're applied one at a
+// time.
+func groupByName(phase []mutationGroup) []mutationGroup {
+	var (
+		merged  []mutationGroup
+		indexes = map[string]int{}
+	)
+	for _, group := range phase {
+		if len(group.mutations) == 0 {
+			merged = append(merged, group)
+			continue
+		}
+		name := strings.ToLower(group.mutations[0].Name)
+		i, ok := indexes[name]
+		if !ok {
+			indexes[name] = len(merged)
+			merged = append(merged, group)
+			continue
+		}
+		merged[i].mutations = append(merged[i].mutations, group.mutations...)
+		if merged[i].ownership == nil {
+			merged[i].ownership = group.ownership
+		}
+	}
+	return merged
+}
+
+// applyGroup applies a group's mutations one at a time.
+func (r *Result) applyGroup(ctx context.Context, dns DNSProvider, cloudflareZone string, group mutationGroup) error {
+	var errs []error
+	for _, mutation := range group.mutations {
+		if err := r.apply(ctx, dns, cloudflareZone, mutation); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 0 && group.ownership != nil {
+		errs = append(errs, r.apply(ctx, dns, cloudflareZone, *group.ownership))
+	}
+	return errors.Join(errs...)
+}
+
+// apply performs a planned mutation, tracking whether it was applied, failed, or mismatched. It's safe
+// to call concurrently, and returns the error that failed the mutation.
+func (r *Result) apply(ctx context.Context, dns DNSProvider, cloudflareZone string, mutation Mutation) error {
+	mutation.Zone = cloudflareZone
+	record, err := dns.Apply(ctx, cloudflareZone, mutation)
+	return r.track(ctx, mutation, record, err)
+}
+
+// track records the outcome of applying mutation, returning err with context.
+func (r *Result) track(ctx context.Context, mutation Mutation, record *Record, err error) error {
+	logger := loggerFrom(ctx).With().
+		Str("action", string(mutation.Action)).
+		Str("name", mutation.Name).
+		Str("content", mutation.Content).
+		Str("recordID", mutation.RecordID).
+		Logger()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		logger.Warn().Err(err).Msg("error applying record mutation, queueing for retry")
+		r.Failed = append(r.Failed, mutation)
+		return fmt.Errorf("error applying %s of %s: %s", mutation.Action, mutation.Name, err)
+	}
+	if err := verifyMutation(mutation, record); err != nil {
+		logger.Warn().Err(err).Msg("record doesn't match what was requested")
+		r.Mismatched = append(r.Mismatched, mutation)
+	}
+	if record != nil && mutation.RecordID == "" {
+		mutation.RecordID = record.ID
+	}
+	r.applied = append(r.applied, mutation)
+	return nil
+}
+
+func v4Addresses(addrs []string) []string {
+	return recordAddresses("A", addrs)
+}
+
+// recordAddresses picks out the addresses an A or AAAA record would hold.
+func recordAddresses(recordType string, addrs []string) []string {
+	var matching []string
+	for _, addr := range addrs {
+		parsed, err := netaddr.ParseIP(addr)
+		if err != nil {
+			// Tailscale only hands out IPs, so there's nothing to publish
+			continue
+		}
+		if parsed.Is4() && recordType == "A" || parsed.Is6() && recordType == "AAAA" {
+			matching = append(matching, addr)
+		}
+	}
+	return matching
+}
+
+// zoneNameOf looks up the zone's name if dns can, or takes it from one of the zone's records.
+func zoneNameOf(ctx context.Context, dns DNSProvider, zone string, records []Record) (string, error) {
+	var lookupErr error
+	if namer, ok := dns.(ZoneNamer); ok {
+		zoneName, err := namer.ZoneName(ctx, zone)
+		if err == nil {
+			return zoneName, nil
+		}
+		lookupErr = err
+	}
+	if len(records) == 0 || records[0].ZoneName == "" {
+		if lookupErr != nil {
+			return "", lookupErr
+		}
+		return "", fmt.Errorf("zone %s has no records to tell its name from, and the DNS provider can't look it up", zone)
+	}
+	if lookupErr != nil {
+		// e.g. a token without Zone:Read, which used to be enough
+		loggerFrom(ctx).Warn().Err(lookupErr).Msg("error looking up zone name, taking it from an existing record")
+	}
+	return records[0].ZoneName, nil
+}
+
+// sameContents reports whether records hold exactly contents, in any order.
+func sameContents(records []Record, contents []string) bool {
+	if len(records) != len(contents) {
+		return false
+	}
+	for _, content := range contents {
+		if !hasRecordContent(records, content) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func hasRecordContent(records []Record, content string) bool {
+	for _, record := range records {
+		if record.Content == content {
+			return true
+		}
+	}
+	return false
+}
+
+// recordContents is what device's records of recordType hold: its addresses, or for CNAME records its
+// MagicDNS name.
+func recordContents(recordType string, device Device) []string {
+	if recordType == "CNAME" {
+		return []string{strings.ToLower(strings.TrimSuffix(device.Name, "."))}
+	}
+	return recordAddresses(recordType, device.Addresses)
+}
+
+// contentNoun is what records of recordType hold, for plan reasons.
+func contentNoun(recordType string) string {
+	if recordType == "CNAME" {
+		return "target"
+	}
+	return "IP"
+}
+
+// addressRecordType is the record type for addr, which is a CNAME target if it isn't an IP address.
+func addressRecordType(addr string) string {
+	if strings.Contains(addr, ":") {
+		return "AAAA"
+	}
+	if _, err := netaddr.ParseIP(addr); err != nil {
+		return "CNAME"
+	}
+	return "A"
+}
+
+// sharedAddressSpace is RFC 6598's carrier-grade NAT range, which Tailscale IPv4 addresses come from.
+var sharedAddressSpace = netaddr.MustParseIPPrefix("100.64.0.0/10")
+
+// unproxiable explains why Cloudflare can't proxy to a record's content.
+func unproxiable(content string) string {
+	ip, err := netaddr.ParseIP(content)
+	switch {
+	case err != nil:
+		return fmt.Sprintf("%s is a MagicDNS name, which only resolves inside the tailnet", content)
+	case sharedAddressSpace.Contains(ip):
+		return fmt.Sprintf("%s is in 100.64.0.0/10, RFC 6598 shared address space that Cloudflare can't reach", content)
+	default:
+		return fmt.Sprintf("%s is a Tailscale address, which is only reachable inside the tailnet", content)
+	}
+}
@@ -0,0 +1,244 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func aRecord(id, name, content string, ttl int) Record {
+	return Record{ID: id, Type: "A", Name: name, Content: content, TTL: ttl, ZoneName: "example.com"}
+}
+
+// planned lists a result's changes as "create name content", "update recordID content",
+// "delete name recordID", and "retune recordID ttl", sorted.
+func planned(result *Result) []string {
+	var changes []string
+	for name, contents := range result.ToCreate {
+		for _, content := range contents {
+			changes = append(changes, fmt.Sprintf("create %s %s", name, content))
+		}
+	}
+	for recordID, contents := range result.ToUpdate {
+		changes = append(changes, fmt.Sprintf("update %s %s", recordID, contents[0]))
+	}
+	for name, recordIDs := range result.ToDelete {
+		for _, recordID := range recordIDs {
+			changes = append(changes, fmt.Sprintf("delete %s %s", name, recordID))
+		}
+	}
+	for recordID, ttl := range result.ToRetune {
+		changes = append(changes, fmt.Sprintf("retune %s %d", recordID, ttl))
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+func ownershipRecord(id, name string) Record {
+	return Record{ID: id, Type: "TXT", Name: ownershipPrefix + name, Content: ownershipMarker(""), TTL: 1, ZoneName: "example.com"}
+}
+
+func TestSync(t *testing.T) {
+	var (
+		laptop = Device{Name: "laptop.t", Addresses: []string{"100.64.0.1", "fd7a:115c:a1e0::1"}, Authorized: true}
+		server = Device{Name: "server.t", Addresses: []string{"100.64.0.2"}, Authorized: true}
+		// www keeps the zone from being empty, and is outside the subdomain
+		www = aRecord("www", "www.example.com", "192.0.2.1", 1)
+	)
+	offlineLaptop := laptop
+	offlineLaptop.LastSeen = time.Now().Add(-2 * time.Hour)
+	tests := []struct {
+		name        string
+		devices     []Device
+		records     []Record
+		opts        Tailscale2CloudflareOptions
+		wantPlan    []string
+		wantRecords []string
+	}{
+		{
+			name:     "create",
+			devices:  []Device{laptop, server},
+			records:  []Record{www},
+			wantPlan: []string{"create laptop.ts.example.com 100.64.0.1", "create server.ts.example.com 100.64.0.2"},
+			wantRecords: []string{
+				"A laptop.ts.example.com 100.64.0.1 1",
+				"A server.ts.example.com 100.64.0.2 1",
+				"A www.example.com 192.0.2.1 1",
+			},
+		},
+		{
+			name:        "unchanged",
+			devices:     []Device{laptop},
+			records:     []Record{www, aRecord("r1", "laptop.ts.example.com", "100.64.0.1", 1)},
+			wantRecords: []string{"A laptop.ts.example.com 100.64.0.1 1", "A www.example.com 192.0.2.1 1"},
+		},
+		{
+			name:        "update",
+			devices:     []Device{laptop},
+			records:     []Record{www, aRecord("r1", "laptop.ts.example.com", "100.64.0.9", 1)},
+			wantPlan:    []string{"update r1 100.64.0.1"},
+			wantRecords: []string{"A laptop.ts.example.com 100.64.0.1 1", "A www.example.com 192.0.2.1 1"},
+		},
+		{
+			name:    "delete",
+			devices: []Device{laptop},
+			records: []Record{
+				www,
+				aRecord("r1", "laptop.ts.example.com", "100.64.0.1", 1),
+				aRecord("r2", "gone.ts.example.com", "100.64.0.3", 1),
+			},
+			wantPlan:    []string{"delete gone.ts.example.com r2"},
+			wantRecords: []string{"A laptop.ts.example.com 100.64.0.1 1", "A www.example.com 192.0.2.1 1"},
+		},
+		{
+			name:    "unauthorized",
+			devices: []Device{{Name: "laptop.t", Addresses: []string{"100.64.0.1"}}},
+			records: []Record{www, aRecord("r1", "laptop.ts.example.com", "100.64.0.1", 1)},
+			wantRecords: []string{
+				"A laptop.ts.example.com 100.64.0.1 1",
+				"A www.example.com 192.0.2.1 1",
+			},
+		},
+		{
+			name:    "remove unauthorized",
+			devices: []Device{{Name: "laptop.t", Addresses: []string{"100.64.0.1"}}},
+			records: []Record{www, aRecord("r1", "laptop.ts.example.com", "100.64.0.1", 1)},
+			opts:    Tailscale2CloudflareOptions{RemoveUnauthorized: true},
+			wantPlan: []string{
+				"delete laptop.ts.example.com r1",
+			},
+			wantRecords: []string{"A www.example.com 192.0.2.1 1"},
+		},
+		{
+			name:     "dry run",
+			devices:  []Device{laptop},
+			records:  []Record{www, aRecord("r2", "gone.ts.example.com", "100.64.0.3", 1)},
+			opts:     Tailscale2CloudflareOptions{DryRun: true},
+			wantPlan: []string{"create laptop.ts.example.com 100.64.0.1", "delete gone.ts.example.com r2"},
+			wantRecords: []string{
+				"A gone.ts.example.com 100.64.0.3 1",
+				"A www.example.com 192.0.2.1 1",
+			},
+		},
+		{
+			name:        "retune offline device",
+			devices:     []Device{offlineLaptop},
+			records:     []Record{www, aRecord("r1", "laptop.ts.example.com", "100.64.0.1", 1)},
+			opts:        Tailscale2CloudflareOptions{OfflineTTL: 300, OfflineAfter: time.Hour},
+			wantPlan:    []string{"retune r1 300"},
+			wantRecords: []string{"A laptop.ts.example.com 100.64.0.1 300", "A www.example.com 192.0.2.1 1"},
+		},
+		{
+			name:        "retune back online",
+			devices:     []Device{laptop},
+			records:     []Record{www, aRecord("r1", "laptop.ts.example.com", "100.64.0.1", 300)},
+			opts:        Tailscale2CloudflareOptions{OfflineTTL: 300, OfflineAfter: time.Hour},
+			wantPlan:    []string{"retune r1 1"},
+			wantRecords: []string{"A laptop.ts.example.com 100.64.0.1 1", "A www.example.com 192.0.2.1 1"},
+		},
+		{
+			name:     "update offline device",
+			devices:  []Device{offlineLaptop},
+			records:  []Record{www, aRecord("r1", "laptop.ts.example.com", "100.64.0.9", 1)},
+			opts:     Tailscale2CloudflareOptions{OfflineTTL: 300, OfflineAfter: time.Hour},
+			wantPlan: []string{"retune r1 300", "update r1 100.64.0.1"},
+			wantRecords: []string{
+				"A laptop.ts.example.com 100.64.0.1 300",
+				"A www.example.com 192.0.2.1 1",
+			},
+		},
+		{
+			name:     "AAAA",
+			devices:  []Device{laptop},
+			records:  []Record{www},
+			opts:     Tailscale2CloudflareOptions{RecordTypes: []string{"A", "AAAA"}},
+			wantPlan: []string{"create laptop.ts.example.com 100.64.0.1", "create laptop.ts.example.com fd7a:115c:a1e0::1"},
+			wantRecords: []string{
+				"A laptop.ts.example.com 100.64.0.1 1",
+				"A www.example.com 192.0.2.1 1",
+				"AAAA laptop.ts.example.com fd7a:115c:a1e0::1 1",
+			},
+		},
+		{
+			name:        "empty zone",
+			devices:     []Device{laptop},
+			wantPlan:    []string{"create laptop.ts.example.com 100.64.0.1"},
+			wantRecords: []string{"A laptop.ts.example.com 100.64.0.1 1"},
+		},
+		{
+			name:    "duplicate record",
+			devices: []Device{laptop},
+			records: []Record{
+				aRecord("r1", "laptop.ts.example.com", "100.64.0.1", 1),
+				aRecord("r2", "laptop.ts.example.com", "100.64.0.1", 1),
+			},
+			wantPlan:    []string{"delete laptop.ts.example.com r2"},
+			wantRecords: []string{"A laptop.ts.example.com 100.64.0.1 1"},
+		},
+		{
+			name:     "record TTL",
+			devices:  []Device{laptop, server},
+			records:  []Record{aRecord("r1", "laptop.ts.example.com", "100.64.0.9", 1)},
+			opts:     Tailscale2CloudflareOptions{RecordTTL: 120},
+			wantPlan: []string{"create server.ts.example.com 100.64.0.2", "retune r1 120", "update r1 100.64.0.1"},
+			wantRecords: []string{
+				"A laptop.ts.example.com 100.64.0.1 120",
+				"A server.ts.example.com 100.64.0.2 120",
+			},
+		},
+		{
+			name:    "prefix",
+			devices: []Device{laptop},
+			records: []Record{
+				aRecord("r1", "a-gone.ts.example.com", "100.64.0.3", 1),
+				aRecord("r2", "b-other.ts.example.com", "100.64.0.4", 1),
+			},
+			opts:     Tailscale2CloudflareOptions{RecordPrefix: "a-"},
+			wantPlan: []string{"create a-laptop.ts.example.com 100.64.0.1", "delete a-gone.ts.example.com r1"},
+			wantRecords: []string{
+				"A a-laptop.ts.example.com 100.64.0.1 1",
+				"A b-other.ts.example.com 100.64.0.4 1",
+			},
+		},
+		{
+			name:    "ownership",
+			devices: []Device{laptop, server},
+			records: []Record{
+				aRecord("r1", "owned.ts.example.com", "100.64.0.3", 1),
+				ownershipRecord("t1", "owned.ts.example.com"),
+				aRecord("r2", "unowned.ts.example.com", "100.64.0.4", 1),
+				aRecord("r3", "server.ts.example.com", "100.64.0.9", 1),
+			},
+			opts:     Tailscale2CloudflareOptions{Ownership: true},
+			wantPlan: []string{"create laptop.ts.example.com 100.64.0.1", "delete owned.ts.example.com r1"},
+			wantRecords: []string{
+				"A laptop.ts.example.com 100.64.0.1 1",
+				"A server.ts.example.com 100.64.0.9 1",
+				"A unowned.ts.example.com 100.64.0.4 1",
+				"TXT _tailscale2cloudflare.laptop.ts.example.com managed-by=tailscale2cloudflare,owner=default 1",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				tailscale  = &fakeTailscale{tailnet: "t", devices: test.devices}
+				cloudflare = &fakeCloudflare{zone: "z", zoneName: "example.com", records: test.records}
+			)
+			opts := serveFakeAPIs(t, tailscale, cloudflare).options(test.opts)
+			result, err := Tailscale2Cloudflare(context.Background(), "key", "t", "token", "z", "ts", opts)
+			if err != nil {
+				t.Fatalf("error syncing: %s", err)
+			}
+			if plan := planned(result); !reflect.DeepEqual(plan, test.wantPlan) {
+				t.Errorf("plan = %q, want %q", plan, test.wantPlan)
+			}
+			if records := cloudflare.dump(); !reflect.DeepEqual(records, test.wantRecords) {
+				t.Errorf("records = %q, want %q", records, test.wantRecords)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// TailscaleClient lists a tailnet's devices.
+type TailscaleClient interface {
+	ListDevices(ctx context.Context, tailnet string) ([]Device, error)
+}
+
+// DNSProvider lists and changes a zone's DNS records.
+type DNSProvider interface {
+	// ListRecords lists the zone's records of recordType that a sync may manage.
+	ListRecords(ctx context.Context, zone, recordType string) ([]Record, error)
+	// Apply performs a mutation, returning the record as stored when the provider reports one.
+	Apply(ctx context.Context, zone string, mutation Mutation) (*Record, error)
+}
+
+// ZoneNamer is implemented by DNSProviders that can look up a zone's name, e.g. example.com. Syncs
+// through providers that don't take the name from one of the zone's existing records, so those zones
+// can't be empty.
+type ZoneNamer interface {
+	ZoneName(ctx context.Context, zone string) (string, error)
+}
+
+// Syncer reconciles a tailnet's devices with a zone's records through the given clients, e.g. to
+// use another DNS provider or fakes. Options may be nil.
+type Syncer struct {
+	Tailscale TailscaleClient
+	DNS       DNSProvider
+	Options   *Tailscale2CloudflareOptions
+}
+
+// Tailscale2Cloudflare syncs A (and optionally AAAA) records named
+// ${machineName}.${cloudflareSubdomain}.${zone} with the Tailscale addresses of each authorized device
+// in the tailnet, deleting records under the subdomain for devices that no longer exist. A blank
+// cloudflareSubdomain manages the zone apex. opts may be nil.
+//
+// Every API request is made with ctx, so canceling it or letting its deadline pass abandons the sync.
+// Mutations cut short this way are returned as failed, to be retried as PendingMutations.
+//
+// The returned Result may be non-nil alongside an error when some record mutations failed.
+func Tailscale2Cloudflare(ctx context.Context, tailscaleKey, tailscaleTailnet, cloudflareToken, cloudflareZone, cloudflareSubdomain string, opts *Tailscale2CloudflareOptions) (*Result, error) {
+	return newSyncer(tailscaleKey, cloudflareToken, opts).Sync(ctx, tailscaleTailnet, cloudflareZone, cloudflareSubdomain)
+}
+
+// Sync is Tailscale2Cloudflare with the Syncer's clients.
+func (s *Syncer) Sync(ctx context.Context, tailnet, zone, subdomain string) (*Result, error) {
+	ctx = withLogger(ctx, s.options().Logger)
+	devices, err := s.Tailscale.ListDevices(ctx, tailnet)
+	if err != nil {
+		return nil, err
+	}
+	return syncDevices(ctx, devices, tailnet, s.DNS, zone, subdomain, s.options())
+}
+
+// Target is a zone and subdomain to publish some of a tailnet's devices under.
+type Target struct {
+	Zone      string
+	Subdomain string
+	Filter    DeviceFilter
+}
+
+// SyncAll lists the tailnet's devices once and syncs each target like Tailscale2Cloudflare, only
+// publishing the devices that match its filter. opts.Filter is ignored in favor of each target's.
+// Targets sharing a zone and subdomain would delete each other's records, so give each its own.
+//
+// Every target is synced even if some fail, and the returned Result combines the ones that could be.
+func SyncAll(ctx context.Context, tailscaleKey, tailscaleTailnet, cloudflareToken string, targets []Target, opts *Tailscale2CloudflareOptions) (*Result, error) {
+	return newSyncer(tailscaleKey, cloudflareToken, opts).SyncAll(ctx, tailscaleTailnet, targets)
+}
+
+// SyncAll is the package-level SyncAll with the Syncer's clients.
+func (s *Syncer) SyncAll(ctx context.Context, tailnet string, targets []Target) (*Result, error) {
+	opts := s.options()
+	ctx = withLogger(ctx, opts.Logger)
+	devices, err := s.Tailscale.ListDevices(ctx, tailnet)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		results = make([]*Result, 0, len(targets))
+		errs    []error
+	)
+	for _, target := range targets {
+		targetOpts := *opts
+		targetOpts.Filter = target.Filter
+		targetOpts.PendingMutations = nil
+		for _, mutation := range opts.PendingMutations {
+			if mutation.Zone == target.Zone || mutation.Zone == "" && len(targets) == 1 {
+				targetOpts.PendingMutations = append(targetOpts.PendingMutations, mutation)
+			}
+		}
+		result, err := syncDevices(ctx, devices, tailnet, s.DNS, target.Zone, target.Subdomain, &targetOpts)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s/%s: %s", target.Zone, target.Subdomain, err))
+		}
+		results = append(results, result)
+	}
+	merged := MergeResults(results...)
+	merged.Devices = devices
+	return merged, errors.Join(errs...)
+}
+
+// newSyncer returns a Syncer using the Tailscale and Cloudflare APIs as opts says to.
+func newSyncer(tailscaleKey, cloudflareToken string, opts *Tailscale2CloudflareOptions) *Syncer {
+	syncer := &Syncer{Options: opts}
+	opts = syncer.options()
+	syncer.Tailscale = &TailscaleAPI{Key: tailscaleKey, BaseURL: opts.TailscaleBaseURL, HTTPClient: opts.HTTPClient}
+	syncer.DNS = &Cloudflare{Token: cloudflareToken, BaseURL: opts.CloudflareBaseURL, HTTPClient: opts.HTTPClient}
+	return syncer
+}
+
+func (s *Syncer) options() *Tailscale2CloudflareOptions {
+	if s.Options == nil {
+		return &Tailscale2CloudflareOptions{}
+	}
+	return s.Options
+}
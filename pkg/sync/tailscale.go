@@ -0,0 +1,229 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type tailnetDevicesResponse struct {
+	Devices []Device
+	// NextCursor is set on paginated responses that have more devices
+	NextCursor string
+}
+
+// maxDevicePages guards against a server that keeps handing out the same next page.
+const maxDevicePages = 1000
+
+// Device is a tailnet device as returned by the Tailscale API.
+// https://github.com/tailscale/tailscale/blob/main/api.md#tailnet-devices-get
+type Device struct {
+	// there are other fields, but we only care about
+	Name       string
+	Hostname   string
+	Addresses  []string
+	Authorized bool
+	Tags       []string
+	// User is the owner's login name, e.g. alice@example.com
+	User string
+	// OS is the device's operating system, e.g. linux, macOS, windows, iOS, or android
+	OS string
+	// ClientVersion is the version of Tailscale the device runs, e.g. 1.76.1-t1234abcd
+	ClientVersion string
+	// Expires is when the node key expires, unless KeyExpiryDisabled
+	Expires           time.Time
+	KeyExpiryDisabled bool
+	// Ephemeral devices, e.g. CI runners and containers, are removed from the tailnet once they go
+	// offline
+	Ephemeral bool `json:"isEphemeral"`
+	LastSeen  time.Time
+	// subnet routes the device advertises, and the ones an admin approved
+	AdvertisedRoutes []string
+	EnabledRoutes    []string
+}
+
+// TailscaleAPI is the TailscaleClient for the Tailscale API, authenticating with an API key or OAuth
+// access token.
+type TailscaleAPI struct {
+	Key string
+	// BaseURL replaces https://api.tailscale.com, e.g. to go through an egress proxy or to a mock
+	// server.
+	BaseURL string
+	// HTTPClient makes the API requests. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// url returns the API URL for path, e.g. "/api/v2/tailnet/example.com/devices".
+func (t *TailscaleAPI) url(path string) string {
+	return apiURL(t.BaseURL, defaultTailscaleBaseURL, path)
+}
+
+// do makes an API request with the key.
+func (t *TailscaleAPI) do(request *http.Request) (*http.Response, error) {
+	request.SetBasicAuth(t.Key, "")
+	return clientOrDefault(t.HTTPClient).Do(request)
+}
+
+// ListDevices GETs every device in the tailnet with the public API, like TailscaleAPI.ListDevices.
+func ListDevices(ctx context.Context, tailscaleKey, tailscaleTailnet string) ([]Device, error) {
+	return (&TailscaleAPI{Key: tailscaleKey}).ListDevices(ctx, tailscaleTailnet)
+}
+
+// ListDevices GETs every device in the tailnet, following pagination if the API paginates, either
+// via a Link: <...>; rel="next" header or a nextCursor field.
+func (t *TailscaleAPI) ListDevices(ctx context.Context, tailscaleTailnet string) ([]Device, error) {
+	var (
+		devices    []Device
+		devicesURL = t.url(fmt.Sprintf(
+			"/api/v2/tailnet/%s/devices?fields=all",
+			tailscaleTailnet,
+		))
+		seen = map[string]bool{}
+	)
+	for page := 0; devicesURL != ""; page++ {
+		if page == maxDevicePages || seen[devicesURL] {
+			return nil, fmt.Errorf("Tailscale devices GET pagination didn't terminate after %d pages", page)
+		}
+		seen[devicesURL] = true
+		pageDevices, nextURL, err := t.listDevicesPage(ctx, devicesURL)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, pageDevices...)
+		devicesURL = nextURL
+	}
+	loggerFrom(ctx).Debug().Interface("devices", devices).Msg("GET devices")
+	return devices, nil
+}
+
+// listDevicesPage GETs a page of devices, returning the next page's URL if there is one.
+func (t *TailscaleAPI) listDevicesPage(ctx context.Context, devicesURL string) ([]Device, string, error) {
+	request, _ := http.NewRequestWithContext(ctx, "GET", devicesURL, nil)
+	response, err := t.do(request)
+	if err != nil {
+		return nil, "", fmt.Errorf("error performing Tailscale devices GET: %s", err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("error reading Tailscale devices GET body: %s", err)
+	}
+	if response.StatusCode > 200 {
+		return nil, "", fmt.Errorf("non-200 response to Tailscale devices GET: %d: %s", response.StatusCode, body)
+	}
+	loggerFrom(ctx).Debug().Interface("body", json.RawMessage(body)).Msg("GET devices")
+	var devicesResponse tailnetDevicesResponse
+	if err := json.Unmarshal(body, &devicesResponse); err != nil {
+		return nil, "", fmt.Errorf("error unmarshalling Tailscale devices GET as JSON: %s", err)
+	}
+	if next := nextLink(response.Header); next != "" {
+		resolved, err := response.Request.URL.Parse(next)
+		if err != nil {
+			return nil, "", fmt.Errorf("error parsing Tailscale devices GET next link: %s", err)
+		}
+		return devicesResponse.Devices, resolved.String(), nil
+	}
+	if devicesResponse.NextCursor != "" {
+		nextURL := *response.Request.URL
+		query := nextURL.Query()
+		query.Set("cursor", devicesResponse.NextCursor)
+		nextURL.RawQuery = query.Encode()
+		return devicesResponse.Devices, nextURL.String(), nil
+	}
+	return devicesResponse.Devices, "", nil
+}
+
+// nextLink finds the rel="next" target in RFC 8288 Link headers.
+func nextLink(header http.Header) string {
+	for _, value := range header.Values("Link") {
+		for _, link := range strings.Split(value, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, param := range parts[1:] {
+				param = strings.ReplaceAll(strings.TrimSpace(param), `"`, "")
+				if strings.EqualFold(param, "rel=next") {
+					return strings.Trim(target, "<>")
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// RecordLabel is the name a device is published under: its machine name, or with useHostnames its
+// OS hostname.
+func (d Device) RecordLabel(tailscaleTailnet string, useHostnames bool) string {
+	if useHostnames {
+		return d.Hostname
+	}
+	// the Name field is formatted as "[machineName].[tailnet]"
+	return strings.Replace(d.Name, "."+tailscaleTailnet, "", 1)
+}
+
+// KeyExpired reports whether the device's node key had expired as of at.
+func (d Device) KeyExpired(at time.Time) bool {
+	return !d.KeyExpiryDisabled && !d.Expires.IsZero() && at.After(d.Expires)
+}
+
+// Offline reports whether the device hadn't been seen for longer than after as of at.
+func (d Device) Offline(at time.Time, after time.Duration) bool {
+	return !d.LastSeen.IsZero() && at.Sub(d.LastSeen) > after
+}
+
+// OwnerLabel returns a DNS label for the device's owner: the part of their login name before the @,
+// normalized, or "" if the device has no owner.
+func (d Device) OwnerLabel() string {
+	login, _, _ := strings.Cut(d.User, "@")
+	return NormalizeName(strings.ReplaceAll(login, ".", "-"))
+}
+
+// SubnetRoutes returns the approved subnet routes the device serves, leaving out exit node routes.
+func (d Device) SubnetRoutes() []string {
+	var routes []string
+	for _, route := range d.EnabledRoutes {
+		if route != "0.0.0.0/0" && route != "::/0" {
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
+
+// IPv4s returns the device's Tailscale IPv4 addresses.
+func (d Device) IPv4s() []string {
+	return v4Addresses(d.Addresses)
+}
+
+// IPv6s returns the device's Tailscale IPv6 addresses.
+func (d Device) IPv6s() []string {
+	return recordAddresses("AAAA", d.Addresses)
+}
+
+// PublishedDevices maps record labels to the authorized devices a sync would publish. Like the sync,
+// the last listed device wins when labels collide.
+func PublishedDevices(devices []Device, tailscaleTailnet string, useHostnames bool) map[string]Device {
+	published := map[string]Device{}
+	for _, device := range devices {
+		label := NormalizeName(device.RecordLabel(tailscaleTailnet, useHostnames))
+		if !device.Authorized || label == "" || isHelloDevice(label) {
+			continue
+		}
+		published[label] = device
+	}
+	return published
+}
+
+// juuust ignore these ones
+func isHelloDevice(name string) bool {
+	switch name {
+	case "hello.ipn.dev", "hello.tailscale.com":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package sync
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestListDevices(t *testing.T) {
+	var devices []Device
+	for i := 1; i <= 5; i++ {
+		devices = append(devices, Device{Name: fmt.Sprintf("device%d.t", i), Addresses: []string{fmt.Sprintf("100.64.0.%d", i)}, Authorized: true})
+	}
+	tests := []struct {
+		name      string
+		perPage   int
+		link      bool
+		wantPages int
+	}{
+		{name: "unpaginated", wantPages: 1},
+		{name: "next cursor", perPage: 2, wantPages: 3},
+		{name: "link header", perPage: 2, link: true, wantPages: 3},
+		{name: "exact pages", perPage: 5, link: true, wantPages: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tailscale := &fakeTailscale{tailnet: "t", devices: devices, perPage: test.perPage, link: test.link}
+			listed, err := serveFakeAPIs(t, tailscale, nil).tailscale().ListDevices(quietContext(), "t")
+			if err != nil {
+				t.Fatalf("error listing devices: %s", err)
+			}
+			if !reflect.DeepEqual(listed, devices) {
+				t.Errorf("listed %v, want %v", listed, devices)
+			}
+			if tailscale.pages != test.wantPages {
+				t.Errorf("served %d pages, want %d", tailscale.pages, test.wantPages)
+			}
+		})
+	}
+}
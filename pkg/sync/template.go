@@ -0,0 +1,98 @@
+package sync
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// RecordTemplateData is what RecordTemplate is executed with for each device.
+type RecordTemplateData struct {
+	// Label is the name the device would otherwise be published under: its machine name, or its
+	// hostname with UseHostnames, after any DeviceOverride.Rename.
+	Label       string
+	MachineName string
+	Hostname    string
+	Tailnet     string
+	// User is the owner's login name, e.g. alice@example.com, and Owner the part before the @ as a
+	// DNS label, e.g. alice.
+	User  string
+	Owner string
+	OS    string
+	Tags  []string
+}
+
+// wildcard stands in for device fields when working out which names a template can render.
+const wildcard = "\x00"
+
+// recordTemplate renders record labels from a RecordTemplate.
+type recordTemplate struct {
+	template *template.Template
+	// glob matches every label the template renders, so records it couldn't have are left alone
+	glob string
+}
+
+func parseRecordTemplate(text, tailscaleTailnet string) (*recordTemplate, error) {
+	if text == "" {
+		return nil, nil
+	}
+	parsed, err := template.New("record").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing record template %q: %s", text, err)
+	}
+	t := &recordTemplate{template: parsed}
+	rendered, err := t.execute(RecordTemplateData{
+		Label:       wildcard,
+		MachineName: wildcard,
+		Hostname:    wildcard,
+		Tailnet:     tailscaleTailnet,
+		User:        wildcard,
+		Owner:       wildcard,
+		OS:          wildcard,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(rendered, wildcard) {
+		return nil, fmt.Errorf("record template %q renders the same name for every device", text)
+	}
+	// check the template's own text is usable in DNS names, with the device fields as a valid label
+	if sample := strings.ReplaceAll(rendered, wildcard, "x"); NormalizeName(sample) != sample {
+		return nil, fmt.Errorf("record template %q doesn't render valid DNS names, e.g. %q", text, sample)
+	}
+	t.glob = strings.ReplaceAll(rendered, wildcard, "*")
+	return t, nil
+}
+
+func (t *recordTemplate) execute(data RecordTemplateData) (string, error) {
+	var rendered strings.Builder
+	if err := t.template.Execute(&rendered, data); err != nil {
+		return "", fmt.Errorf("error executing record template: %s", err)
+	}
+	return rendered.String(), nil
+}
+
+// render returns the record label for device, published as label.
+func (t *recordTemplate) render(device Device, tailscaleTailnet, label string) (string, error) {
+	return t.execute(RecordTemplateData{
+		Label:       label,
+		MachineName: device.RecordLabel(tailscaleTailnet, false),
+		Hostname:    device.Hostname,
+		Tailnet:     tailscaleTailnet,
+		User:        device.User,
+		Owner:       device.OwnerLabel(),
+		OS:          device.OS,
+		Tags:        device.Tags,
+	})
+}
+
+// match reports whether the template could have rendered label. Without a template, every label
+// matches.
+func (t *recordTemplate) match(label string) bool {
+	if t == nil {
+		return true
+	}
+	matched, _ := path.Match(t.glob, label)
+	return matched
+}
@@ -0,0 +1,120 @@
+// Package trigger coalesces bursts of sync triggers, e.g. from webhooks, so that a flurry of device
+// events turns into one reconciliation instead of many overlapping ones.
+package trigger
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// maxDebounces bounds how many triggers in a row can put off a run, so that a steady stream of them
+// still gets synced.
+const maxDebounces = 10
+
+// Coalescer calls Run after triggers stop arriving for Debounce, and never sooner than MinInterval
+// after the previous run started. Runs never overlap; triggers that arrive during a run cause one more
+// run afterwards.
+type Coalescer struct {
+	Debounce    time.Duration
+	MinInterval time.Duration
+	Run         func()
+	// Logger receives the Coalescer's logs. Defaults to zerolog's global logger.
+	Logger *zerolog.Logger
+
+	requests chan struct{}
+}
+
+// New returns a Coalescer. Call Serve to start handling triggers.
+func New(debounce, minInterval time.Duration, run func()) *Coalescer {
+	return &Coalescer{
+		Debounce:    debounce,
+		MinInterval: minInterval,
+		Run:         run,
+		requests:    make(chan struct{}, 1),
+	}
+}
+
+// Trigger requests a run. It never blocks.
+func (c *Coalescer) Trigger() {
+	select {
+	case c.requests <- struct{}{}:
+	default:
+		// a run is already pending
+	}
+}
+
+// Serve runs Run as triggered until ctx is done.
+func (c *Coalescer) Serve(ctx context.Context) {
+	var lastRun time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.requests:
+		}
+		if !c.settle(ctx) {
+			return
+		}
+		if wait := time.Until(lastRun.Add(c.MinInterval)); wait > 0 {
+			c.logger().Debug().Dur("wait", wait).Msg("waiting out minimum interval before triggered sync")
+			if !sleep(ctx, wait) {
+				return
+			}
+		}
+		// anything that arrived while waiting is covered by this run
+		select {
+		case <-c.requests:
+		default:
+		}
+		lastRun = time.Now()
+		c.Run()
+	}
+}
+
+// settle waits until no triggers arrive for Debounce, or maxDebounces of them have passed. It reports
+// false if ctx was done first.
+func (c *Coalescer) settle(ctx context.Context) bool {
+	if c.Debounce <= 0 {
+		return true
+	}
+	timer := time.NewTimer(c.Debounce)
+	defer timer.Stop()
+	for coalesced := 0; ; coalesced++ {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+			return true
+		case <-c.requests:
+			if coalesced+1 >= maxDebounces {
+				c.logger().Debug().Int("coalesced", coalesced+1).Msg("triggers keep arriving, running sync anyway")
+				return true
+			}
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(c.Debounce)
+		}
+	}
+}
+
+func (c *Coalescer) logger() *zerolog.Logger {
+	if c.Logger == nil {
+		return &log.Logger
+	}
+	return c.Logger
+}
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
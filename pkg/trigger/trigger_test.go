@@ -0,0 +1,115 @@
+package trigger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// every returns n trigger times, interval apart.
+func every(interval time.Duration, n int) []time.Duration {
+	triggers := make([]time.Duration, n)
+	for i := range triggers {
+		triggers[i] = time.Duration(i) * interval
+	}
+	return triggers
+}
+
+func TestCoalescer(t *testing.T) {
+	tests := []struct {
+		name        string
+		debounce    time.Duration
+		minInterval time.Duration
+		// triggers are when to trigger, relative to the start
+		triggers []time.Duration
+		wantRuns int
+		// wantGap is the least time between runs
+		wantGap time.Duration
+	}{
+		{
+			name:     "burst",
+			debounce: 50 * time.Millisecond,
+			triggers: []time.Duration{0, 0, 5 * time.Millisecond, 10 * time.Millisecond},
+			wantRuns: 1,
+		},
+		{
+			name:     "separate bursts",
+			debounce: 20 * time.Millisecond,
+			triggers: []time.Duration{0, 5 * time.Millisecond, 150 * time.Millisecond},
+			wantRuns: 2,
+		},
+		{
+			name:     "steady stream",
+			debounce: 40 * time.Millisecond,
+			triggers: every(10*time.Millisecond, 13),
+			wantRuns: 2,
+		},
+		{
+			name:        "minimum interval",
+			minInterval: 150 * time.Millisecond,
+			triggers:    []time.Duration{0, 50 * time.Millisecond},
+			wantRuns:    2,
+			wantGap:     150 * time.Millisecond,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runs := make(chan time.Time, 10)
+			coalescer := New(test.debounce, test.minInterval, func() { runs <- time.Now() })
+			logger := zerolog.Nop()
+			coalescer.Logger = &logger
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go coalescer.Serve(ctx)
+			start := time.Now()
+			for _, at := range test.triggers {
+				time.Sleep(time.Until(start.Add(at)))
+				coalescer.Trigger()
+			}
+			// give the last triggers time to settle
+			time.Sleep(test.debounce + test.minInterval + 100*time.Millisecond)
+			cancel()
+			var times []time.Time
+			for len(runs) > 0 {
+				times = append(times, <-runs)
+			}
+			if len(times) != test.wantRuns {
+				t.Fatalf("ran %d times, want %d", len(times), test.wantRuns)
+			}
+			for i := 1; i < len(times); i++ {
+				if gap := times[i].Sub(times[i-1]); gap < test.wantGap {
+					t.Errorf("runs %d and %d were %s apart, want at least %s", i, i+1, gap, test.wantGap)
+				}
+			}
+		})
+	}
+}
+
+func TestCoalescerTriggerDuringRun(t *testing.T) {
+	var (
+		runs      = make(chan struct{}, 10)
+		coalescer *Coalescer
+		first     = true
+	)
+	coalescer = New(0, 0, func() {
+		if first {
+			first = false
+			// triggers during a run cause exactly one more
+			coalescer.Trigger()
+			coalescer.Trigger()
+		}
+		runs <- struct{}{}
+	})
+	logger := zerolog.Nop()
+	coalescer.Logger = &logger
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go coalescer.Serve(ctx)
+	coalescer.Trigger()
+	time.Sleep(100 * time.Millisecond)
+	if len(runs) != 2 {
+		t.Errorf("ran %d times, want 2", len(runs))
+	}
+}
@@ -0,0 +1,138 @@
+// Package webhook receives Tailscale webhook events, verifying that Tailscale sent them.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// SignatureHeader is the header Tailscale signs webhook requests with.
+const SignatureHeader = "Tailscale-Webhook-Signature"
+
+const (
+	// maxSkew is how old (or far in the future) a signature's timestamp may be, limiting replays
+	maxSkew = 5 * time.Minute
+	// maxBody is the largest request body read, which is plenty for a batch of events
+	maxBody = 1 << 20
+)
+
+// Event is a single Tailscale webhook event. Tailscale sends them in batches.
+type Event struct {
+	Timestamp time.Time       `json:"timestamp"`
+	Version   int             `json:"version"`
+	Type      string          `json:"type"`
+	Tailnet   string          `json:"tailnet"`
+	Message   string          `json:"message"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// deviceEvents are the event types that can change which records a sync publishes.
+var deviceEvents = map[string]bool{
+	"nodeCreated":       true,
+	"nodeNeedsApproval": true,
+	"nodeApproved":      true,
+	"nodeKeyExpired":    true,
+	"nodeDeleted":       true,
+}
+
+// DeviceEvent reports whether the event can change which records a sync publishes.
+func (e Event) DeviceEvent() bool {
+	return deviceEvents[e.Type]
+}
+
+// Verify checks a Tailscale-Webhook-Signature header of the form "t=<unix time>,v1=<hex HMAC>"
+// against the request body, where the HMAC-SHA256 is of "<unix time>.<body>" keyed by the webhook
+// secret. Signatures more than a few minutes from now are rejected.
+func Verify(secret, signature string, body []byte, now time.Time) error {
+	var (
+		timestamp string
+		macs      []string
+	)
+	for _, field := range strings.Split(signature, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			macs = append(macs, value)
+		}
+	}
+	if timestamp == "" || len(macs) == 0 {
+		return fmt.Errorf("malformed %s header", SignatureHeader)
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("error parsing signature timestamp: %s", err)
+	}
+	if skew := now.Sub(time.Unix(unix, 0)); skew > maxSkew || skew < -maxSkew {
+		return fmt.Errorf("signature timestamp is %s off", skew.Round(time.Second))
+	}
+	h := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(h, "%s.%s", timestamp, body)
+	want := h.Sum(nil)
+	// several v1 signatures are sent while a secret is being rotated
+	for _, mac := range macs {
+		got, err := hex.DecodeString(mac)
+		if err == nil && hmac.Equal(got, want) {
+			return nil
+		}
+	}
+	return fmt.Errorf("signature doesn't match")
+}
+
+// Handler is an http.Handler that receives webhook requests, calling OnEvents with each verified batch
+// of events.
+type Handler struct {
+	Secret   string
+	OnEvents func([]Event)
+	// Logger receives the Handler's logs. Defaults to zerolog's global logger.
+	Logger *zerolog.Logger
+}
+
+func (h *Handler) logger() *zerolog.Logger {
+	if h.Logger == nil {
+		return &log.Logger
+	}
+	return h.Logger
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBody))
+	if err != nil {
+		http.Error(w, "error reading body", http.StatusBadRequest)
+		return
+	}
+	if err := Verify(h.Secret, r.Header.Get(SignatureHeader), body, time.Now()); err != nil {
+		h.logger().Warn().Err(err).Str("remoteAddr", r.RemoteAddr).Msg("rejecting webhook request")
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	var events []Event
+	if err := json.Unmarshal(body, &events); err != nil {
+		h.logger().Warn().Err(err).Msg("error unmarshalling webhook events as JSON")
+		http.Error(w, "invalid events", http.StatusBadRequest)
+		return
+	}
+	h.OnEvents(events)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,118 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func sign(secret string, at time.Time, body string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(h, "%d.%s", at.Unix(), body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func TestVerify(t *testing.T) {
+	var (
+		now  = time.Unix(1700000000, 0)
+		body = `[{"type":"nodeCreated"}]`
+	)
+	tests := []struct {
+		name      string
+		signature string
+		wantErr   bool
+	}{
+		{name: "valid", signature: fmt.Sprintf("t=%d,v1=%s", now.Unix(), sign("secret", now, body))},
+		{name: "slightly old", signature: fmt.Sprintf("t=%d,v1=%s", now.Unix()-60, sign("secret", now.Add(-time.Minute), body))},
+		{name: "rotating secrets", signature: fmt.Sprintf("t=%d,v1=%s,v1=%s", now.Unix(), sign("old", now, body), sign("secret", now, body))},
+		{name: "wrong secret", signature: fmt.Sprintf("t=%d,v1=%s", now.Unix(), sign("other", now, body)), wantErr: true},
+		{name: "stale", signature: fmt.Sprintf("t=%d,v1=%s", now.Unix()-600, sign("secret", now.Add(-10*time.Minute), body)), wantErr: true},
+		{name: "future", signature: fmt.Sprintf("t=%d,v1=%s", now.Unix()+600, sign("secret", now.Add(10*time.Minute), body)), wantErr: true},
+		{name: "signed other timestamp", signature: fmt.Sprintf("t=%d,v1=%s", now.Unix(), sign("secret", now.Add(-time.Second), body)), wantErr: true},
+		{name: "no timestamp", signature: "v1=" + sign("secret", now, body), wantErr: true},
+		{name: "no signature", signature: fmt.Sprintf("t=%d", now.Unix()), wantErr: true},
+		{name: "bad timestamp", signature: "t=soon,v1=" + sign("secret", now, body), wantErr: true},
+		{name: "bad hex", signature: fmt.Sprintf("t=%d,v1=zz", now.Unix()), wantErr: true},
+		{name: "empty", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Verify("secret", test.signature, []byte(body), now)
+			if (err != nil) != test.wantErr {
+				t.Errorf("Verify() = %v, want error: %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	body := `[{"type":"nodeCreated","tailnet":"t"},{"type":"policyUpdate","tailnet":"t"}]`
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		signature  string
+		wantStatus int
+		wantEvents int
+	}{
+		{
+			name:       "events",
+			method:     http.MethodPost,
+			body:       body,
+			signature:  fmt.Sprintf("t=%d,v1=%s", time.Now().Unix(), sign("secret", time.Now(), body)),
+			wantStatus: http.StatusOK,
+			wantEvents: 2,
+		},
+		{name: "GET", method: http.MethodGet, wantStatus: http.StatusMethodNotAllowed},
+		{name: "unsigned", method: http.MethodPost, body: body, wantStatus: http.StatusUnauthorized},
+		{
+			name:       "not JSON",
+			method:     http.MethodPost,
+			body:       "hello",
+			signature:  fmt.Sprintf("t=%d,v1=%s", time.Now().Unix(), sign("secret", time.Now(), "hello")),
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var events []Event
+			logger := zerolog.Nop()
+			handler := &Handler{
+				Secret:   "secret",
+				OnEvents: func(received []Event) { events = received },
+				Logger:   &logger,
+			}
+			request := httptest.NewRequest(test.method, "/", strings.NewReader(test.body))
+			request.Header.Set(SignatureHeader, test.signature)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			if recorder.Code != test.wantStatus {
+				t.Errorf("status = %d, want %d", recorder.Code, test.wantStatus)
+			}
+			if len(events) != test.wantEvents {
+				t.Errorf("got %d events, want %d", len(events), test.wantEvents)
+			}
+		})
+	}
+}
+
+func TestDeviceEvent(t *testing.T) {
+	for eventType, want := range map[string]bool{
+		"nodeCreated":  true,
+		"nodeDeleted":  true,
+		"policyUpdate": false,
+		"test":         false,
+	} {
+		if got := (Event{Type: eventType}).DeviceEvent(); got != want {
+			t.Errorf("%s DeviceEvent() = %t, want %t", eventType, got, want)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+// Package zabbix creates Zabbix hosts for tailnet devices through the JSON-RPC API, and disables the
+// ones it created once their devices are gone.
+package zabbix
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/mark-ignacio/tailscale2cloudflare/pkg/sync"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	managedByTag   = "managed-by"
+	managedByValue = "tailscale2cloudflare"
+	// tailscaleTag is the host tag each of a device's Tailscale tags is copied to.
+	tailscaleTag = "tailscale"
+
+	hostEnabled  = "0"
+	hostDisabled = "1"
+)
+
+type Options struct {
+	// URL of the Zabbix frontend, e.g. https://zabbix.example.com. Requires Zabbix 6.4 or later.
+	URL      string
+	APIToken string
+	// Group is the name of the host group hosts are created in.
+	Group string
+	// Templates are names of templates to link to created hosts.
+	Templates []string
+	// Domain, if set, is appended to device names, so hosts are named like their DNS records.
+	Domain string
+	DryRun bool
+}
+
+type host struct {
+	HostID     string          `json:"hostid"`
+	Host       string          `json:"host"`
+	Status     string          `json:"status"`
+	Interfaces []hostInterface `json:"interfaces"`
+}
+
+type hostInterface struct {
+	InterfaceID string `json:"interfaceid"`
+	IP          string `json:"ip"`
+}
+
+type hostTag struct {
+	Tag   string `json:"tag"`
+	Value string `json:"value"`
+}
+
+type rpcResponse struct {
+	Result json.RawMessage
+	Error  *struct {
+		Code    int
+		Message string
+		Data    string
+	}
+}
+
+// Sync creates an agent-interface host for each device, re-enabling and re-addressing hosts it
+// created before, and disables hosts it created for devices that are gone. Hosts aren't deleted so
+// that their history is kept.
+func Sync(devices map[string]sync.Device, opts Options) error {
+	var existing []host
+	err := call(opts, "host.get", map[string]interface{}{
+		"output":           []string{"hostid", "host", "status"},
+		"selectInterfaces": []string{"interfaceid", "ip"},
+		"tags":             []hostTag{{Tag: managedByTag, Value: managedByValue}},
+	}, &existing)
+	if err != nil {
+		return err
+	}
+	existingHosts := make(map[string]host, len(existing))
+	for _, h := range existing {
+		existingHosts[h.Host] = h
+	}
+	labels := make([]string, 0, len(devices))
+	for label := range devices {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	var (
+		groupID     string
+		templateIDs []map[string]string
+	)
+	for _, label := range labels {
+		device := devices[label]
+		ipv4s := device.IPv4s()
+		if len(ipv4s) == 0 {
+			continue
+		}
+		name := hostName(label, opts.Domain)
+		logger := log.With().Str("host", name).Str("address", ipv4s[0]).Logger()
+		tags := hostTags(device)
+		if h, ok := existingHosts[name]; ok {
+			if h.Status == hostEnabled && len(h.Interfaces) > 0 && h.Interfaces[0].IP == ipv4s[0] {
+				logger.Debug().Msg("Zabbix host up to date")
+				continue
+			}
+			logger.Info().Bool("dryRun", opts.DryRun).Msg("updating Zabbix host")
+			if opts.DryRun {
+				continue
+			}
+			err := call(opts, "host.update", map[string]interface{}{
+				"hostid": h.HostID,
+				"status": hostEnabled,
+				"tags":   tags,
+			}, nil)
+			if err != nil {
+				return err
+			}
+			if len(h.Interfaces) > 0 && h.Interfaces[0].IP != ipv4s[0] {
+				err := call(opts, "hostinterface.update", map[string]interface{}{
+					"interfaceid": h.Interfaces[0].InterfaceID,
+					"ip":          ipv4s[0],
+				}, nil)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		logger.Info().Bool("dryRun", opts.DryRun).Msg("creating Zabbix host")
+		if opts.DryRun {
+			continue
+		}
+		if groupID == "" {
+			if groupID, templateIDs, err = lookupIDs(opts); err != nil {
+				return err
+			}
+		}
+		err := call(opts, "host.create", map[string]interface{}{
+			"host":   name,
+			"status": hostEnabled,
+			"groups": []map[string]string{{"groupid": groupID}},
+			"interfaces": []map[string]interface{}{{
+				"type":  1, // agent
+				"main":  1,
+				"useip": 1,
+				"ip":    ipv4s[0],
+				"dns":   "",
+				"port":  "10050",
+			}},
+			"templates": templateIDs,
+			"tags":      tags,
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	for _, h := range existing {
+		if _, ok := devices[strings.TrimSuffix(h.Host, "."+opts.Domain)]; ok || h.Status == hostDisabled {
+			continue
+		}
+		log.Info().Str("host", h.Host).Bool("dryRun", opts.DryRun).Msg("disabling Zabbix host")
+		if opts.DryRun {
+			continue
+		}
+		if err := call(opts, "host.update", map[string]interface{}{"hostid": h.HostID, "status": hostDisabled}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupIDs resolves the host group and template names in opts.
+func lookupIDs(opts Options) (string, []map[string]string, error) {
+	var groups []struct {
+		GroupID string `json:"groupid"`
+	}
+	err := call(opts, "hostgroup.get", map[string]interface{}{
+		"output": []string{"groupid"},
+		"filter": map[string][]string{"name": {opts.Group}},
+	}, &groups)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(groups) == 0 {
+		return "", nil, fmt.Errorf("Zabbix host group %q doesn't exist", opts.Group)
+	}
+	templateIDs := []map[string]string{}
+	if len(opts.Templates) > 0 {
+		var templates []struct {
+			TemplateID string `json:"templateid"`
+		}
+		err := call(opts, "template.get", map[string]interface{}{
+			"output": []string{"templateid"},
+			"filter": map[string][]string{"host": opts.Templates},
+		}, &templates)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(templates) != len(opts.Templates) {
+			return "", nil, fmt.Errorf("only found %d of the Zabbix templates %s", len(templates), strings.Join(opts.Templates, ", "))
+		}
+		for _, template := range templates {
+			templateIDs = append(templateIDs, map[string]string{"templateid": template.TemplateID})
+		}
+	}
+	return groups[0].GroupID, templateIDs, nil
+}
+
+func hostName(label, domain string) string {
+	if domain == "" {
+		return label
+	}
+	return label + "." + domain
+}
+
+func hostTags(device sync.Device) []hostTag {
+	tags := []hostTag{{Tag: managedByTag, Value: managedByValue}}
+	for _, tag := range device.Tags {
+		tags = append(tags, hostTag{Tag: tailscaleTag, Value: strings.TrimPrefix(tag, "tag:")})
+	}
+	return tags
+}
+
+func call(opts Options, method string, params interface{}, out interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  method,
+		"params":  params,
+		"id":      1,
+	})
+	if err != nil {
+		return fmt.Errorf("error creating Zabbix %s request body: %s", method, err)
+	}
+	request, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(opts.URL, "/")+"/api_jsonrpc.php", bytes.NewBuffer(body))
+	if err != nil {
+		return fmt.Errorf("error creating Zabbix %s request: %s", method, err)
+	}
+	request.Header.Set("Authorization", "Bearer "+opts.APIToken)
+	request.Header.Set("Content-Type", "application/json-rpc")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("error performing Zabbix %s: %s", method, err)
+	}
+	defer response.Body.Close()
+	body, err = ioutil.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("error reading Zabbix %s body: %s", method, err)
+	}
+	if response.StatusCode > http.StatusOK {
+		return fmt.Errorf("non-200 response to Zabbix %s: %d: %s", method, response.StatusCode, body)
+	}
+	var rpc rpcResponse
+	if err := json.Unmarshal(body, &rpc); err != nil {
+		return fmt.Errorf("error unmarshalling Zabbix %s as JSON: %s", method, err)
+	}
+	if rpc.Error != nil {
+		return fmt.Errorf("Zabbix %s error %d: %s %s", method, rpc.Error.Code, rpc.Error.Message, rpc.Error.Data)
+	}
+	if out != nil {
+		if err := json.Unmarshal(rpc.Result, out); err != nil {
+			return fmt.Errorf("error unmarshalling Zabbix %s result: %s", method, err)
+		}
+	}
+	return nil
+}